@@ -1,8 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"os"
 	"os/exec"
 	"time"
 )
@@ -14,6 +19,40 @@ type Arduino struct {
 	portName     string
 	bootloaderID int
 	ardOS        ArduinoOS // структура с данными для поиска устройства на определённой ОС
+	uploader     string    // программа для прошивки (см. arduinoNative.go)
+	baud         int       // скорость порта для встроенной реализации протокола
+	fqbn         string    // полное название платы для arduino-cli
+	// область flash-памяти, занятая загрузчиком (из шаблона), nil, если загрузчика нет
+	bootSection *MemoryRegion
+}
+
+func init() {
+	registerBoardType(&BoardType{
+		Name:      "arduino",
+		Detection: SerialDetection,
+		New: func(temp BoardTemplate, found FoundDevice) Board {
+			return NewArduinoFromTemp(temp, found.Ports[0], found.ArduinoOS, found.SerialID)
+		},
+		Refresh: func(old *Device, found *Device) bool {
+			oldArduino := old.Board.(*Arduino)
+			newArduino := found.Board.(*Arduino)
+			if oldArduino.portName == newArduino.portName {
+				return false
+			}
+			oldArduino.portName = newArduino.portName
+			return true
+		},
+		ProgressMsg:          FlashBacktrackMsg,
+		FlashesThroughSerial: true,
+		Timeouts: map[DeviceOperation]int{
+			// у Arduino Micro в это время также входит поиск bootloader (до 12,5 секунд)
+			FlashOperation:   90,
+			PingOperation:    15,
+			ResetOperation:   15,
+			ExtractOperation: 90,
+			VerifyOperation:  90,
+		},
+	})
 }
 
 func NewArduinoFromTemp(temp BoardTemplate, portName string, ardOS ArduinoOS, serialID string) *Arduino {
@@ -37,6 +76,10 @@ func NewArduinoFromTemp(temp BoardTemplate, portName string, ardOS ArduinoOS, se
 		serialID:     serialID,
 		portName:     portName,
 		ardOS:        ardOS,
+		uploader:     arduinoPayload.Uploader,
+		baud:         arduinoPayload.Baud,
+		fqbn:         arduinoPayload.FQBN,
+		bootSection:  temp.Bootloader,
 	}
 }
 
@@ -48,19 +91,39 @@ func CopyArduino(board *Arduino) *Arduino {
 		serialID:     board.serialID,
 		portName:     board.portName,
 		ardOS:        board.ardOS,
+		uploader:     board.uploader,
+		baud:         board.baud,
+		fqbn:         board.fqbn,
+		bootSection:  board.bootSection,
 	}
 }
 
-func (board *Arduino) avrdude(args ...string) ([]byte, error) {
+// аргументы avrdude для этого устройства, к которым добавляются args
+func (board *Arduino) avrdudeArgs(args ...string) []string {
 	defaultArgs := []string{"-D", "-p", board.controller, "-c", board.programmer, "-P", board.portName}
 	if configPath != "" {
 		defaultArgs = append(defaultArgs, "-C", configPath)
 	}
-	defaultArgs = append(defaultArgs, args...)
-	cmd := exec.Command(avrdudePath, defaultArgs...)
+	return append(defaultArgs, args...)
+}
+
+// запуск avrdude, процесс завершается принудительно при отмене контекста ctx
+func (board *Arduino) avrdude(ctx context.Context, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, avrdudePath, board.avrdudeArgs(args...)...)
 	return cmd.CombinedOutput()
 }
 
+// аналогично avrdude, но дополнительно отправляет прогресс выполнения в logger по мере вывода avrdude
+func (board *Arduino) avrdudeWithProgress(ctx context.Context, logger chan any, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, avrdudePath, board.avrdudeArgs(args...)...)
+	var output bytes.Buffer
+	writer := io.MultiWriter(&output, newAvrdudeProgressParser(logger))
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+	err := cmd.Run()
+	return output.Bytes(), err
+}
+
 // подключено ли устройство
 func (board *Arduino) IsConnected() bool {
 	return board.portName != NOT_FOUND
@@ -74,52 +137,346 @@ func (board *Arduino) hasBootloader() bool {
 	return board.bootloaderID != -1
 }
 
-func (board *Arduino) flashBootloader(filePath string, logger chan any) (string, error) {
-	flasherSync.Lock()
-	defer flasherSync.Unlock()
-	if e := rebootPort(board.portName); e != nil {
-		return "Не удалось перезагрузить порт", e
-	}
+// количество попыток найти bootloader после перезагрузки, между попытками проходит 500 мс
+const bootloaderSearchAttempts = 25
+
+/*
+Перезагрузка устройства в режим bootloader и выполнение action над найденным bootloader.
+
+Используется для устройств, которые прошиваются через отдельный bootloader (например, Arduino Micro).
+Прогресс поиска bootloader отправляется в logger (этап bootloader), logger не закрывается.
+Устройства с разными bootloader'ами, а также устройства с известным расположением на шине, прошиваются одновременно.
+*/
+func (board *Arduino) withBootloader(ctx context.Context, logger chan any, action func(bootloader Board) (string, error)) (string, error) {
 	bootloaderType := board.bootloaderID
 	detector.DontAddThisType(bootloaderType)
 	defer detector.AddThisType(bootloaderType)
 	defer time.Sleep(500 * time.Millisecond)
-	var notAddedDevices map[string]*Device
-	found := false
-	for i := 0; i < 25; i++ {
+	bootloaderID, bootloaderDevice, msg, err := board.findBootloader(ctx, logger)
+	if err != nil {
+		return msg, err
+	}
+	defer bootloaders.release(bootloaderID)
+	return action(bootloaderDevice.Board)
+}
+
+/*
+Перезагрузка в bootloader и поиск его среди устройств, которые детектор не добавляет в список.
+
+Если расположение устройства на шине неизвестно, то на время перезагрузки и поиска блокируются другие устройства
+с таким же bootloader (см. bootloaderSync). Найденный bootloader занят, пока не будет вызван bootloaders.release.
+Возвращает ID и устройство bootloader, либо сообщение для клиента и ошибку.
+*/
+func (board *Arduino) findBootloader(ctx context.Context, logger chan any) (string, *Device, string, error) {
+	location := board.ardOS.usbLocation()
+	if location == "" {
+		unlock := bootloaders.lockTemplate(board.bootloaderID)
+		defer unlock()
+	}
+	if e := board.rebootToBootloader(); e != nil {
+		return "", nil, "Не удалось перезагрузить порт", e
+	}
+	reporter := newProgressReporter(logger, BOOTLOADER_STAGE)
+	reporter.report(0, bootloaderSearchAttempts)
+	for i := 0; i < bootloaderSearchAttempts; i++ {
 		// TODO: возможно стоит добавить количество необходимого времени в параметры сервера
 		time.Sleep(500 * time.Millisecond)
+		if ctx.Err() != nil {
+			return "", nil, "Поиск Bootloader прерван.", ctx.Err()
+		}
 		printLog("Попытка найти подходящее устройство", i+1)
-		_, notAddedDevices, _ = detector.Update()
-		sameTypeCnt := 0
-		var bootloaderDevice *Device
-		for _, dev := range notAddedDevices {
-			if dev.TypeDesc.ID == bootloaderType {
-				bootloaderDevice = dev
-				sameTypeCnt++
-				if sameTypeCnt > 1 {
-					return "Не удалось опознать Bootloader. Ошибка могла быть вызвана перезагрузкой одного из устройств, либо из-за подключения нового.", errors.New("bootloader: too many")
-				}
-				found = true
-			}
+		_, notAddedDevices, _ := detector.Update()
+		bootloaderID, bootloaderDevice, err := bootloaders.claim(notAddedDevices, board.bootloaderID, location)
+		if err != nil {
+			return "", nil, "Не удалось опознать Bootloader. Ошибка могла быть вызвана перезагрузкой одного из устройств, либо из-за подключения нового.", err
+		}
+		if bootloaderDevice != nil {
+			reporter.report(bootloaderSearchAttempts, bootloaderSearchAttempts)
+			return bootloaderID, bootloaderDevice, "", nil
 		}
-		if found {
-			return bootloaderDevice.Board.Flash(filePath, logger)
+	}
+	return "", nil, "Не удалось найти Bootloader.", errors.New("bootloader: not found")
+}
+
+// расположение устройства на шине, пустая строка, если оно неизвестно
+func (board *Arduino) usbLocation() string {
+	return board.ardOS.usbLocation()
+}
+
+// перезагрузка в bootloader: через serial-порт для встроенных загрузчиков, иначе через stty (MODE в Windows)
+func (board *Arduino) rebootToBootloader() error {
+	if board.isNative() {
+		return touch1200(board.portName)
+	}
+	return rebootPort(board.portName)
+}
+
+func (board *Arduino) flashBootloader(ctx context.Context, filePath string, logger chan any) (string, error) {
+	return board.withBootloader(ctx, logger, func(bootloader Board) (string, error) {
+		if bootloader, isArduino := bootloader.(*Arduino); isArduino {
+			return bootloader.flash(ctx, filePath, logger)
 		}
+		return bootloader.Flash(ctx, filePath, nil)
+	})
+}
+
+// прогресс прошивки отправляется в logger, после завершения прошивки logger закрывается
+func (board *Arduino) Flash(ctx context.Context, filePath string, logger chan any) (string, error) {
+	if logger != nil {
+		defer close(logger)
 	}
-	return "Не удалось найти Bootloader.", errors.New("bootloader: not found")
+	return board.flash(ctx, filePath, logger)
 }
 
-func (board *Arduino) Flash(filePath string, logger chan any) (string, error) {
+// прошивка без закрытия logger, нужна, чтобы передать logger в bootloader
+func (board *Arduino) flash(ctx context.Context, filePath string, logger chan any) (string, error) {
+	if board.usesArduinoCli() {
+		return board.arduinoCliFlash(ctx, filePath, logger)
+	}
 	if board.hasBootloader() {
-		return board.flashBootloader(filePath, logger)
+		return board.flashBootloader(ctx, filePath, logger)
+	}
+	if board.isNative() {
+		return board.nativeFlash(ctx, filePath, logger)
 	}
 	flashFile := "flash:w:" + getAbolutePath(filePath) + ":a"
-	stdout, err := board.avrdude("-U", flashFile)
+	var stdout []byte
+	var err error
+	if logger != nil {
+		stdout, err = board.avrdudeWithProgress(ctx, logger, "-U", flashFile)
+	} else {
+		stdout, err = board.avrdude(ctx, "-U", flashFile)
+	}
 	avrdudeMessage := handleFlashResult(string(stdout), err)
 	return avrdudeMessage, err
 }
 
+// команды, которые будут выполнены при прошивке, для устройств с bootloader порт bootloader заранее неизвестен
+func (board *Arduino) FlashPlan(filePath string) []string {
+	if board.usesArduinoCli() {
+		return []string{formatCommand(arduinoCliPath, board.arduinoCliUploadArgs(filePath))}
+	}
+	flashFile := "flash:w:" + getAbolutePath(filePath) + ":a"
+	if !board.hasBootloader() {
+		if board.isNative() {
+			return board.nativeFlashPlan(filePath)
+		}
+		return []string{formatCommand(avrdudePath, board.avrdudeArgs("-U", flashFile))}
+	}
+	plan := []string{
+		fmt.Sprintf("перезагрузка порта %s в режим bootloader (%s)", board.portName, board.rebootMethod()),
+		fmt.Sprintf("поиск bootloader (ID шаблона %d)", board.bootloaderID),
+	}
+	temp, exists := detector.findTemplate(board.bootloaderID)
+	if !exists || temp.Type != "arduino" {
+		return append(plan, "прошивка через bootloader")
+	}
+	bootloader := NewArduinoFromTemp(*temp, "<порт bootloader>", board.ardOS, "")
+	return append(plan, bootloader.FlashPlan(filePath)...)
+}
+
+// сравнение прошивки устройства с файлом (avrdude -U flash:v), прогресс отправляется в logger, после завершения проверки logger закрывается
+func (board *Arduino) Verify(ctx context.Context, filePath string, logger chan any) (VerifyResult, error) {
+	if logger != nil {
+		defer close(logger)
+	}
+	return board.verify(ctx, filePath, logger)
+}
+
+// проверка без закрытия logger, нужна, чтобы передать logger в bootloader
+func (board *Arduino) verify(ctx context.Context, filePath string, logger chan any) (VerifyResult, error) {
+	if board.hasBootloader() {
+		var result VerifyResult
+		msg, err := board.withBootloader(ctx, logger, func(bootloader Board) (string, error) {
+			arduinoBootloader, isArduino := bootloader.(*Arduino)
+			if !isArduino {
+				return "Проверка прошивки недоступна для этого bootloader.", errors.New("bootloader: verify is not supported")
+			}
+			var err error
+			result, err = arduinoBootloader.verify(ctx, filePath, logger)
+			return result.Message, err
+		})
+		if err != nil {
+			return VerifyResult{Match: false, Address: -1, Message: msg}, err
+		}
+		return result, nil
+	}
+	if board.isNative() {
+		return board.nativeVerify(ctx, filePath, logger)
+	}
+	verifyFile := "flash:v:" + getAbolutePath(filePath) + ":a"
+	var stdout []byte
+	var err error
+	if logger != nil {
+		stdout, err = board.avrdudeWithProgress(ctx, logger, "-U", verifyFile)
+	} else {
+		stdout, err = board.avrdude(ctx, "-U", verifyFile)
+	}
+	output := string(stdout)
+	// при несовпадении avrdude завершается с ошибкой, но это не является ошибкой проверки
+	if address, mismatch := avrdudeMismatchAddress(output); mismatch && ctx.Err() == nil {
+		return VerifyResult{Match: false, Address: address, Message: output}, nil
+	}
+	avrdudeMessage := handleFlashResult(output, err)
+	if err != nil {
+		return VerifyResult{Match: false, Address: -1, Message: avrdudeMessage}, err
+	}
+	return VerifyResult{Match: true, Address: -1, Message: avrdudeMessage}, nil
+}
+
+// выгрузка прошивки из устройства (avrdude -U flash:r), прерывается при отмене контекста ctx
+func (board *Arduino) Extract(ctx context.Context) ([]byte, error) {
+	if board.hasBootloader() {
+		var data []byte
+		_, err := board.withBootloader(ctx, nil, func(bootloader Board) (string, error) {
+			arduinoBootloader, isArduino := bootloader.(*Arduino)
+			if !isArduino {
+				return "", errors.New("bootloader: extract is not supported")
+			}
+			var err error
+			data, err = arduinoBootloader.Extract(ctx)
+			return "", err
+		})
+		return data, err
+	}
+	if board.isNative() {
+		return board.nativeExtract(ctx)
+	}
+	return board.readMemory(ctx, "flash")
+}
+
+// чтение EEPROM устройства (avrdude -U eeprom:r), прерывается при отмене контекста ctx
+func (board *Arduino) ReadEEPROM(ctx context.Context) ([]byte, error) {
+	return board.readMemory(ctx, "eeprom")
+}
+
+// запись файла в EEPROM устройства (avrdude -U eeprom:w), возвращает сообщение от avrdude
+func (board *Arduino) WriteEEPROM(ctx context.Context, filePath string) (string, error) {
+	if board.hasBootloader() {
+		return board.withBootloader(ctx, nil, func(bootloader Board) (string, error) {
+			arduinoBootloader, isArduino := bootloader.(*Arduino)
+			if !isArduino {
+				return "Запись EEPROM недоступна для этого bootloader.", errors.New("bootloader: eeprom is not supported")
+			}
+			return arduinoBootloader.WriteEEPROM(ctx, filePath)
+		})
+	}
+	stdout, err := board.avrdude(ctx, "-U", "eeprom:w:"+getAbolutePath(filePath)+":a")
+	return handleFlashResult(string(stdout), err), err
+}
+
+// чтение области памяти memory (flash, eeprom) через avrdude в бинарном виде
+func (board *Arduino) readMemory(ctx context.Context, memory string) ([]byte, error) {
+	data, err := board.readMemories(ctx, memory)
+	if err != nil {
+		return nil, err
+	}
+	return data[0], nil
+}
+
+// чтение нескольких областей памяти за один запуск avrdude, данные возвращаются в том же порядке, что и memories
+func (board *Arduino) readMemories(ctx context.Context, memories ...string) ([][]byte, error) {
+	if board.hasBootloader() {
+		var data [][]byte
+		_, err := board.withBootloader(ctx, nil, func(bootloader Board) (string, error) {
+			arduinoBootloader, isArduino := bootloader.(*Arduino)
+			if !isArduino {
+				return "", errors.New("bootloader: reading memory is not supported")
+			}
+			var err error
+			data, err = arduinoBootloader.readMemories(ctx, memories...)
+			return "", err
+		})
+		return data, err
+	}
+	// avrdude записывает считанные данные только в файл, поэтому они сохраняются во временные файлы
+	memoryPaths := make([]string, 0, len(memories))
+	defer func() {
+		for _, memoryPath := range memoryPaths {
+			os.Remove(memoryPath)
+		}
+	}()
+	args := make([]string, 0, 2*len(memories))
+	for _, memory := range memories {
+		tempFile, err := os.CreateTemp("", memory+"-*.bin")
+		if err != nil {
+			return nil, err
+		}
+		memoryPaths = append(memoryPaths, tempFile.Name())
+		tempFile.Close()
+		args = append(args, "-U", memory+":r:"+tempFile.Name()+":r")
+	}
+	stdout, err := board.avrdude(ctx, args...)
+	if err != nil {
+		return nil, errors.New(handleFlashResult(string(stdout), err))
+	}
+	data := make([][]byte, 0, len(memories))
+	for _, memoryPath := range memoryPaths {
+		memoryData, err := os.ReadFile(memoryPath)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, memoryData)
+	}
+	return data, nil
+}
+
+// чтение fuse-битов и lock-битов устройства через ISP-программатор или загрузчик, который их поддерживает
+func (board *Arduino) ReadFuses(ctx context.Context) (map[string]byte, error) {
+	if !board.Supports(FuseOperation) {
+		return nil, errors.New("загрузчик не может читать fuse-биты, нужен ISP-программатор")
+	}
+	data, err := board.readMemories(ctx, fuseNames...)
+	if err != nil {
+		return nil, err
+	}
+	fuses := make(map[string]byte, len(fuseNames))
+	for i, fuse := range fuseNames {
+		if len(data[i]) != 1 {
+			return nil, fmt.Errorf("avrdude вернул %d байт вместо одного при чтении %s", len(data[i]), fuse)
+		}
+		fuses[fuse] = data[i][0]
+	}
+	return fuses, nil
+}
+
+// fuse-биты записываются только через ISP-программатор, загрузчики (arduino, avr109, wiring) их не записывают
+func (board *Arduino) CanWriteFuses() bool {
+	return !isBootloaderProgrammer(board.programmer)
+}
+
+// проверка новых значений fuse-битов по таблице безопасных значений для контроллера этого устройства
+func (board *Arduino) CheckFuses(fuses map[string]byte) error {
+	return checkFuseSafety(board.controller, board.bootSection, fuses)
+}
+
+// запись fuse-битов и lock-битов (avrdude -U <fuse>:w:<value>:m), доступна только через ISP-программатор, возвращает сообщение от avrdude
+func (board *Arduino) WriteFuses(ctx context.Context, fuses map[string]byte) (string, error) {
+	if !board.CanWriteFuses() {
+		err := errors.New("загрузчик не может записывать fuse-биты, нужен ISP-программатор")
+		return err.Error(), err
+	}
+	args := make([]string, 0, 2*len(fuses))
+	// порядок записи должен быть всегда одинаковым, поэтому перебирается fuseNames, а не fuses
+	for _, fuse := range fuseNames {
+		value, ok := fuses[fuse]
+		if !ok {
+			continue
+		}
+		args = append(args, "-U", fmt.Sprintf("%s:w:0x%02x:m", fuse, value))
+	}
+	stdout, err := board.avrdude(ctx, args...)
+	return handleFlashResult(string(stdout), err), err
+}
+
+// fuse-биты не читаются через загрузчики arduino (Optiboot) и urclock
+func (board *Arduino) Supports(op DeviceOperation) bool {
+	if op == FuseOperation {
+		return canReadFuses(board.programmer)
+	}
+	return true
+}
+
 func (board *Arduino) hasSerial() bool {
 	return board.serialID != NOT_FOUND
 }
@@ -130,25 +487,38 @@ func (board *Arduino) GetWebMessageType() string {
 
 func (board *Arduino) GetWebMessage(name string, deviceID string) any {
 	return DeviceMessage{
-		ID:         deviceID,
-		Name:       name,
-		Controller: board.controller,
-		Programmer: board.programmer,
-		SerialID:   board.serialID,
-		PortName:   board.portName,
+		ID:           deviceID,
+		Name:         name,
+		Controller:   board.controller,
+		Programmer:   board.programmer,
+		SerialID:     board.serialID,
+		PortName:     board.portName,
+		LastFirmware: deviceHistory.Last(deviceID),
 	}
 }
 
-func (board *Arduino) Ping() error {
-	_, err := board.avrdude("-n")
+func (board *Arduino) Ping(ctx context.Context) error {
+	if board.usesArduinoCli() {
+		return board.arduinoCliPing(ctx)
+	}
+	if board.isNative() && !board.hasBootloader() {
+		return board.nativePing(ctx)
+	}
+	_, err := board.avrdude(ctx, "-n")
 	return err
 }
 
-func (board *Arduino) Reset() error {
-	_, err := board.avrdude("-r")
+func (board *Arduino) Reset(ctx context.Context) error {
+	if board.usesArduinoCli() {
+		return board.arduinoCliReset(ctx)
+	}
+	_, err := board.avrdude(ctx, "-r")
 	return err
 }
 
-func (board *Arduino) GetMetaData() (any, error) {
+func (board *Arduino) GetMetaData(ctx context.Context) (any, error) {
+	if board.usesArduinoCli() {
+		return board.arduinoCliMetaData(ctx)
+	}
 	return "", errors.New("операция получения метаданных недоступна для этого устройства")
 }
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/albenik/go-serial/v2"
+)
+
+// результат команды arduino-cli с параметром --format json
+type arduinoCliResult struct {
+	// вывод программы прошивки (для upload - вывод avrdude)
+	Stdout string `json:"stdout"`
+	Stderr string `json:"stderr"`
+	// описание ошибки, если команда завершилась неудачно
+	Error string `json:"error"`
+}
+
+// порт из arduino-cli board list --format json
+type arduinoCliDetectedPort struct {
+	Port struct {
+		Address  string `json:"address"`
+		Protocol string `json:"protocol"`
+	} `json:"port"`
+	MatchingBoards []struct {
+		Name string `json:"name"`
+		FQBN string `json:"fqbn"`
+	} `json:"matching_boards"`
+}
+
+// метаданные устройства, полученные через arduino-cli board list
+type ArduinoCliMetaData struct {
+	Board string `json:"board"`
+	FQBN  string `json:"fqbn"`
+}
+
+/*
+true, если устройство прошивается через arduino-cli.
+
+Если arduino-cli не найден, то используется avrdude, как если бы uploader не был указан.
+*/
+func (board *Arduino) usesArduinoCli() bool {
+	return board.uploader == ARDUINO_CLI_UPLOADER && arduinoCliAvailable()
+}
+
+// arduino-cli ищется один раз при первом использовании, а не при каждом пинге или прошивке
+var arduinoCliAvailable = sync.OnceValue(func() bool {
+	if _, err := exec.LookPath(arduinoCliPath); err != nil {
+		printLog("arduino-cli is not found, avrdude is used instead:", err.Error())
+		return false
+	}
+	return true
+})
+
+// аргументы arduino-cli upload для прошивки файлом filePath
+func (board *Arduino) arduinoCliUploadArgs(filePath string) []string {
+	return []string{"upload", "-p", board.portName, "-b", board.fqbn, "-i", getAbolutePath(filePath), "-v", "--format", "json"}
+}
+
+/*
+Запуск arduino-cli с выводом в формате JSON, процесс завершается принудительно при отмене контекста ctx.
+
+Возвращает разобранный результат и вывод программы (для сообщения клиенту, если результат не удалось разобрать).
+Ошибка из поля error результата возвращается вместо кода завершения программы.
+*/
+func arduinoCli(ctx context.Context, args ...string) (arduinoCliResult, []byte, error) {
+	var result arduinoCliResult
+	cmd := exec.CommandContext(ctx, arduinoCliPath, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.Output()
+	output := append(stdout, stderr.Bytes()...)
+	if jsonErr := json.Unmarshal(stdout, &result); jsonErr != nil {
+		if err == nil {
+			err = fmt.Errorf("не удалось разобрать вывод arduino-cli: %w", jsonErr)
+		}
+		return result, output, err
+	}
+	if result.Error != "" {
+		return result, output, errors.New(result.Error)
+	}
+	return result, output, err
+}
+
+/*
+Прошивка через arduino-cli upload, arduino-cli сам перезагружает устройство в bootloader и находит его порт.
+
+В режиме JSON arduino-cli выводит результат только после завершения прошивки,
+поэтому прогресс записи и проверки отправляется в logger по выводу avrdude из результата.
+*/
+func (board *Arduino) arduinoCliFlash(ctx context.Context, filePath string, logger chan any) (string, error) {
+	if board.fqbn == "" {
+		err := errors.New("для прошивки через arduino-cli в описании устройства должно быть указано поле fqbn")
+		return err.Error(), err
+	}
+	if board.hasBootloader() {
+		// порт bootloader появится во время прошивки, его не нужно добавлять в список устройств;
+		// arduino-cli ищет bootloader сам, поэтому устройства с таким же bootloader прошиваются по очереди
+		unlock := bootloaders.lockTemplate(board.bootloaderID)
+		defer unlock()
+		detector.DontAddThisType(board.bootloaderID)
+		defer detector.AddThisType(board.bootloaderID)
+	}
+	if logger != nil {
+		newProgressReporter(logger, WRITING_STAGE).report(0, 1)
+	}
+	result, output, err := arduinoCli(ctx, board.arduinoCliUploadArgs(filePath)...)
+	uploadOutput := strings.TrimSpace(result.Stdout + "\n" + result.Stderr)
+	if logger != nil {
+		newAvrdudeProgressParser(logger).Write([]byte(uploadOutput + "\n"))
+	}
+	if err != nil {
+		return handleFlashResult(string(output), err), err
+	}
+	return uploadOutput, nil
+}
+
+// порт устройства в выводе arduino-cli board list, false, если arduino-cli его не нашёл
+func (board *Arduino) arduinoCliFindPort(ctx context.Context) (arduinoCliDetectedPort, bool, error) {
+	cmd := exec.CommandContext(ctx, arduinoCliPath, "board", "list", "--format", "json")
+	stdout, err := cmd.Output()
+	if err != nil {
+		return arduinoCliDetectedPort{}, false, err
+	}
+	// arduino-cli до версии 1.0 выводит массив портов, а начиная с 1.0 - объект с полем detected_ports
+	var ports []arduinoCliDetectedPort
+	if err := json.Unmarshal(stdout, &ports); err != nil {
+		var list struct {
+			DetectedPorts []arduinoCliDetectedPort `json:"detected_ports"`
+		}
+		if err := json.Unmarshal(stdout, &list); err != nil {
+			return arduinoCliDetectedPort{}, false, fmt.Errorf("не удалось разобрать вывод arduino-cli: %w", err)
+		}
+		ports = list.DetectedPorts
+	}
+	for _, port := range ports {
+		if port.Port.Address == board.portName {
+			return port, true, nil
+		}
+	}
+	return arduinoCliDetectedPort{}, false, nil
+}
+
+// проверка того, что arduino-cli видит порт устройства
+func (board *Arduino) arduinoCliPing(ctx context.Context) error {
+	_, found, err := board.arduinoCliFindPort(ctx)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("arduino-cli не нашёл порт %s", board.portName)
+	}
+	return nil
+}
+
+/*
+Перезагрузка через DTR/RTS, как при открытии порта в Arduino IDE (у arduino-cli нет отдельной команды перезагрузки).
+
+Устройства с отдельным bootloader (Arduino Micro) так не перезагружаются.
+*/
+func (board *Arduino) arduinoCliReset(ctx context.Context) error {
+	if board.hasBootloader() {
+		return errors.New("перезагрузка через arduino-cli недоступна для устройств с bootloader")
+	}
+	port, err := serial.Open(board.portName)
+	if err != nil {
+		return err
+	}
+	resetToBootloader(port)
+	return port.Close()
+}
+
+// название и FQBN платы, которую arduino-cli определил на порту устройства
+func (board *Arduino) arduinoCliMetaData(ctx context.Context) (any, error) {
+	port, found, err := board.arduinoCliFindPort(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("arduino-cli не нашёл порт %s", board.portName)
+	}
+	if len(port.MatchingBoards) == 0 {
+		return ArduinoCliMetaData{FQBN: board.fqbn}, nil
+	}
+	names := make([]string, 0, len(port.MatchingBoards))
+	for _, matching := range port.MatchingBoards {
+		names = append(names, matching.Name)
+	}
+	return ArduinoCliMetaData{
+		Board: strings.Join(names, ", "),
+		FQBN:  port.MatchingBoards[0].FQBN,
+	}, nil
+}
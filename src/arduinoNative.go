@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// программы для прошивки Arduino (поле uploader в typePayload)
+const (
+	// внешняя программа avrdude (по-умолчанию)
+	AVRDUDE_UPLOADER = "avrdude"
+	// встроенная реализация протокола STK500v1 (Optiboot, Arduino Uno)
+	STK500V1_UPLOADER = "stk500v1"
+	// встроенная реализация протокола AVR109 (Caterina, Arduino Micro и Leonardo)
+	AVR109_UPLOADER = "avr109"
+	// встроенная реализация протокола STK500v2 (загрузчик wiring, Arduino Mega)
+	STK500V2_UPLOADER = "stk500v2"
+	// внешняя программа arduino-cli с установленным ядром платы (см. arduinoCli.go)
+	ARDUINO_CLI_UPLOADER = "arduino-cli"
+)
+
+// true, если устройство прошивается встроенной реализацией протокола
+func (board *Arduino) isNative() bool {
+	return board.uploader != "" && board.uploader != AVRDUDE_UPLOADER && board.uploader != ARDUINO_CLI_UPLOADER
+}
+
+// подключение к загрузчику устройства без avrdude
+func (board *Arduino) openProgrammer(ctx context.Context) (avrProgrammer, avrPart, error) {
+	part, err := findAVRPart(board.controller)
+	if err != nil {
+		return nil, part, err
+	}
+	var programmer avrProgrammer
+	switch board.uploader {
+	case STK500V1_UPLOADER:
+		programmer, err = openSTK500v1(ctx, board.portName, board.baud)
+	case AVR109_UPLOADER:
+		programmer, err = openAVR109(ctx, board.portName, board.baud)
+	case STK500V2_UPLOADER:
+		programmer, err = openSTK500v2(ctx, board.portName, board.baud)
+	default:
+		return nil, part, fmt.Errorf("неизвестная программа для прошивки: %s", board.uploader)
+	}
+	if err != nil {
+		return nil, part, err
+	}
+	return programmer, part, nil
+}
+
+func (board *Arduino) nativeFlash(ctx context.Context, filePath string, logger chan any) (string, error) {
+	image, err := parseIntelHexFile(filePath)
+	if err != nil {
+		return "Некорректный файл Intel HEX: " + err.Error(), err
+	}
+	programmer, part, err := board.openProgrammer(ctx)
+	if err != nil {
+		return err.Error(), err
+	}
+	defer programmer.close()
+	return programFlash(ctx, programmer, part, image, logger)
+}
+
+func (board *Arduino) nativeVerify(ctx context.Context, filePath string, logger chan any) (VerifyResult, error) {
+	image, err := parseIntelHexFile(filePath)
+	if err != nil {
+		return VerifyResult{Match: false, Address: -1, Message: "Некорректный файл Intel HEX: " + err.Error()}, err
+	}
+	programmer, part, err := board.openProgrammer(ctx)
+	if err != nil {
+		return VerifyResult{Match: false, Address: -1, Message: err.Error()}, err
+	}
+	defer programmer.close()
+	err = checkSignature(programmer, part)
+	if err != nil {
+		return VerifyResult{Match: false, Address: -1, Message: err.Error()}, err
+	}
+	return verifyImage(ctx, programmer, part, image, logger)
+}
+
+func (board *Arduino) nativeExtract(ctx context.Context) ([]byte, error) {
+	programmer, part, err := board.openProgrammer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer programmer.close()
+	return readFlash(ctx, programmer, part, nil)
+}
+
+// пинг через чтение сигнатуры контроллера
+func (board *Arduino) nativePing(ctx context.Context) error {
+	programmer, part, err := board.openProgrammer(ctx)
+	if err != nil {
+		return err
+	}
+	defer programmer.close()
+	return checkSignature(programmer, part)
+}
+
+// операции, которые будут выполнены при прошивке без avrdude
+func (board *Arduino) nativeFlashPlan(filePath string) []string {
+	part, err := findAVRPart(board.controller)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	connect := fmt.Sprintf("%s: подключение к %s (%d бод)", board.uploader, board.portName, board.nativeBaud())
+	if board.uploader == STK500V1_UPLOADER || board.uploader == STK500V2_UPLOADER {
+		connect += ", перезагрузка через DTR/RTS"
+	}
+	plan := []string{
+		connect,
+		fmt.Sprintf("%s: проверка сигнатуры 0x%X (%s)", board.uploader, part.signature[:], board.controller),
+	}
+	image, err := parseIntelHexFile(filePath)
+	if err != nil {
+		return append(plan, "некорректный файл Intel HEX: "+err.Error())
+	}
+	pages := len(splitPages(image, part.pageSize))
+	if board.uploader == AVR109_UPLOADER {
+		plan = append(plan, fmt.Sprintf("%s: стирание flash-памяти", board.uploader))
+	}
+	return append(plan,
+		fmt.Sprintf("%s: запись %d страниц по %d байт (%d байт прошивки)", board.uploader, pages, part.pageSize, image.Size()),
+		fmt.Sprintf("%s: проверка %d страниц", board.uploader, pages),
+	)
+}
+
+// способ перезагрузки в bootloader для плана прошивки (см. rebootToBootloader)
+func (board *Arduino) rebootMethod() string {
+	if board.isNative() {
+		return fmt.Sprintf("открытие порта на скорости %d бод", touchBaud)
+	}
+	return "stty, MODE в Windows"
+}
+
+// скорость порта для встроенного загрузчика
+func (board *Arduino) nativeBaud() int {
+	if board.baud > 0 {
+		return board.baud
+	}
+	switch board.uploader {
+	case STK500V1_UPLOADER:
+		return stk500v1DefaultBaud
+	case AVR109_UPLOADER:
+		return avr109DefaultBaud
+	case STK500V2_UPLOADER:
+		return stk500v2DefaultBaud
+	}
+	return 0
+}
@@ -44,6 +44,9 @@ var fakeMSNum int
 // путь к avrdude
 var avrdudePath string
 
+// путь к arduino-cli (используется для устройств с uploader = arduino-cli)
+var arduinoCliPath string
+
 // путь к файлу конфигурации (если пустой, то он не будет передаваться через аргументы в avrdude)
 var configPath string
 
@@ -53,12 +56,32 @@ var deviceListPath string
 // путь к программе для прошивки кибермишки
 var blgMbUploaderPath string
 
+// разрешить клиентам запись fuse-битов (write-fuses)
+var allowFuseWrite bool
+
+// путь к файлу с историей прошивок устройств (если пустой, то история хранится только в памяти)
+var historyPath string
+
+// путь к папке с резервными копиями прошивок (если пустой, то резервные копии не создаются)
+var backupPath string
+
+// путь к папке с описаниями внешних плагинов (если пустой, то плагины не загружаются)
+var pluginsPath string
+
+// папки, в которых ищутся накопители UF2-загрузчиков, разделённые os.PathListSeparator
+var uf2MountRoots string
+
 // чтение флагов и происвоение им стандартных значений
 func setArgs() {
 	flag.StringVar(&webAddress, "address", "localhost:8080", "адресс для подключения")
 	flag.StringVar(&avrdudePath, "avrdudePath", "avrdude", "путь к avrdude, используется системный путь по-умолчанию")
+	flag.StringVar(&arduinoCliPath, "arduinoCliPath", "arduino-cli", "путь к arduino-cli, используется для Arduino с uploader = arduino-cli, если arduino-cli не найден, то вместо него используется avrdude")
 	flag.StringVar(&configPath, "configPath", "", "путь к файлу конфигурации avrdude")
 	flag.StringVar(&deviceListPath, "deviceListPath", "", "путь к JSON-файлу со списком устройств. Если прописан, то заменяет стандартный список устройств, при условии, что не возникнет ошибок, связанных с чтением и открытием JSON-файла, иначе используется стандартный список устройств (по-умолчанию пустая строка, означающая, что будет используется, встроенный в загрузчик список)")
+	flag.StringVar(&historyPath, "historyPath", defaultHistoryPath(), "путь к JSON-файлу с историей прошивок устройств. Если указана пустая строка, то история хранится только в памяти и теряется после перезапуска")
+	flag.StringVar(&backupPath, "backupPath", defaultBackupPath(), "путь к папке, в которой хранятся резервные копии прошивок, сделанные перед прошивкой (flash-start и ms-bin-start с backup = true). Если указана пустая строка, то резервные копии не создаются")
+	flag.StringVar(&pluginsPath, "pluginsPath", defaultPluginsPath(), "путь к папке с описаниями внешних плагинов (JSON-файлы), которые добавляют поддержку новых типов устройств. Если указана пустая строка или папки не существует, то плагины не загружаются")
+	flag.StringVar(&uf2MountRoots, "uf2MountRoots", defaultUF2MountRoots(), "папки, в которых ищутся накопители UF2-загрузчиков (сама папка или её подпапки с файлом INFO_UF2.TXT), разделённые системным разделителем списка путей (':' или ';' на Windows)")
 	flag.StringVar(&blgMbUploaderPath, "blgMbUploaderPath", "blg-mb/cyberbear-loader", "путь к программе для прошивки кибермишки")
 	flag.IntVar(&maxMsgSize, "msgSize", 1024, "максмальный размер одного сообщения, передаваемого через веб-сокеты (в байтах)")
 	flag.IntVar(&maxFileSize, "fileSize", 2*1024*1024, "максимальный размер файла, загружаемого на сервер (в байтах)")
@@ -66,6 +89,7 @@ func setArgs() {
 	flag.IntVar(&fakeBoardsNum, "stub", 0, "количество ненастоящих, симулируемых устройств, которые будут восприниматься как настоящие, применяется для тестирования, при значении 0 или меньше фальшивые устройства не добавляются")
 	flag.IntVar(&fakeMSNum, "stubms", 0, "количество ненастоящих, симулируемых устройств типа МС-ТЮК, которые будут восприниматься как настоящие, применяется для тестирования, при значении 0 или меньше фальшивые устройства не добавляются")
 	flag.BoolVar(&verbose, "verbose", false, "выводить в консоль подробную информацию")
+	flag.BoolVar(&allowFuseWrite, "allowFuseWrite", false, "разрешить запись fuse-битов и lock-битов (write-fuses), значения всё равно проверяются по таблице безопасных значений для контроллера")
 	flag.BoolVar(&alwaysUpdate, "alwaysUpdate", false, "всегда искать устройства и обновлять их список, даже когда ни один клиент не подключён (используется для тестирования)")
 	getListCooldownSeconds := flag.Int("listCooldown", 2, "минимальное время (в секундах), через которое клиент может снова запросить список устройств, игнорируется, если количество клиентов меньше чем 2")
 	updateListTimeSeconds := flag.Int("updateList", 15, "количество секунд между автоматическими обновлениями, не может быть меньше единицы, если получено значение меньше единицы, то оно заменяется на 1")
@@ -96,10 +120,16 @@ func printArgsDesc() {
 	fakeBoardsNumStr := fmt.Sprintf("количество фальшивых устройств: %d", fakeBoardsNum)
 	fakeMSNumStr := fmt.Sprintf("количество фальшивых МС-ТЮК: %d", fakeMSNum)
 	avrdudePathStr := fmt.Sprintf("путь к avrdude (если написано avrdude, то используется системный путь): %s", avrdudePath)
+	arduinoCliPathStr := fmt.Sprintf("путь к arduino-cli: %s", arduinoCliPath)
 	configPathStr := fmt.Sprintf("путь к файлу конфигурации avrdude: %s", configPath)
 	deviceListPathStr := fmt.Sprintf("путь к файлу со списком устройств (если пусто, то используется встроенный список): %s", deviceListPath)
 	blgMbUploaderPathStr := fmt.Sprintf("путь к программе для прошивки кибермишки: %s", blgMbUploaderPath)
-	log.Printf("Модуль загрузчика запущен со следующими параметрами:\n %s\n %s\n %s\n %s\n %s\n %s\n %s\n %s\n %s\n %s\n %s\n %s\n %s\n %s\n",
+	allowFuseWriteStr := fmt.Sprintf("разрешена запись fuse-битов: %v", allowFuseWrite)
+	historyPathStr := fmt.Sprintf("путь к файлу с историей прошивок (если пусто, то история не сохраняется): %s", historyPath)
+	backupPathStr := fmt.Sprintf("путь к папке с резервными копиями прошивок (если пусто, то резервные копии не создаются): %s", backupPath)
+	pluginsPathStr := fmt.Sprintf("путь к папке с плагинами (если пусто, то плагины не загружаются): %s", pluginsPath)
+	uf2MountRootsStr := fmt.Sprintf("папки для поиска UF2-накопителей: %s", uf2MountRoots)
+	log.Printf("Модуль загрузчика запущен со следующими параметрами:\n %s\n %s\n %s\n %s\n %s\n %s\n %s\n %s\n %s\n %s\n %s\n %s\n %s\n %s\n %s\n %s\n %s\n %s\n %s\n %s\n",
 		webAddressStr,
 		maxFileSizeStr,
 		maxMsgSizeStr,
@@ -111,8 +141,14 @@ func printArgsDesc() {
 		fakeBoardsNumStr,
 		fakeMSNumStr,
 		avrdudePathStr,
+		arduinoCliPathStr,
 		configPathStr,
 		deviceListPathStr,
 		blgMbUploaderPathStr,
+		allowFuseWriteStr,
+		historyPathStr,
+		backupPathStr,
+		pluginsPathStr,
+		uf2MountRootsStr,
 	)
 }
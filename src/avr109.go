@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/albenik/go-serial/v2"
+)
+
+// команды протокола AVR109 (загрузчик Caterina, Arduino Micro и Leonardo)
+const (
+	AVR109_SOFTWARE_ID     = 'S'
+	AVR109_ENTER_PROGMODE  = 'P'
+	AVR109_LEAVE_PROGMODE  = 'L'
+	AVR109_EXIT_BOOTLOADER = 'E'
+	AVR109_CHIP_ERASE      = 'e'
+	AVR109_SET_ADDRESS     = 'A'
+	AVR109_BLOCK_SUPPORT   = 'b'
+	AVR109_BLOCK_LOAD      = 'B'
+	AVR109_BLOCK_READ      = 'g'
+	AVR109_READ_SIGNATURE  = 's'
+	// ответ загрузчика на успешно выполненную команду
+	AVR109_OK = '\r'
+)
+
+// Caterina работает через USB CDC и не зависит от скорости порта, используется значение avrdude
+const avr109DefaultBaud = 57600
+
+// скорость, при открытии порта на которой устройство перезагружается в загрузчик
+const touchBaud = 1200
+
+// время ожидания ответа на одну команду, стирание памяти может занимать больше секунды
+const avr109Timeout = 3 * time.Second
+
+// соединение с загрузчиком по протоколу AVR109
+type avr109 struct {
+	port avrPort
+	// максимальный размер блока, который загрузчик принимает за одну команду
+	blockSize int
+}
+
+/*
+Перезагрузка устройства в загрузчик: порт открывается на скорости 1200 бод и закрывается со сброшенным DTR.
+
+Заменяет вызов stty (MODE в Windows) для устройств, прошиваемых без avrdude.
+*/
+func touch1200(portName string) error {
+	port, err := serial.Open(portName, serial.WithBaudrate(touchBaud))
+	if err != nil {
+		return err
+	}
+	if err := port.SetDTR(false); err != nil {
+		printLog("touch1200: can't set DTR:", err.Error())
+	}
+	return port.Close()
+}
+
+// открытие порта загрузчика, проверка его ответа и вход в режим программирования
+func openAVR109(ctx context.Context, portName string, baud int) (*avr109, error) {
+	if baud <= 0 {
+		baud = avr109DefaultBaud
+	}
+	port, err := serial.Open(
+		portName,
+		serial.WithBaudrate(baud),
+		serial.WithReadTimeout(50),
+		serial.WithWriteTimeout(int(avr109Timeout.Milliseconds())),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return startAVR109(ctx, port)
+}
+
+// проверка ответа загрузчика на порту port и вход в режим программирования, при ошибке порт закрывается
+func startAVR109(ctx context.Context, port avrPort) (*avr109, error) {
+	programmer := &avr109{port: port}
+	err := programmer.init(ctx)
+	if err != nil {
+		port.Close()
+		return nil, err
+	}
+	return programmer, nil
+}
+
+func (programmer *avr109) init(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	programmer.port.ResetInputBuffer()
+	softwareID, err := programmer.command([]byte{AVR109_SOFTWARE_ID}, 7)
+	if err != nil {
+		return fmt.Errorf("загрузчик не отвечает: %w", err)
+	}
+	printLog("avr109: bootloader", string(softwareID))
+	blockSupport, err := programmer.command([]byte{AVR109_BLOCK_SUPPORT}, 3)
+	if err != nil {
+		return err
+	}
+	if blockSupport[0] != 'Y' {
+		return errors.New("загрузчик не поддерживает постраничную запись")
+	}
+	programmer.blockSize = int(blockSupport[1])<<8 | int(blockSupport[2])
+	return programmer.commandOK([]byte{AVR109_ENTER_PROGMODE})
+}
+
+// отправка команды и чтение ответа фиксированного размера
+func (programmer *avr109) command(cmd []byte, responseSize int) ([]byte, error) {
+	_, err := programmer.port.Write(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return readExactly(programmer.port, responseSize, avr109Timeout)
+}
+
+// отправка команды, на которую загрузчик отвечает AVR109_OK
+func (programmer *avr109) commandOK(cmd []byte) error {
+	response, err := programmer.command(cmd, 1)
+	if err != nil {
+		return err
+	}
+	if response[0] != AVR109_OK {
+		return fmt.Errorf("неожиданный ответ загрузчика на команду '%c': 0x%02x", cmd[0], response[0])
+	}
+	return nil
+}
+
+// загрузчик возвращает сигнатуру начиная с младшего байта
+func (programmer *avr109) readSignature() ([3]byte, error) {
+	var signature [3]byte
+	response, err := programmer.command([]byte{AVR109_READ_SIGNATURE}, 3)
+	if err != nil {
+		return signature, err
+	}
+	signature[0], signature[1], signature[2] = response[2], response[1], response[0]
+	return signature, nil
+}
+
+// стирание flash-памяти перед записью, как это делает avrdude
+func (programmer *avr109) erase() error {
+	return programmer.commandOK([]byte{AVR109_CHIP_ERASE})
+}
+
+// адрес flash-памяти передаётся в словах
+func (programmer *avr109) setAddress(address int) error {
+	word := address / 2
+	return programmer.commandOK([]byte{AVR109_SET_ADDRESS, byte(word >> 8), byte(word)})
+}
+
+func (programmer *avr109) writePage(address int, data []byte) error {
+	if programmer.blockSize > 0 && len(data) > programmer.blockSize {
+		return fmt.Errorf("размер страницы %d больше размера блока загрузчика %d", len(data), programmer.blockSize)
+	}
+	err := programmer.setAddress(address)
+	if err != nil {
+		return err
+	}
+	cmd := append([]byte{AVR109_BLOCK_LOAD, byte(len(data) >> 8), byte(len(data)), 'F'}, data...)
+	return programmer.commandOK(cmd)
+}
+
+func (programmer *avr109) readPage(address int, size int) ([]byte, error) {
+	err := programmer.setAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	return programmer.command([]byte{AVR109_BLOCK_READ, byte(size >> 8), byte(size), 'F'}, size)
+}
+
+// выход из режима программирования и из загрузчика, после чего устройство запускает записанную программу
+func (programmer *avr109) close() error {
+	if err := programmer.commandOK([]byte{AVR109_LEAVE_PROGMODE}); err != nil {
+		printLog("avr109: can't leave programming mode:", err.Error())
+	}
+	if err := programmer.commandOK([]byte{AVR109_EXIT_BOOTLOADER}); err != nil {
+		printLog("avr109: can't exit bootloader:", err.Error())
+	}
+	return programmer.port.Close()
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+// ответ Caterina на неизвестную или невыполненную команду
+const avr109Unknown = '?'
+
+/*
+Caterina: отвечает на однобайтовые команды AVR109, запись страницы (как во flash-памяти AVR) только сбрасывает биты,
+поэтому без стирания записанные данные отличаются от прошивки.
+*/
+type avr109Emulator struct {
+	emulatedPort
+	signature [3]byte
+	flash     []byte
+	blockSize int
+	address   int
+	progMode  bool
+	exited    bool
+	// ответ avr109Unknown на стирание памяти
+	failErase bool
+}
+
+func newAVR109Emulator(part avrPart) *avr109Emulator {
+	// память до стирания заполнена старой прошивкой
+	flash := bytes.Repeat([]byte{0x5A}, part.flashSize)
+	emulator := &avr109Emulator{signature: part.signature, flash: flash, blockSize: part.pageSize}
+	emulator.handle = emulator.command
+	return emulator
+}
+
+func (emulator *avr109Emulator) command(input []byte) ([]byte, int) {
+	size := 1
+	switch input[0] {
+	case AVR109_SET_ADDRESS:
+		size = 3
+	case AVR109_BLOCK_READ:
+		size = 4
+	case AVR109_BLOCK_LOAD:
+		if len(input) < 3 {
+			return nil, 0
+		}
+		size = 4 + (int(input[1])<<8 | int(input[2]))
+	}
+	if len(input) < size {
+		return nil, 0
+	}
+	args := input[1:size]
+	switch input[0] {
+	case AVR109_SOFTWARE_ID:
+		return []byte("CATERIN"), size
+	case AVR109_BLOCK_SUPPORT:
+		return []byte{'Y', byte(emulator.blockSize >> 8), byte(emulator.blockSize)}, size
+	case AVR109_READ_SIGNATURE:
+		return []byte{emulator.signature[2], emulator.signature[1], emulator.signature[0]}, size
+	case AVR109_ENTER_PROGMODE:
+		emulator.progMode = true
+	case AVR109_LEAVE_PROGMODE:
+		emulator.progMode = false
+	case AVR109_EXIT_BOOTLOADER:
+		emulator.exited = true
+	case AVR109_CHIP_ERASE:
+		if emulator.failErase {
+			return []byte{avr109Unknown}, size
+		}
+		for i := range emulator.flash {
+			emulator.flash[i] = 0xFF
+		}
+	case AVR109_SET_ADDRESS:
+		emulator.address = 2 * (int(args[0])<<8 | int(args[1]))
+	case AVR109_BLOCK_LOAD:
+		data := args[3:]
+		if args[2] != 'F' || len(data) > emulator.blockSize {
+			return []byte{avr109Unknown}, size
+		}
+		for i, b := range data {
+			emulator.flash[emulator.address+i] &= b
+		}
+		emulator.address += len(data)
+	case AVR109_BLOCK_READ:
+		length := int(args[0])<<8 | int(args[1])
+		data := bytes.Clone(emulator.flash[emulator.address : emulator.address+length])
+		emulator.address += length
+		return data, size
+	default:
+		return []byte{avr109Unknown}, size
+	}
+	return []byte{AVR109_OK}, size
+}
+
+func TestAVR109Flash(t *testing.T) {
+	emulator := newAVR109Emulator(atmega32u4)
+	programmer, err := startAVR109(context.Background(), emulator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !emulator.progMode || programmer.blockSize != atmega32u4.pageSize {
+		t.Fatalf("режим программирования %v, размер блока %d", emulator.progMode, programmer.blockSize)
+	}
+	image := testAVRImage()
+	msg, err := programFlash(context.Background(), programmer, atmega32u4, image, nil)
+	if err != nil {
+		t.Fatal(msg)
+	}
+	checkAVRFlash(t, emulator.flash, image)
+	flash, err := readFlash(context.Background(), programmer, atmega32u4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(flash, emulator.flash) {
+		t.Fatal("прочитанная flash-память не совпадает с памятью загрузчика")
+	}
+	if err := programmer.close(); err != nil {
+		t.Fatal(err)
+	}
+	if emulator.progMode || !emulator.exited || !emulator.closed {
+		t.Fatal("загрузчик не завершён или порт не закрыт")
+	}
+}
+
+func TestAVR109Errors(t *testing.T) {
+	t.Run("нет постраничной записи", func(t *testing.T) {
+		emulator := newAVR109Emulator(atmega32u4)
+		handle := emulator.handle
+		emulator.handle = func(input []byte) ([]byte, int) {
+			if input[0] == AVR109_BLOCK_SUPPORT {
+				return []byte{'N', 0, 0}, 1
+			}
+			return handle(input)
+		}
+		_, err := startAVR109(context.Background(), emulator)
+		if err == nil || !emulator.closed {
+			t.Fatalf("ошибка %v, порт закрыт: %v", err, emulator.closed)
+		}
+	})
+	t.Run("загрузчик не стёр память", func(t *testing.T) {
+		emulator := newAVR109Emulator(atmega32u4)
+		emulator.failErase = true
+		programmer, err := startAVR109(context.Background(), emulator)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := programFlash(context.Background(), programmer, atmega32u4, testAVRImage(), nil)
+		if err == nil || !strings.Contains(msg, "не удалось стереть flash-память") {
+			t.Fatalf("сообщение %q, ошибка %v", msg, err)
+		}
+	})
+	t.Run("страница больше блока загрузчика", func(t *testing.T) {
+		emulator := newAVR109Emulator(atmega32u4)
+		emulator.blockSize = 64
+		programmer, err := startAVR109(context.Background(), emulator)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := programFlash(context.Background(), programmer, atmega32u4, testAVRImage(), nil)
+		if err == nil || !strings.Contains(msg, "больше размера блока загрузчика") {
+			t.Fatalf("сообщение %q, ошибка %v", msg, err)
+		}
+	})
+	t.Run("неизвестная команда", func(t *testing.T) {
+		programmer := &avr109{port: newAVR109Emulator(atmega32u4)}
+		if err := programmer.commandOK([]byte{'Z'}); err == nil {
+			t.Fatal("ожидалась ошибка")
+		}
+	})
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// параметры контроллера AVR, необходимые для прошивки без avrdude
+type avrPart struct {
+	signature [3]byte
+	// размер страницы flash-памяти в байтах
+	pageSize int
+	// размер flash-памяти в байтах
+	flashSize int
+}
+
+var (
+	atmega168  = avrPart{[3]byte{0x1E, 0x94, 0x06}, 128, 16384}
+	atmega328p = avrPart{[3]byte{0x1E, 0x95, 0x0F}, 128, 32768}
+	atmega32u4 = avrPart{[3]byte{0x1E, 0x95, 0x87}, 128, 32768}
+	atmega2560 = avrPart{[3]byte{0x1E, 0x98, 0x01}, 256, 262144}
+)
+
+// контроллеры, которые можно прошить без avrdude, в качестве ключа используется название контроллера в нижнем регистре
+var avrParts = map[string]avrPart{
+	"atmega168":  atmega168,
+	"m168":       atmega168,
+	"atmega328p": atmega328p,
+	"m328p":      atmega328p,
+	"atmega32u4": atmega32u4,
+	"m32u4":      atmega32u4,
+	"atmega2560": atmega2560,
+	"m2560":      atmega2560,
+}
+
+func findAVRPart(controller string) (avrPart, error) {
+	part, exists := avrParts[strings.ToLower(controller)]
+	if !exists {
+		return avrPart{}, fmt.Errorf("контроллер %s не поддерживается встроенным загрузчиком, используйте avrdude", controller)
+	}
+	return part, nil
+}
+
+/*
+Соединение с загрузчиком AVR, который записывает и читает flash-память постранично (STK500v1, AVR109, STK500v2).
+
+Адреса указываются в байтах, загрузчик сам переводит их в адреса слов, если этого требует протокол.
+*/
+type avrProgrammer interface {
+	readSignature() ([3]byte, error)
+	writePage(address int, data []byte) error
+	readPage(address int, size int) ([]byte, error)
+	// выход из режима программирования и закрытие порта
+	close() error
+}
+
+// порт, через который идёт обмен с загрузчиком AVR: последовательный порт или эмулятор загрузчика в тестах
+type avrPort interface {
+	io.ReadWriter
+	// сброс данных, которые пришли от загрузчика, но ещё не прочитаны
+	ResetInputBuffer() error
+	Close() error
+}
+
+// загрузчик, которому перед записью нужно стереть flash-память (AVR109 не стирает страницы при записи)
+type avrEraser interface {
+	erase() error
+}
+
+// проверка того, что к порту подключён ожидаемый контроллер
+func checkSignature(programmer avrProgrammer, part avrPart) error {
+	signature, err := programmer.readSignature()
+	if err != nil {
+		return fmt.Errorf("не удалось прочитать сигнатуру контроллера: %w", err)
+	}
+	if signature != part.signature {
+		return fmt.Errorf("сигнатура контроллера 0x%X не совпадает с ожидаемой 0x%X", signature[:], part.signature[:])
+	}
+	return nil
+}
+
+// разбиение образа прошивки на страницы, части страниц, не занятые прошивкой, заполняются 0xFF
+func splitPages(image *FirmwareImage, pageSize int) []MemorySegment {
+	var pages []MemorySegment
+	for _, segment := range image.Segments {
+		for address := segment.Address - segment.Address%uint32(pageSize); address < segment.End(); address += uint32(pageSize) {
+			if len(pages) > 0 && pages[len(pages)-1].Address == address {
+				// страница уже добавлена предыдущим участком
+				page := pages[len(pages)-1]
+				copyToPage(page, segment)
+				continue
+			}
+			page := MemorySegment{Address: address, Data: make([]byte, pageSize)}
+			for i := range page.Data {
+				page.Data[i] = binPadding
+			}
+			copyToPage(page, segment)
+			pages = append(pages, page)
+		}
+	}
+	return pages
+}
+
+// копирование части участка, попадающей в страницу
+func copyToPage(page MemorySegment, segment MemorySegment) {
+	start := max(page.Address, segment.Address)
+	end := min(page.End(), segment.End())
+	if start < end {
+		copy(page.Data[start-page.Address:end-page.Address], segment.Data[start-segment.Address:end-segment.Address])
+	}
+}
+
+// отправка прогресса этапа прошивки клиенту (flash-backtrack), аналогично выводу avrdude
+type progressReporter struct {
+	logger      chan any
+	stage       string
+	start       time.Time
+	lastPercent int
+}
+
+func newProgressReporter(logger chan any, stage string) *progressReporter {
+	return &progressReporter{
+		logger:      logger,
+		stage:       stage,
+		start:       time.Now(),
+		lastPercent: -1,
+	}
+}
+
+func (reporter *progressReporter) report(done int, total int) {
+	if reporter.logger == nil || total == 0 {
+		return
+	}
+	percent := done * 100 / total
+	if percent == reporter.lastPercent {
+		return
+	}
+	reporter.lastPercent = percent
+	elapsed := time.Since(reporter.start).Seconds()
+	var eta float64
+	if percent > 0 {
+		eta = elapsed * float64(100-percent) / float64(percent)
+	}
+	reporter.logger <- FlashBacktrackMessage{
+		Stage:   reporter.stage,
+		Percent: percent,
+		Elapsed: elapsed,
+		Eta:     eta,
+	}
+}
+
+/*
+Запись прошивки постранично с последующей проверкой (как avrdude без флага -V).
+
+Перед записью проверяется сигнатура контроллера и размер прошивки.
+Возвращает сообщение для клиента.
+*/
+func programFlash(ctx context.Context, programmer avrProgrammer, part avrPart, image *FirmwareImage, logger chan any) (string, error) {
+	err := checkSignature(programmer, part)
+	if err != nil {
+		return err.Error(), err
+	}
+	pages := splitPages(image, part.pageSize)
+	if len(pages) > 0 && int(pages[len(pages)-1].End()) > part.flashSize {
+		err := fmt.Errorf("прошивка не помещается во flash-память контроллера (%d байт)", part.flashSize)
+		return err.Error(), err
+	}
+	if eraser, needErase := programmer.(avrEraser); needErase {
+		err := eraser.erase()
+		if err != nil {
+			err = fmt.Errorf("не удалось стереть flash-память: %w", err)
+			return err.Error(), err
+		}
+	}
+	reporter := newProgressReporter(logger, WRITING_STAGE)
+	reporter.report(0, len(pages))
+	for i, page := range pages {
+		if ctx.Err() != nil {
+			return "Прошивка прервана.", ctx.Err()
+		}
+		err := programmer.writePage(int(page.Address), page.Data)
+		if err != nil {
+			err = fmt.Errorf("ошибка записи страницы 0x%04x: %w", page.Address, err)
+			return err.Error(), err
+		}
+		reporter.report(i+1, len(pages))
+	}
+	result, err := verifyImage(ctx, programmer, part, image, logger)
+	if err != nil {
+		return result.Message, err
+	}
+	if !result.Match {
+		return result.Message, fmt.Errorf("ошибка проверки прошивки по адресу 0x%04x", result.Address)
+	}
+	return fmt.Sprintf("Прошивка завершена: записано %d байт (%d страниц), проверка пройдена.", image.Size(), len(pages)), nil
+}
+
+/*
+Сравнение прошивки контроллера с образом, сравниваются только байты, занятые образом.
+
+Несовпадение не считается ошибкой, ошибка возвращается только если не удалось прочитать память.
+*/
+func verifyImage(ctx context.Context, programmer avrProgrammer, part avrPart, image *FirmwareImage, logger chan any) (VerifyResult, error) {
+	pages := splitPages(image, part.pageSize)
+	reporter := newProgressReporter(logger, VERIFYING_STAGE)
+	reporter.report(0, len(pages))
+	actual := make([]MemorySegment, 0, len(pages))
+	for i, page := range pages {
+		if ctx.Err() != nil {
+			return VerifyResult{Match: false, Address: -1, Message: "Проверка прервана."}, ctx.Err()
+		}
+		data, err := programmer.readPage(int(page.Address), len(page.Data))
+		if err != nil {
+			err = fmt.Errorf("ошибка чтения страницы 0x%04x: %w", page.Address, err)
+			return VerifyResult{Match: false, Address: -1, Message: err.Error()}, err
+		}
+		actual = append(actual, MemorySegment{Address: page.Address, Data: data})
+		reporter.report(i+1, len(pages))
+	}
+	// страницы не перекрываются, поэтому ошибки объединения быть не может
+	actualSegments, _ := mergeSegments(actual)
+	actualImage := FirmwareImage{Segments: actualSegments}
+	for _, segment := range image.Segments {
+		for i, expected := range segment.Data {
+			address := segment.Address + uint32(i)
+			if got, _ := actualImage.byteAt(address); got != expected {
+				return VerifyResult{
+					Match:   false,
+					Address: int(address),
+					Message: fmt.Sprintf("Прошивка устройства отличается от файла по адресу 0x%04x: 0x%02x != 0x%02x.", address, got, expected),
+				}, nil
+			}
+		}
+	}
+	return VerifyResult{Match: true, Address: -1, Message: "Прошивка устройства совпадает с файлом."}, nil
+}
+
+// чтение всей flash-памяти контроллера
+func readFlash(ctx context.Context, programmer avrProgrammer, part avrPart, logger chan any) ([]byte, error) {
+	err := checkSignature(programmer, part)
+	if err != nil {
+		return nil, err
+	}
+	pagesNum := part.flashSize / part.pageSize
+	reporter := newProgressReporter(logger, READING_STAGE)
+	reporter.report(0, pagesNum)
+	flash := make([]byte, 0, part.flashSize)
+	for i := 0; i < pagesNum; i++ {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		data, err := programmer.readPage(i*part.pageSize, part.pageSize)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка чтения страницы 0x%04x: %w", i*part.pageSize, err)
+		}
+		flash = append(flash, data...)
+		reporter.report(i+1, pagesNum)
+	}
+	return flash, nil
+}
+
+// байт образа по адресу, false, если адрес не занят прошивкой
+func (image *FirmwareImage) byteAt(address uint32) (byte, bool) {
+	for _, segment := range image.Segments {
+		if address >= segment.Address && address < segment.End() {
+			return segment.Data[address-segment.Address], true
+		}
+	}
+	return 0, false
+}
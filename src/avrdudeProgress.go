@@ -0,0 +1,149 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// этапы прошивки, о которых сообщается клиенту через flash-backtrack
+const (
+	READING_STAGE   = "reading"
+	WRITING_STAGE   = "writing"
+	VERIFYING_STAGE = "verifying"
+	ERASING_STAGE   = "erasing"
+	// поиск устройства после перезагрузки в bootloader
+	BOOTLOADER_STAGE = "bootloader"
+)
+
+// строка с полностью выведенным индикатором прогресса, например: "Writing | ################################################## | 100% 1.23s"
+var avrdudeProgressLine = regexp.MustCompile(`^(\w+) \| (#*)\s*\| (\d+)% (\d+(?:\.\d+)?)s`)
+
+// начало индикатора прогресса, который avrdude дописывает по одному символу, если вывод не является терминалом
+var avrdudeProgressBar = regexp.MustCompile(`^(\w+) \| (#*)$`)
+
+/*
+Разбор вывода avrdude для получения прогресса прошивки.
+
+Реализует io.Writer, чтобы его можно было передать в exec.Cmd вместе с буфером для всего вывода.
+Обрабатывает оба вида индикаторов прогресса avrdude: с обновлением строки через '\r' (терминал)
+и с постепенным добавлением символов '#' (обычный вывод, каждый символ - 2%).
+*/
+type avrdudeProgressParser struct {
+	logger chan any
+	// текущая (ещё не завершённая) строка вывода
+	line []byte
+	// этап, для которого сейчас выводится индикатор
+	stage string
+	// время начала текущего этапа
+	stageStart time.Time
+	// последнее отправленное значение прогресса, чтобы не отправлять одинаковые сообщения
+	lastPercent int
+	// true, если уже была запись, значит следующее чтение - это проверка записанной прошивки
+	written bool
+}
+
+func newAvrdudeProgressParser(logger chan any) *avrdudeProgressParser {
+	return &avrdudeProgressParser{
+		logger:      logger,
+		lastPercent: -1,
+	}
+}
+
+func (parser *avrdudeProgressParser) Write(data []byte) (int, error) {
+	for _, b := range data {
+		if b == '\n' || b == '\r' {
+			parser.handleLine(string(parser.line), true)
+			parser.line = parser.line[:0]
+			continue
+		}
+		parser.line = append(parser.line, b)
+		if b == '#' || b == ' ' {
+			parser.handleLine(string(parser.line), false)
+		}
+	}
+	return len(data), nil
+}
+
+// обработка строки вывода, completed = true, если строка завершена
+func (parser *avrdudeProgressParser) handleLine(line string, completed bool) {
+	if match := avrdudeProgressLine.FindStringSubmatch(line); match != nil {
+		percent, _ := strconv.Atoi(match[3])
+		elapsed, _ := strconv.ParseFloat(match[4], 64)
+		parser.report(match[1], percent, elapsed)
+		if percent >= 100 && completed {
+			parser.finishStage()
+		}
+		return
+	}
+	if match := avrdudeProgressBar.FindStringSubmatch(line); match != nil && !completed {
+		percent := min(len(match[2])*2, 100)
+		parser.report(match[1], percent, time.Since(parser.stageStart).Seconds())
+	}
+}
+
+// отправка прогресса клиенту
+func (parser *avrdudeProgressParser) report(avrdudeStage string, percent int, elapsed float64) {
+	stage := parser.stageName(avrdudeStage)
+	if stage != parser.stage {
+		parser.stage = stage
+		parser.stageStart = time.Now()
+		parser.lastPercent = -1
+		elapsed = 0
+	}
+	if percent == parser.lastPercent {
+		return
+	}
+	parser.lastPercent = percent
+	var eta float64
+	if percent > 0 {
+		eta = elapsed * float64(100-percent) / float64(percent)
+	}
+	parser.logger <- FlashBacktrackMessage{
+		Stage:   stage,
+		Percent: percent,
+		Elapsed: elapsed,
+		Eta:     eta,
+	}
+}
+
+// завершение текущего этапа, следующий индикатор будет считаться новым этапом
+func (parser *avrdudeProgressParser) finishStage() {
+	if parser.stage == WRITING_STAGE {
+		parser.written = true
+	}
+	parser.stage = ""
+}
+
+// название этапа для клиента
+func (parser *avrdudeProgressParser) stageName(avrdudeStage string) string {
+	switch strings.ToLower(avrdudeStage) {
+	case "writing":
+		return WRITING_STAGE
+	case "reading":
+		// после записи avrdude считывает прошивку для проверки
+		if parser.written {
+			return VERIFYING_STAGE
+		}
+		return READING_STAGE
+	}
+	return strings.ToLower(avrdudeStage)
+}
+
+// адрес первого несовпадающего байта при проверке прошивки, разные версии avrdude выводят его по-разному:
+// "verification error, first mismatch at byte 0x0000" или "device 0x0c != input 0x0d at addr 0x0000"
+var avrdudeMismatch = regexp.MustCompile(`(?:mismatch at byte|at addr) 0x([0-9a-fA-F]+)`)
+
+// возвращает адрес первого несовпадения из вывода avrdude, false, если несовпадений нет
+func avrdudeMismatchAddress(output string) (int, bool) {
+	match := avrdudeMismatch.FindStringSubmatch(output)
+	if match == nil {
+		return -1, false
+	}
+	address, err := strconv.ParseInt(match[1], 16, 64)
+	if err != nil {
+		return -1, false
+	}
+	return int(address), true
+}
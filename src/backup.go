@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+)
+
+// количество резервных копий, которые хранятся для каждого устройства, более старые копии удаляются
+const backupsPerDevice = 5
+
+// имя файла с описанием резервных копий в папке backupPath
+const backupIndexName = "index.json"
+
+// резервная копия прошивки устройства, сделанная перед прошивкой
+type Backup struct {
+	// имя файла в папке с резервными копиями
+	Name string    `json:"name"`
+	Time time.Time `json:"time"`
+	Size int       `json:"size"`
+	// SHA-256 прошивки
+	Hash string `json:"hash"`
+	// адрес платы, только для МС-ТЮК
+	Address string `json:"address,omitempty"`
+}
+
+/*
+Хранилище резервных копий прошивок, ключ - deviceID.
+
+Прошивки хранятся в отдельных файлах, а их описание - в файле backupIndexName в той же папке.
+Если путь к папке пустой, то резервные копии создавать нельзя.
+*/
+type BackupStore struct {
+	mu  sync.Mutex
+	dir string
+	// копии от старых к новым
+	backups map[string][]Backup
+}
+
+// резервные копии, загружаются при запуске сервера
+var backupStore *BackupStore
+
+// символы, которые нельзя использовать в имени файла резервной копии
+var unsafeFileNameChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// стандартная папка для резервных копий, пустая строка, если не удалось определить папку для конфигурации пользователя
+func defaultBackupPath() string {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(configDir, "lapki-flasher", "backups")
+}
+
+// чтение описания резервных копий из папки dir
+func loadBackupStore(dir string) *BackupStore {
+	store := BackupStore{
+		dir:     dir,
+		backups: make(map[string][]Backup),
+	}
+	if dir == "" {
+		return &store
+	}
+	data, err := os.ReadFile(filepath.Join(dir, backupIndexName))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Println("Не удалось прочитать список резервных копий:", err.Error())
+		}
+		return &store
+	}
+	err = json.Unmarshal(data, &store.backups)
+	if err != nil {
+		log.Println("Не удалось распарсить список резервных копий:", err.Error())
+		store.backups = make(map[string][]Backup)
+	}
+	return &store
+}
+
+// сохранение резервной копии прошивки устройства, самая старая копия удаляется, если их больше backupsPerDevice
+func (store *BackupStore) Save(deviceID string, address string, data []byte) (Backup, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.dir == "" {
+		return Backup{}, errors.New("папка для резервных копий не задана (-backupPath)")
+	}
+	err := os.MkdirAll(store.dir, 0755)
+	if err != nil {
+		return Backup{}, err
+	}
+	now := time.Now()
+	hash := firmwareHash(data)
+	backup := Backup{
+		Name:    fmt.Sprintf("%s_%s_%s.bin", unsafeFileNameChars.ReplaceAllString(deviceID, "_"), now.Format("20060102-150405.000"), hash[:8]),
+		Time:    now,
+		Size:    len(data),
+		Hash:    hash,
+		Address: address,
+	}
+	err = os.WriteFile(store.Path(backup), data, 0644)
+	if err != nil {
+		return Backup{}, err
+	}
+	backups := append(store.backups[deviceID], backup)
+	for len(backups) > backupsPerDevice {
+		os.Remove(store.Path(backups[0]))
+		backups = backups[1:]
+	}
+	store.backups[deviceID] = backups
+	return backup, store.saveIndex()
+}
+
+// резервные копии устройства, начиная с последней
+func (store *BackupStore) List(deviceID string) []Backup {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	backups := slices.Clone(store.backups[deviceID])
+	slices.Reverse(backups)
+	return backups
+}
+
+// поиск резервной копии устройства по имени файла
+func (store *BackupStore) Find(deviceID string, name string) (Backup, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for _, backup := range store.backups[deviceID] {
+		if backup.Name == name {
+			return backup, true
+		}
+	}
+	return Backup{}, false
+}
+
+// путь к файлу резервной копии
+func (store *BackupStore) Path(backup Backup) string {
+	return filepath.Join(store.dir, backup.Name)
+}
+
+func (store *BackupStore) saveIndex() error {
+	data, err := json.MarshalIndent(store.backups, "", "  ")
+	if err != nil {
+		return err
+	}
+	indexPath := filepath.Join(store.dir, backupIndexName)
+	tempPath := indexPath + ".tmp"
+	err = os.WriteFile(tempPath, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempPath, indexPath)
+}
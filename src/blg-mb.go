@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"os/exec"
@@ -13,8 +14,39 @@ type BlgMb struct {
 	version  string
 }
 
+func init() {
+	registerBoardType(&BoardType{
+		Name:      "blg-mb",
+		Detection: USBDetection,
+		New: func(temp BoardTemplate, found FoundDevice) Board {
+			return &BlgMb{serialID: found.SerialID}
+		},
+		Init: func(dev *Device) {
+			board := dev.Board.(*BlgMb)
+			ctx, cancel := dev.operationContext(context.Background(), MetaOperation)
+			defer cancel()
+			if board.version == "" {
+				board.GetVersion(ctx)
+			}
+			if board.serialID == "" {
+				board.GetId(ctx)
+			}
+		},
+		Timeouts: map[DeviceOperation]int{
+			FlashOperation:   120,
+			PingOperation:    10,
+			ResetOperation:   10,
+			MetaOperation:    10,
+			ExtractOperation: 60,
+			VerifyOperation:  60,
+		},
+	})
+}
+
 func (board *BlgMb) IsConnected() bool {
-	return board.Ping() == nil
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout("blg-mb", PingOperation))
+	defer cancel()
+	return board.Ping(ctx) == nil
 }
 
 func (board *BlgMb) GetSerialPort() string {
@@ -27,35 +59,50 @@ func (board *BlgMb) GetWebMessageType() string {
 
 func (board *BlgMb) GetWebMessage(name string, deviceID string) any {
 	return BlgMbDeviceMessage{
-		ID:       deviceID,
-		Name:     name,
-		SerialID: board.serialID,
-		Version:  board.version,
+		ID:           deviceID,
+		Name:         name,
+		SerialID:     board.serialID,
+		Version:      board.version,
+		LastFirmware: deviceHistory.Last(deviceID),
 	}
 }
 
-func (board *BlgMb) CyberBearLoader(args ...string) ([]byte, error) {
+// запуск программы для прошивки кибермишки, процесс завершается принудительно при отмене контекста ctx
+func (board *BlgMb) CyberBearLoader(ctx context.Context, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, blgMbUploaderPath, board.cyberBearLoaderArgs(args...)...)
+	return cmd.CombinedOutput()
+}
+
+// аргументы для программы прошивки кибермишки, включая выбор устройства по serialID
+func (board *BlgMb) cyberBearLoaderArgs(args ...string) []string {
 	if board.serialID != "" {
 		targetArgs := []string{"-t", board.serialID}
 		args = append(targetArgs, args...)
 	}
-	cmd := exec.Command(blgMbUploaderPath, args...)
-	return cmd.CombinedOutput()
+	return args
 }
 
-func (board *BlgMb) Flash(filePath string, logger chan any) (string, error) {
-	stdout, err := board.CyberBearLoader("load", "-f", filePath, "-b")
+func (board *BlgMb) Flash(ctx context.Context, filePath string, logger chan any) (string, error) {
+	stdout, err := board.CyberBearLoader(ctx, board.flashArgs(filePath)...)
 	msg := handleFlashResult(string(stdout), err)
 	return msg, err
 }
 
-func (board *BlgMb) Ping() error {
-	_, err := board.CyberBearLoader("identify")
+func (board *BlgMb) flashArgs(filePath string) []string {
+	return []string{"load", "-f", filePath, "-b"}
+}
+
+func (board *BlgMb) FlashPlan(filePath string) []string {
+	return []string{formatCommand(blgMbUploaderPath, board.cyberBearLoaderArgs(board.flashArgs(filePath)...))}
+}
+
+func (board *BlgMb) Ping(ctx context.Context) error {
+	_, err := board.CyberBearLoader(ctx, "identify")
 	return err
 }
 
-func (board *BlgMb) Reset() error {
-	_, err := board.CyberBearLoader("reboot")
+func (board *BlgMb) Reset(ctx context.Context) error {
+	_, err := board.CyberBearLoader(ctx, "reboot")
 	return err
 }
 
@@ -63,8 +110,8 @@ func (board *BlgMb) Update() bool {
 	return false
 }
 
-func (board *BlgMb) GetMetaData() (any, error) {
-	stdout, stderr := board.CyberBearLoader("identify")
+func (board *BlgMb) GetMetaData(ctx context.Context) (any, error) {
+	stdout, stderr := board.CyberBearLoader(ctx, "identify")
 	return string(stdout), stderr
 }
 
@@ -73,11 +120,11 @@ func (board *BlgMb) GetMetaData() (any, error) {
 
 Автоматически обновляет поле version.
 */
-func (board *BlgMb) GetVersion() (string, error) {
+func (board *BlgMb) GetVersion(ctx context.Context) (string, error) {
 	if board.version != "" {
 		return board.version, nil
 	}
-	value, err := board.GetMetaData()
+	value, err := board.GetMetaData(ctx)
 	if err != nil {
 		return "", err
 	}
@@ -102,21 +149,25 @@ func (board *BlgMb) GetVersion() (string, error) {
 	return "", fmt.Errorf("art value not found")
 }
 
-// Извлечение прошивки
-func (board *BlgMb) Extract() ([]byte, error) {
-	_, err := board.CyberBearLoader("reboot", "-b")
+// Извлечение прошивки, прерывается при отмене контекста ctx
+func (board *BlgMb) Extract(ctx context.Context) ([]byte, error) {
+	_, err := board.CyberBearLoader(ctx, "reboot", "-b")
 	if err != nil {
 		return []byte{}, err
 	}
-	_, err = board.CyberBearLoader("-m", "b1", "wait", "-t", "5")
+	_, err = board.CyberBearLoader(ctx, "-m", "b1", "wait", "-t", "5")
 	if err != nil {
 		return []byte{}, err
 	}
-	bytes, err := board.CyberBearLoader("extract", "--pages", "44")
+	bytes, err := board.CyberBearLoader(ctx, "extract", "--pages", "44")
 	if err != nil {
+		if ctx.Err() != nil {
+			// выгрузка отменена, возвращаем плату из режима загрузчика
+			board.CyberBearLoader(context.Background(), "reboot")
+		}
 		return bytes, err
 	}
-	_, err = board.CyberBearLoader("reboot")
+	_, err = board.CyberBearLoader(context.Background(), "reboot")
 	if err != nil {
 		// Предупреждаем, но не прекращаем работу
 		printLog("Не удалось перезагрузить КиберМишку:", err.Error())
@@ -124,9 +175,23 @@ func (board *BlgMb) Extract() ([]byte, error) {
 	return bytes, nil
 }
 
-func (board *BlgMb) GetId() (string, error) {
+func (board *BlgMb) Snapshot(ctx context.Context) ([]byte, error) {
+	return board.Extract(ctx)
+}
+
+// сравнение прошивки КиберМишки с файлом, прошивка выгружается через Extract
+func (board *BlgMb) Verify(ctx context.Context, filePath string, logger chan any) (VerifyResult, error) {
+	if logger != nil {
+		defer close(logger)
+	}
+	return verifyExtracted(filePath, func() ([]byte, error) {
+		return board.Extract(ctx)
+	})
+}
+
+func (board *BlgMb) GetId(ctx context.Context) (string, error) {
 	// TODO: унификация кода
-	value, err := board.GetMetaData()
+	value, err := board.GetMetaData(ctx)
 	if err != nil {
 		return "", err
 	}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"strings"
 	"sync"
 )
 
@@ -11,12 +13,81 @@ var notSupportedBoards = []string{""}
 type PidVidType struct {
 	ProductID string `json:"productID"`
 	VendorID  string `json:"vendorID"`
+	// серийный номер устройства, необязательное поле, если указан, то устройство с другим серийным номером не подходит к шаблону
+	SerialID string `json:"serialID,omitempty"`
 }
 
 type ArduinoPayload struct {
 	Controller   string `json:"controller"`
 	Programmer   string `json:"programmer"`
 	BootloaderID int    `json:"bootloaderID"`
+	// программа для прошивки: avrdude (по-умолчанию), встроенная реализация протокола (stk500v1) или arduino-cli
+	Uploader string `json:"uploader,omitempty"`
+	// полное название платы для arduino-cli (например, arduino:avr:uno)
+	FQBN string `json:"fqbn,omitempty"`
+	// скорость порта для встроенной реализации протокола, если не указана, то используется стандартная для протокола
+	Baud int `json:"baud,omitempty"`
+}
+
+/*
+Описание устройства, которое прошивается внешней программой (тип command).
+
+Команды задаются списком аргументов, первый элемент - программа, в аргументах можно использовать подстановки
+{port} (порт устройства), {file} (файл прошивки) и {serial} (серийный номер устройства).
+Необязательные команды могут отсутствовать, тогда соответствующая операция недоступна.
+*/
+type CommandPayload struct {
+	Flash []string `json:"flash"`
+	Ping  []string `json:"ping,omitempty"`
+	Reset []string `json:"reset,omitempty"`
+	// команда должна записать прошивку устройства в файл {file}
+	ReadFirmware []string `json:"readFirmware,omitempty"`
+	// вывод команды отправляется клиенту как метаданные устройства
+	Identify []string `json:"identify,omitempty"`
+	// регулярное выражение, которое должно найтись в выводе команды прошивки, иначе прошивка считается неудачной
+	SuccessRegex string `json:"successRegex,omitempty"`
+	// регулярное выражение для строки с прогрессом прошивки, группы percent и stage (необязательная)
+	ProgressRegex string `json:"progressRegex,omitempty"`
+}
+
+// описание устройства на ESP8266 или ESP32 (тип esp)
+type ESPPayload struct {
+	// ожидаемая модель микросхемы (например, ESP32), необязательное поле, если модель не совпадает, то прошивка не выполняется
+	Chip string `json:"chip,omitempty"`
+	// адрес во flash-памяти, по которому записывается файл прошивки (по-умолчанию 0)
+	Address int `json:"address,omitempty"`
+	// скорость, на которую загрузчик переключается для прошивки, если не указана, то используется 115200
+	Baud int `json:"baud,omitempty"`
+	// способ перезагрузки в загрузчик: classic (по-умолчанию) или usb-jtag
+	Reset string `json:"reset,omitempty"`
+}
+
+// описание устройства, которое прошивается через системный загрузчик STM32 по USART (тип stm32)
+type STM32Payload struct {
+	// скорость порта, по-умолчанию 115200
+	Baud int `json:"baud,omitempty"`
+	// линия порта, управляющая BOOT0: rts (по-умолчанию), dtr или none
+	Boot0 string `json:"boot0,omitempty"`
+	// линия порта, управляющая NRST: dtr (по-умолчанию), rts или none
+	Reset string `json:"reset,omitempty"`
+	// true, если активному состоянию сигналов соответствует снятая линия
+	InvertLines bool `json:"invertLines,omitempty"`
+}
+
+// описание устройства, которое прошивается копированием UF2-файла на накопитель (тип uf2)
+type UF2Payload struct {
+	// начало поля Board-ID в INFO_UF2.TXT, по которому накопитель сопоставляется с шаблоном, пустая строка подходит любому накопителю
+	BoardID string `json:"boardID,omitempty"`
+	// идентификатор семейства микроконтроллеров в UF2-блоках (например, 0xe48bff56 для RP2040), необязательное поле
+	FamilyID string `json:"familyID,omitempty"`
+}
+
+// описание устройства в режиме USB DFU (тип dfu)
+type DFUPayload struct {
+	// номер альтернативной настройки интерфейса DFU (у DfuSe - область памяти, 0 - внутренняя flash-память)
+	Alt int `json:"alt,omitempty"`
+	// использовать расширения DfuSe (STM32), если не указано, то определяется по версии DFU в дескрипторе устройства
+	DfuSe *bool `json:"dfuse,omitempty"`
 }
 
 type BoardTemplate struct {
@@ -26,18 +97,93 @@ type BoardTemplate struct {
 	Type               string          `json:"type"`
 	TypePayload        json.RawMessage `json:"typePayload"`
 	FlashFileExtension string          `json:"flashFileExtension"`
+	// максимальное время выполнения операций (в секундах), необязательное поле, см. timeout.go
+	Timeouts map[DeviceOperation]int `json:"timeouts,omitempty"`
+	// размер flash-памяти в байтах, необязательное поле, используется для проверки прошивки перед загрузкой
+	FlashSize int `json:"flashSize,omitempty"`
+	// область flash-памяти, занятая загрузчиком, необязательное поле, прошивка не должна её затрагивать
+	Bootloader *MemoryRegion `json:"bootloader,omitempty"`
+	// адрес, с которого начинается прошивка в формате BIN (используется при преобразовании BIN в HEX), необязательное поле
+	FlashBase int `json:"flashBase,omitempty"`
+}
+
+// область памяти, адреса указываются в байтах
+type MemoryRegion struct {
+	Start int `json:"start"`
+	Size  int `json:"size"`
 }
 
 type Board interface {
 	IsConnected() bool
 	GetSerialPort() string
-	Flash(filePath string, logger chan any) (string, error)
+	// прошивка устройства, операция прерывается при отмене контекста ctx
+	Flash(ctx context.Context, filePath string, logger chan any) (string, error)
 	Update() bool
 	GetWebMessageType() string
 	GetWebMessage(name string, deviceID string) any
-	Ping() error
-	Reset() error
-	GetMetaData() (any, error)
+	Ping(ctx context.Context) error
+	Reset(ctx context.Context) error
+	GetMetaData(ctx context.Context) (any, error)
+}
+
+// устройство, из которого можно выгрузить прошивку (get-firmware), выгрузка прерывается при отмене контекста ctx
+type Extractor interface {
+	Extract(ctx context.Context) ([]byte, error)
+}
+
+// устройство с EEPROM, которую можно считать и перезаписать, операции прерываются при отмене контекста ctx
+type EEPROMAccessor interface {
+	ReadEEPROM(ctx context.Context) ([]byte, error)
+	// запись файла в EEPROM, возвращает сообщение от прошивающей программы
+	WriteEEPROM(ctx context.Context, filePath string) (string, error)
+}
+
+// устройство с fuse-битами и lock-битами, операции чтения и записи прерываются при отмене контекста ctx
+type FuseAccessor interface {
+	ReadFuses(ctx context.Context) (map[string]byte, error)
+	// можно ли записывать fuse-биты (чтение проверяется через Supports(FuseOperation))
+	CanWriteFuses() bool
+	// проверка значений перед записью, возвращает ошибку, если значения могут сделать устройство непрошиваемым
+	CheckFuses(fuses map[string]byte) error
+	// запись fuse-битов, возвращает сообщение от прошивающей программы
+	WriteFuses(ctx context.Context, fuses map[string]byte) (string, error)
+}
+
+/*
+Устройство, текущую прошивку которого можно сохранить перед прошивкой (резервная копия), операция прерывается при отмене контекста ctx.
+
+Резервная копия восстанавливается обычной прошивкой через Flash.
+*/
+type Snapshotter interface {
+	Snapshot(ctx context.Context) ([]byte, error)
+}
+
+// устройство, которое адресуется внутри общей шины (МС-ТЮК), адрес передаётся клиентом при прошивке
+type Addressable interface {
+	GetAddress() string
+	SetAddress(address string)
+}
+
+// устройство, которое может проверить прошивку сразу после записи (параметр verification в ms-bin-start)
+type FlashVerificationSetter interface {
+	SetFlashVerification(verify bool)
+}
+
+// устройство, у которого набор доступных операций зависит от шаблона (тип command)
+type OperationChecker interface {
+	Supports(op DeviceOperation) bool
+}
+
+// поддерживает ли устройство операцию op, устройства без OperationChecker поддерживают все операции своего типа
+func supportsOperation(board Board, op DeviceOperation) bool {
+	checker, isOptional := board.(OperationChecker)
+	return !isOptional || checker.Supports(op)
+}
+
+// устройство, которое может описать прошивку без её выполнения (dry-run)
+type FlashPlanner interface {
+	// команды или операции, которые будут выполнены при прошивке файла filePath
+	FlashPlan(filePath string) []string
 }
 
 type Device struct {
@@ -60,16 +206,17 @@ func newDevice(typeDesc BoardTemplate, board Board) *Device {
 	return &device
 }
 
-func (temp *BoardTemplate) IsMSDevice() bool {
-	return temp.Type == "tjc-ms"
-}
-
-func (temp *BoardTemplate) IsArduinoDevice() bool {
-	return temp.Type == "arduino"
-}
-
-func (temp *BoardTemplate) IsBlgMbDevice() bool {
-	return temp.Type == "blg-mb"
+// подходит ли устройство с парой vendorID и productID и серийным номером serialID к шаблону (с учётом поля serialID пар pidvid)
+func (temp *BoardTemplate) acceptsSerial(vendorID string, productID string, serialID string) bool {
+	for _, pidvid := range temp.PidVid {
+		if !strings.EqualFold(pidvid.VendorID, vendorID) || !strings.EqualFold(pidvid.ProductID, productID) {
+			continue
+		}
+		if pidvid.SerialID == "" || strings.EqualFold(pidvid.SerialID, serialID) {
+			return true
+		}
+	}
+	return false
 }
 
 // находит шаблон платы по его id
@@ -150,6 +297,11 @@ func (dev *Device) getSerialMonitorBaudSync() int {
 	return dev.SerialMonitor.Baud
 }
 
+// true, если устройство прошивается через тот же порт, который открывается монитором порта
+func (dev *Device) flashesThroughSerial() bool {
+	return dev.TypeDesc.BoardType().FlashesThroughSerial
+}
+
 func (dev *Device) isFake() bool {
 	switch dev.Board.(type) {
 	case *FakeBoard:
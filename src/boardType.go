@@ -0,0 +1,96 @@
+package main
+
+import "log"
+
+// способ обнаружения устройства при опросе USB (см. detection_<ОС>.go)
+type DetectionKind int
+
+const (
+	// устройство с одним serial-портом (Arduino)
+	SerialDetection DetectionKind = iota
+	// устройство с четырьмя serial-портами и одинаковым для всех устройств серийным номером (МС-ТЮК)
+	MSDetection
+	// устройство без serial-порта, работа с ним идёт через внешнюю программу (КиберМишка)
+	USBDetection
+	// устройство не обнаруживается при опросе (фальшивые платы)
+	NoDetection
+	// устройства ищет сам тип через Detect, без опроса USB (плагины, UF2-накопители)
+	CustomDetection
+)
+
+// данные об устройстве, найденные при опросе
+type FoundDevice struct {
+	// для SerialDetection - один порт, для MSDetection - четыре порта, для USBDetection - пусто
+	Ports []string
+	// серийный номер устройства, если его нет, то NOT_FOUND (пустая строка для USBDetection)
+	SerialID  string
+	ArduinoOS ArduinoOS
+	MS1OS     MS1OS
+}
+
+/*
+Тип устройства (поле type в шаблоне).
+
+Каждый тип регистрируется через registerBoardType в init() файла со своей реализацией,
+операции, которые поддерживает устройство, определяются интерфейсами, которые реализует Board (Verifier, Extractor и т.д.).
+*/
+type BoardType struct {
+	Name      string
+	Detection DetectionKind
+	// создание устройства по данным, найденным при опросе
+	New func(temp BoardTemplate, found FoundDevice) Board
+	// поиск устройств для CustomDetection, templates - список шаблонов, ключ результата - ID устройства
+	Detect func(templates []BoardTemplate) map[string]*Device
+	// перенос данных повторно обнаруженного устройства found в уже известное old (под блокировкой old),
+	// возвращает true, если изменился порт, необязательное поле
+	Refresh func(old *Device, found *Device) bool
+	// получение дополнительных данных об устройстве после обнаружения (под блокировкой, если устройство уже в списке),
+	// необязательное поле
+	Init func(dev *Device)
+	// тип сообщения, через которое клиенту отправляется прогресс из logger, пустая строка, если прогресс не отправляется
+	ProgressMsg string
+	// true, если устройство прошивается через тот же порт, который открывается монитором порта
+	FlashesThroughSerial bool
+	// время ожидания (в секундах) для операций, может быть переопределено полем timeouts в шаблоне устройства (см. timeout.go)
+	Timeouts map[DeviceOperation]int
+}
+
+var boardTypes = make(map[string]*BoardType)
+
+func registerBoardType(boardType *BoardType) {
+	if _, exists := boardTypes[boardType.Name]; exists {
+		log.Fatalln("Тип устройства зарегистрирован повторно:", boardType.Name)
+	}
+	boardTypes[boardType.Name] = boardType
+}
+
+// тип устройства по названию, false, если такой тип не зарегистрирован
+func findBoardType(name string) (*BoardType, bool) {
+	boardType, exists := boardTypes[name]
+	return boardType, exists
+}
+
+// тип устройства шаблона, для незарегистрированных типов возвращается тип без обработчиков
+func (temp *BoardTemplate) BoardType() *BoardType {
+	if boardType, exists := findBoardType(temp.Type); exists {
+		return boardType
+	}
+	return &BoardType{Name: temp.Type, Detection: NoDetection}
+}
+
+// обновление известного устройства данными повторно обнаруженного устройства, возвращает true, если изменился порт
+func (dev *Device) refresh(found *Device) bool {
+	boardType := dev.TypeDesc.BoardType()
+	portChanged := false
+	if boardType.Refresh != nil {
+		portChanged = boardType.Refresh(dev, found)
+	}
+	dev.init()
+	return portChanged
+}
+
+func (dev *Device) init() {
+	if init := dev.TypeDesc.BoardType().Init; init != nil {
+		init(dev)
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// подстановки в аргументах команд устройства типа command
+const (
+	PORT_PLACEHOLDER   = "{port}"
+	FILE_PLACEHOLDER   = "{file}"
+	SERIAL_PLACEHOLDER = "{serial}"
+)
+
+/*
+Устройство, которое прошивается внешней программой, команды которой описаны в шаблоне (тип command).
+
+Порт и серийный номер устройства определяются так же, как у Arduino.
+*/
+type CommandBoard struct {
+	payload CommandPayload
+	// признак успешной прошивки в выводе программы, nil, если не задан
+	success *regexp.Regexp
+	// строка с прогрессом прошивки в выводе программы, nil, если не задана
+	progress *regexp.Regexp
+	// используется только для поиска и отслеживания порта устройства
+	port *Arduino
+}
+
+func init() {
+	registerBoardType(&BoardType{
+		Name:      "command",
+		Detection: SerialDetection,
+		New: func(temp BoardTemplate, found FoundDevice) Board {
+			return NewCommandBoard(temp, found.Ports[0], found.ArduinoOS, found.SerialID)
+		},
+		Refresh: func(old *Device, found *Device) bool {
+			oldPort := old.Board.(*CommandBoard).port
+			newPort := found.Board.(*CommandBoard).port
+			if oldPort.portName == newPort.portName {
+				return false
+			}
+			oldPort.portName = newPort.portName
+			return true
+		},
+		ProgressMsg:          FlashBacktrackMsg,
+		FlashesThroughSerial: true,
+		Timeouts: map[DeviceOperation]int{
+			FlashOperation:   120,
+			PingOperation:    15,
+			ResetOperation:   15,
+			MetaOperation:    15,
+			ExtractOperation: 120,
+		},
+	})
+}
+
+func NewCommandBoard(temp BoardTemplate, portName string, ardOS ArduinoOS, serialID string) *CommandBoard {
+	board := CommandBoard{
+		port: &Arduino{
+			bootloaderID: -1,
+			serialID:     serialID,
+			portName:     portName,
+			ardOS:        ardOS,
+		},
+	}
+	err := json.Unmarshal(temp.TypePayload, &board.payload)
+	if err != nil {
+		printLog("Error, wrong command payload!", temp.Name, err.Error())
+		return &board
+	}
+	board.success = compilePayloadRegex(temp.Name, "successRegex", board.payload.SuccessRegex)
+	board.progress = compilePayloadRegex(temp.Name, "progressRegex", board.payload.ProgressRegex)
+	return &board
+}
+
+// некорректное регулярное выражение игнорируется, чтобы ошибка в одном шаблоне не мешала работе с остальными устройствами
+func compilePayloadRegex(templateName string, field string, expr string) *regexp.Regexp {
+	if expr == "" {
+		return nil
+	}
+	regex, err := regexp.Compile(expr)
+	if err != nil {
+		printLog("Error, wrong", field, "in template", templateName, err.Error())
+		return nil
+	}
+	return regex
+}
+
+// команда с подставленными значениями, file - путь к файлу прошивки
+func (board *CommandBoard) expand(command []string, file string) (string, []string) {
+	serialID := board.port.serialID
+	if serialID == NOT_FOUND {
+		serialID = ""
+	}
+	replacer := strings.NewReplacer(
+		PORT_PLACEHOLDER, board.port.portName,
+		FILE_PLACEHOLDER, file,
+		SERIAL_PLACEHOLDER, serialID,
+	)
+	args := make([]string, 0, len(command)-1)
+	for _, arg := range command[1:] {
+		args = append(args, replacer.Replace(arg))
+	}
+	return replacer.Replace(command[0]), args
+}
+
+// запуск команды, вывод программы записывается в output, процесс завершается принудительно при отмене контекста ctx
+func (board *CommandBoard) run(ctx context.Context, command []string, file string, output io.Writer) error {
+	if len(command) == 0 {
+		return errors.New("команда не задана в шаблоне устройства")
+	}
+	name, args := board.expand(command, file)
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	return cmd.Run()
+}
+
+func (board *CommandBoard) runOutput(ctx context.Context, command []string, file string) ([]byte, error) {
+	var output bytes.Buffer
+	err := board.run(ctx, command, file, &output)
+	return output.Bytes(), err
+}
+
+func (board *CommandBoard) IsConnected() bool {
+	return board.port.IsConnected()
+}
+
+func (board *CommandBoard) GetSerialPort() string {
+	return board.port.portName
+}
+
+// прогресс прошивки отправляется в logger, если задан progressRegex, после завершения прошивки logger закрывается
+func (board *CommandBoard) Flash(ctx context.Context, filePath string, logger chan any) (string, error) {
+	if logger != nil {
+		defer close(logger)
+	}
+	var output bytes.Buffer
+	var writer io.Writer = &output
+	if logger != nil && board.progress != nil {
+		writer = io.MultiWriter(&output, newCommandProgressParser(logger, board.progress))
+	}
+	err := board.run(ctx, board.payload.Flash, getAbolutePath(filePath), writer)
+	if err == nil && board.success != nil && !board.success.Match(output.Bytes()) {
+		err = errors.New("в выводе программы прошивки нет признака успешной прошивки")
+	}
+	return handleFlashResult(output.String(), err), err
+}
+
+func (board *CommandBoard) FlashPlan(filePath string) []string {
+	if len(board.payload.Flash) == 0 {
+		return []string{"команда прошивки не задана в шаблоне устройства"}
+	}
+	return []string{formatCommand(board.expand(board.payload.Flash, getAbolutePath(filePath)))}
+}
+
+func (board *CommandBoard) Update() bool {
+	return board.port.Update()
+}
+
+func (board *CommandBoard) GetWebMessageType() string {
+	return DeviceMsg
+}
+
+func (board *CommandBoard) GetWebMessage(name string, deviceID string) any {
+	return DeviceMessage{
+		ID:           deviceID,
+		Name:         name,
+		SerialID:     board.port.serialID,
+		PortName:     board.port.portName,
+		LastFirmware: deviceHistory.Last(deviceID),
+	}
+}
+
+// используется команда ping, если её нет, то identify, если нет и её, то проверяется наличие порта
+func (board *CommandBoard) Ping(ctx context.Context) error {
+	command := board.payload.Ping
+	if len(command) == 0 {
+		command = board.payload.Identify
+	}
+	if len(command) == 0 {
+		if !board.IsConnected() {
+			return errors.New("порт устройства не найден")
+		}
+		return nil
+	}
+	_, err := board.runOutput(ctx, command, "")
+	return err
+}
+
+func (board *CommandBoard) Reset(ctx context.Context) error {
+	_, err := board.runOutput(ctx, board.payload.Reset, "")
+	return err
+}
+
+// вывод команды identify
+func (board *CommandBoard) GetMetaData(ctx context.Context) (any, error) {
+	stdout, err := board.runOutput(ctx, board.payload.Identify, "")
+	return string(stdout), err
+}
+
+// операция доступна, если для неё задана команда в шаблоне
+func (board *CommandBoard) Supports(op DeviceOperation) bool {
+	switch op {
+	case FlashOperation:
+		return len(board.payload.Flash) > 0
+	case ResetOperation:
+		return len(board.payload.Reset) > 0
+	case MetaOperation:
+		return len(board.payload.Identify) > 0
+	case ExtractOperation:
+		return len(board.payload.ReadFirmware) > 0
+	}
+	return true
+}
+
+// выгрузка прошивки командой readFirmware, которая должна записать прошивку в файл {file}
+func (board *CommandBoard) Extract(ctx context.Context) ([]byte, error) {
+	file, err := os.CreateTemp("", "lapki-firmware-*.bin")
+	if err != nil {
+		return nil, err
+	}
+	filePath := file.Name()
+	file.Close()
+	defer os.Remove(filePath)
+	stdout, err := board.runOutput(ctx, board.payload.ReadFirmware, filePath)
+	if err != nil {
+		return nil, errors.New(handleFlashResult(string(stdout), err))
+	}
+	return os.ReadFile(filePath)
+}
+
+/*
+Разбор вывода программы прошивки для получения прогресса.
+
+Процент берётся из группы percent регулярного выражения (или из первой группы, если именованной группы нет),
+название этапа - из группы stage, если её нет, то этап считается записью (writing).
+*/
+type commandProgressParser struct {
+	logger   chan any
+	regex    *regexp.Regexp
+	line     []byte
+	reporter *progressReporter
+}
+
+func newCommandProgressParser(logger chan any, regex *regexp.Regexp) *commandProgressParser {
+	return &commandProgressParser{
+		logger: logger,
+		regex:  regex,
+	}
+}
+
+func (parser *commandProgressParser) Write(data []byte) (int, error) {
+	for _, b := range data {
+		if b == '\n' || b == '\r' {
+			parser.handleLine(string(parser.line))
+			parser.line = parser.line[:0]
+			continue
+		}
+		parser.line = append(parser.line, b)
+	}
+	return len(data), nil
+}
+
+func (parser *commandProgressParser) handleLine(line string) {
+	match := parser.regex.FindStringSubmatch(line)
+	if match == nil {
+		return
+	}
+	percentIndex := parser.regex.SubexpIndex("percent")
+	if percentIndex < 0 {
+		percentIndex = 1
+	}
+	if percentIndex >= len(match) {
+		return
+	}
+	percent, err := strconv.Atoi(match[percentIndex])
+	if err != nil {
+		return
+	}
+	percent = min(max(percent, 0), 100)
+	stage := WRITING_STAGE
+	if stageIndex := parser.regex.SubexpIndex("stage"); stageIndex > 0 && match[stageIndex] != "" {
+		stage = strings.ToLower(match[stageIndex])
+	}
+	if parser.reporter == nil || parser.reporter.stage != stage {
+		parser.reporter = newProgressReporter(parser.logger, stage)
+	}
+	parser.reporter.report(percent, 100)
+}
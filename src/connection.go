@@ -2,6 +2,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"sync"
@@ -35,6 +36,12 @@ type WebSocketConnection struct {
 	numQueries  int
 	Manager     *WebSocketManager
 	binDataChan chan []byte
+	// контекст текущей операции прошивки или выгрузки прошивки, nil, если операции нет
+	operationCtx context.Context
+	// отмена текущей операции (flash-cancel)
+	cancelOperation context.CancelFunc
+	// true, если загружается файл, не привязанный к устройству (inspect-firmware)
+	uploading bool
 }
 
 func NewWebSocket(wsc *websocket.Conn, getListCooldownDuration time.Duration, m *WebSocketManager, maxQueries int) *WebSocketConnection {
@@ -100,7 +107,13 @@ func (c *WebSocketConnection) decNumQueries() {
 func (c *WebSocketConnection) IsBinChanBusySync() bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	return c.FlashingBoard != nil
+	return c.FlashingBoard != nil || c.uploading
+}
+
+func (c *WebSocketConnection) SetUploadingSync(uploading bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.uploading = uploading
 }
 
 func (c *WebSocketConnection) SetFlashingBoard(dev *Device, ID string) {
@@ -134,6 +147,43 @@ func (c *WebSocketConnection) SetFlasherMessageSync(msg string) {
 	c.flasherMsg = msg
 }
 
+// начать новую операцию (прошивку или выгрузку прошивки), которую клиент может отменить через flash-cancel
+func (c *WebSocketConnection) StartOperationSync() context.Context {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.operationCtx, c.cancelOperation = context.WithCancel(context.Background())
+	return c.operationCtx
+}
+
+// завершение текущей операции, после этого её нельзя отменить
+func (c *WebSocketConnection) StopOperationSync() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cancelOperation != nil {
+		c.cancelOperation()
+	}
+	c.operationCtx = nil
+	c.cancelOperation = nil
+}
+
+// отменить текущую операцию, возвращает false, если отменять нечего
+func (c *WebSocketConnection) CancelOperationSync() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cancelOperation == nil {
+		return false
+	}
+	c.cancelOperation()
+	return true
+}
+
+// возвращает контекст текущей операции, либо nil, если операции нет
+func (c *WebSocketConnection) GetOperationCtxSync() context.Context {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.operationCtx
+}
+
 func (c *WebSocketConnection) isClosedChan() bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -16,13 +16,17 @@ type Detector struct {
 	boards         map[string]*Device
 	boardTemplates []BoardTemplate
 	mu             sync.Mutex
+	// обновления выполняются по очереди, поиск устройств выполняется без блокировки mu,
+	// чтобы медленный поиск (например, плагином) не блокировал работу со списком устройств
+	updateMu sync.Mutex
 
 	// симуляция плат
 	fakeBoards map[string]*Device
 
-	// Список ID типов плат, которые не нужно добавлять, при обновлении.
+	// Список ID типов плат, которые не нужно добавлять, при обновлении, и количество запросов на исключение каждого типа
+	// (тип исключается, пока все запросившие его не вызовут AddThisType).
 	// Старые устройства, если они не отсоединялись, останутся в списке, даже если их typeID находится в списке
-	dontAddTypes map[int]void
+	dontAddTypes map[int]int
 
 	boardActions *list.List
 }
@@ -33,7 +37,7 @@ func NewDetector() *Detector {
 	// добавление фальшивых плат
 	d.generateFakeBoards()
 	d.initDeviceListErrorHandle(deviceListPath)
-	d.dontAddTypes = make(map[int]void)
+	d.dontAddTypes = make(map[int]int)
 	d.boardActions = list.New()
 	return &d
 }
@@ -54,11 +58,25 @@ func (d *Detector) Update() (
 	notAddedDevices map[string]*Device,
 	devicesInList map[string]*Device) {
 
-	d.mu.Lock()
-	defer d.mu.Unlock()
+	d.updateMu.Lock()
+	defer d.updateMu.Unlock()
 
+	// шаблоны и фальшивые платы не меняются после создания детектора, поэтому поиск выполняется без блокировки mu
 	detectedBoards = detectBoards(d.boardTemplates)
 
+	// добавление устройств, которые ищут сами типы (плагины, UF2-накопители)
+	for _, boardType := range boardTypes {
+		if boardType.Detection != CustomDetection || boardType.Detect == nil {
+			continue
+		}
+		if detectedBoards == nil {
+			detectedBoards = make(map[string]*Device)
+		}
+		for ID, board := range boardType.Detect(d.boardTemplates) {
+			detectedBoards[ID] = board
+		}
+	}
+
 	// добавление фальшивых плат к действительно обнаруженным
 	if fakeBoardsNum > 0 || fakeMSNum > 0 {
 		if detectedBoards == nil {
@@ -69,6 +87,9 @@ func (d *Detector) Update() (
 		}
 	}
 
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
 	// обновление информации о старых устройствах и добавление новых
 
 	notAddedDevices = make(map[string]*Device)
@@ -77,36 +98,15 @@ func (d *Detector) Update() (
 		oldBoard, exists := d.boards[deviceID]
 		if exists {
 			oldBoard.Mu.Lock()
-			switch oldBoard.Board.(type) {
-			case *Arduino:
-				oldArduino := oldBoard.Board.(*Arduino)
-				newArduino := newBoard.Board.(*Arduino)
-				if oldArduino.portName != newArduino.portName {
-					oldArduino.portName = newArduino.portName
-					d.boardActions.PushBack(ActionWithBoard{board: oldBoard, boardID: deviceID, action: PORT_UPDATE})
-				}
-			case *BlgMb:
-				blgBoard := oldBoard.Board.(*BlgMb)
-				if blgBoard.version == "" {
-					blgBoard.GetVersion()
-				}
-				if blgBoard.serialID == "" {
-					blgBoard.GetId()
-				}
+			if oldBoard.refresh(newBoard) {
+				d.boardActions.PushBack(ActionWithBoard{board: oldBoard, boardID: deviceID, action: PORT_UPDATE})
 			}
 			oldBoard.Mu.Unlock()
 		} else {
 			if _, ok := d.dontAddTypes[newBoard.TypeDesc.ID]; ok {
 				notAddedDevices[deviceID] = newBoard
 			} else {
-				switch newBoard.Board.(type) {
-				case *BlgMb:
-					blgBoard := newBoard.Board.(*BlgMb)
-					blgBoard.GetVersion()
-					if blgBoard.serialID == "" {
-						blgBoard.GetId()
-					}
-				}
+				newBoard.init()
 				d.boards[deviceID] = newBoard
 				d.boardActions.PushBack(ActionWithBoard{board: newBoard, boardID: deviceID, action: ADD})
 			}
@@ -142,13 +142,17 @@ func (d *Detector) PopFrontActionSync() (action ActionWithBoard, exists bool) {
 func (d *Detector) DontAddThisType(typeID int) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	d.dontAddTypes[typeID] = void{}
+	d.dontAddTypes[typeID]++
 }
 
+// отмена одного вызова DontAddThisType, устройства снова добавляются, когда отменены все вызовы
 func (d *Detector) AddThisType(typeID int) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	delete(d.dontAddTypes, typeID)
+	d.dontAddTypes[typeID]--
+	if d.dontAddTypes[typeID] <= 0 {
+		delete(d.dontAddTypes, typeID)
+	}
 }
 
 // возвращает устройство, соответствующее ID, существует ли устройство в списке
@@ -194,6 +198,16 @@ func (d *Detector) boardList() []BoardTemplate {
 	return d.boardTemplates
 }
 
+// поиск шаблона устройства по его ID, false, если такого шаблона нет
+func (d *Detector) findTemplate(ID int) (*BoardTemplate, bool) {
+	for i := range d.boardTemplates {
+		if d.boardTemplates[i].ID == ID {
+			return &d.boardTemplates[i], true
+		}
+	}
+	return nil, false
+}
+
 // генерация фальшивых плат, которые будут восприниматься программой как настоящие
 func (d *Detector) generateFakeBoards() {
 	d.fakeBoards = make(map[string]*Device)
@@ -18,6 +18,11 @@ type ArduinoOS struct {
 type MS1OS struct {
 }
 
+// расположение устройства на шине не определяется
+func (ardOS ArduinoOS) usbLocation() string {
+	return ""
+}
+
 type IOREG struct {
 	VendorID  int64 `plist:"idVendor"`
 	ProductID int64 `plist:"idProduct"`
@@ -93,6 +98,10 @@ func IOREGscan(plistArr []IOREG, boardTemplates []BoardTemplate, boards map[stri
 	for _, entry := range plistArr {
 		isFound := false
 		for _, boardTemplate := range boardTemplates {
+			// такие устройства ищет сам тип (см. BoardType.Detect)
+			if boardTemplate.BoardType().Detection == CustomDetection {
+				continue
+			}
 			for _, pidvid := range boardTemplate.PidVid {
 				productID := pidvid.ProductID
 				PID, err := strconv.ParseInt(productID, 16, 64)
@@ -109,7 +118,13 @@ func IOREGscan(plistArr []IOREG, boardTemplates []BoardTemplate, boards map[stri
 				if entry.ProductID == PID && entry.VendorID == VID {
 					var board Board
 					var ID string
-					if boardTemplate.IsMSDevice() {
+					boardType := boardTemplate.BoardType()
+					if boardType.New == nil || boardType.Detection == NoDetection {
+						printLog("no searching algorithm for this type of device!", boardTemplate.Type)
+						continue
+					}
+					switch boardType.Detection {
+					case MSDetection:
 						// TODO
 						portsMap := make(map[string]struct{}, 4)
 						ID = strconv.FormatInt(collectMSBoardInfo(entry, portsMap), 10)
@@ -137,37 +152,40 @@ func IOREGscan(plistArr []IOREG, boardTemplates []BoardTemplate, boards map[stri
 								return ports[i] < ports[j]
 							}
 						})
-						board = NewMS1(
-							[4]string{ports[0], ports[1], ports[2], ports[3]},
-							MS1OS{},
-						)
-					} else if boardTemplate.IsArduinoDevice() {
-						arduino := NewArduinoFromTemp(
-							boardTemplate,
-							NOT_FOUND,
-							ArduinoOS{},
-							NOT_FOUND,
-						)
-						ID = strconv.FormatInt(collectArduinoBoardInfo(entry, arduino), 10)
-						if arduino.serialID != "" {
-							ID = arduino.serialID
+						board = boardType.New(boardTemplate, FoundDevice{
+							Ports: ports,
+							MS1OS: MS1OS{},
+						})
+					case SerialDetection:
+						// порт и серийный номер собираются во временное описание Arduino
+						found := &Arduino{
+							bootloaderID: -1,
+							serialID:     NOT_FOUND,
+							portName:     NOT_FOUND,
+						}
+						ID = strconv.FormatInt(collectArduinoBoardInfo(entry, found), 10)
+						if found.serialID != "" {
+							ID = found.serialID
 						}
 						if ID == "" || ID == "0" {
 							printLog("can't find ID!")
 							goto SKIP
 						}
-						if arduino.portName == NOT_FOUND {
+						if found.portName == NOT_FOUND {
 							printLog("can't find port name!")
 							goto SKIP
 						}
-						arduino.ardOS.ID = ID
-						board = arduino
-					} else if boardTemplate.IsBlgMbDevice() {
-						ID = productID + vendorID + "blg-mb"
-						board = &BlgMb{}
-					} else {
-						printLog("no searching algorithm for this type of device!", boardTemplate.Type)
-						continue
+						if !boardTemplate.acceptsSerial(vendorID, productID, found.serialID) {
+							continue
+						}
+						board = boardType.New(boardTemplate, FoundDevice{
+							Ports:     []string{found.portName},
+							SerialID:  found.serialID,
+							ArduinoOS: ArduinoOS{ID: ID},
+						})
+					case USBDetection:
+						ID = productID + vendorID + boardTemplate.Type
+						board = boardType.New(boardTemplate, FoundDevice{})
 					}
 					detectedDevice := newDevice(
 						boardTemplate,
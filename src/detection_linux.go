@@ -20,6 +20,8 @@ type ArduinoOS struct {
 	deviceID  string
 	productID string
 	vendorID  string
+	// расположение устройства на шине (см. usbLocation)
+	location string
 }
 
 type MS1OS struct {
@@ -61,6 +63,10 @@ func detectBoards(boardTemplates []BoardTemplate) map[string]*Device {
 
 	_, err := ctx.OpenDevices(func(desc *gousb.DeviceDesc) bool {
 		for _, boardTemplate := range boardTemplates {
+			// такие устройства ищет сам тип (см. BoardType.Detect)
+			if boardTemplate.BoardType().Detection == CustomDetection {
+				continue
+			}
 			vid := ""
 			pid := ""
 			foundVidPid := false
@@ -75,8 +81,13 @@ func detectBoards(boardTemplates []BoardTemplate) map[string]*Device {
 			if !foundVidPid {
 				continue
 			}
-			if boardTemplate.IsBlgMbDevice() {
-				devs[pid+vid+"blg-mb"] = newDevice(boardTemplate, &BlgMb{})
+			boardType := boardTemplate.BoardType()
+			if boardType.New == nil || boardType.Detection == NoDetection {
+				printLog("no searching algorithm for this type of device!", boardTemplate.Type)
+				break
+			}
+			if boardType.Detection == USBDetection {
+				devs[pid+vid+boardTemplate.Type] = newDevice(boardTemplate, boardType.New(boardTemplate, FoundDevice{}))
 				break
 			}
 			ports := findPortName(desc)
@@ -91,45 +102,33 @@ func detectBoards(boardTemplates []BoardTemplate) map[string]*Device {
 				break
 			}
 			serialID := properties[1]
+			if !boardTemplate.acceptsSerial(vid, pid, serialID) {
+				continue
+			}
 			var id string
 			// на данный момент у всех МС-ТЮК одинаковый serialID, поэтому мы его игнорируем
-			if serialID != NOT_FOUND && !boardTemplate.IsMSDevice() {
+			if serialID != NOT_FOUND && boardType.Detection != MSDetection {
 				id = serialID
 			} else {
 				id = properties[0]
 			}
-			var board Board
-			if boardTemplate.IsMSDevice() {
-				if portsNum != 4 {
-					printLog("Number of ports for ms1 should be equal to 4. Number of ports for this device:", portsNum)
-					break
-				}
-				board = NewMS1(
-					[4]string{
-						ports[0],
-						ports[1],
-						ports[2],
-						ports[3],
-					},
-					MS1OS{
-						deviceID: id,
-					},
-				)
-			} else if boardTemplate.IsArduinoDevice() {
-				board = NewArduinoFromTemp(
-					boardTemplate,
-					ports[0],
-					ArduinoOS{
-						deviceID:  id,
-						productID: pid,
-						vendorID:  vid,
-					},
-					serialID,
-				)
-			} else {
-				printLog("no searching algorithm for this type of device!", boardTemplate.Type)
+			if boardType.Detection == MSDetection && portsNum != 4 {
+				printLog("Number of ports for ms1 should be equal to 4. Number of ports for this device:", portsNum)
 				break
 			}
+			board := boardType.New(boardTemplate, FoundDevice{
+				Ports:    ports,
+				SerialID: serialID,
+				ArduinoOS: ArduinoOS{
+					deviceID:  id,
+					productID: pid,
+					vendorID:  vid,
+					location:  usbLocation(desc),
+				},
+				MS1OS: MS1OS{
+					deviceID: id,
+				},
+			})
 			devs[id] = newDevice(boardTemplate, board)
 			break
 		}
@@ -144,6 +143,20 @@ func detectBoards(boardTemplates []BoardTemplate) map[string]*Device {
 	return devs
 }
 
+// расположение устройства на шине: <шина>-<порт[.порт]>, не меняется при перезагрузке устройства в bootloader
+func usbLocation(desc *gousb.DeviceDesc) string {
+	ports := make([]string, len(desc.Path))
+	for i, port := range desc.Path {
+		ports[i] = strconv.Itoa(port)
+	}
+	return fmt.Sprintf("%d-%s", desc.Bus, strings.Join(ports, "."))
+}
+
+// расположение устройства на шине, пустая строка, если оно неизвестно
+func (ardOS ArduinoOS) usbLocation() string {
+	return ardOS.location
+}
+
 func hasFound(ID string, isSerial bool, portName string) bool {
 	var properties []string
 	var err error
@@ -22,6 +22,11 @@ type MS1OS struct {
 	pathesToDevices [4]string
 }
 
+// расположение устройства на шине не определяется
+func (ardOS ArduinoOS) usbLocation() string {
+	return ""
+}
+
 // настройка ОС (для Windows она не требуется, но она здесь присутствует, чтобы обеспечить совместимость с другими платформами, которые использует свои реализации этой функции)
 func setupOS() {
 
@@ -187,6 +192,10 @@ func detectBoards(boardTemplates []BoardTemplate) map[string]*Device {
 		device := strings.TrimSpace(line)
 		deviceLen := len(device)
 		for _, boardTemplate := range boardTemplates {
+			// такие устройства ищет сам тип (см. BoardType.Detect)
+			if boardTemplate.BoardType().Detection == CustomDetection {
+				continue
+			}
 			for _, pidvid := range boardTemplate.PidVid {
 				vendorID := pidvid.VendorID
 				productID := pidvid.ProductID
@@ -198,7 +207,12 @@ func detectBoards(boardTemplates []BoardTemplate) map[string]*Device {
 					if portName == NOT_FOUND {
 						printLog("WARNING: No port for device:", device)
 					}
-					if boardTemplate.IsMSDevice() {
+					boardType := boardTemplate.BoardType()
+					if boardType.New == nil || boardType.Detection == NoDetection {
+						printLog("no searching algorithm for this type of device!", boardTemplate.Type)
+						continue
+					}
+					if boardType.Detection == MSDetection {
 						// сбор МС-ТЮК "по-частям"
 
 						// поиск "FriendlyName"
@@ -229,17 +243,16 @@ func detectBoards(boardTemplates []BoardTemplate) map[string]*Device {
 						if strings.Contains(possibleSerialID, "&") {
 							possibleSerialID = ""
 						}
-						if boardTemplate.IsArduinoDevice() {
-							detectedBoard := NewArduinoFromTemp(boardTemplate, portName, ArduinoOS{pathToDevice: device}, possibleSerialID)
-							devs[device] = newDevice(boardTemplate, detectedBoard)
-							printLog("Arduino device was found:", detectedBoard, device)
-						} else if boardTemplate.IsBlgMbDevice() {
-							devs[device] = newDevice(boardTemplate, &BlgMb{serialID: possibleSerialID})
-							printLog("CyberBear device was found:", device)
-						} else {
-							//TODO
-							printLog("no searching algorithm for this type of device!", boardTemplate.Type)
+						if !boardTemplate.acceptsSerial(vendorID, productID, possibleSerialID) {
+							continue
 						}
+						detectedBoard := boardType.New(boardTemplate, FoundDevice{
+							Ports:     []string{portName},
+							SerialID:  possibleSerialID,
+							ArduinoOS: ArduinoOS{pathToDevice: device},
+						})
+						devs[device] = newDevice(boardTemplate, detectedBoard)
+						printLog("Device was found:", boardTemplate.Type, detectedBoard, device)
 					}
 				}
 			}
@@ -272,7 +285,10 @@ func detectBoards(boardTemplates []BoardTemplate) map[string]*Device {
 			portNames[i] = pack[i].portName
 			pathesToDevices[i] = pack[i].pathToDevice
 		}
-		ms1 := NewMS1(portNames, MS1OS{pathesToDevices: pathesToDevices})
+		ms1 := pack[0].template.BoardType().New(*pack[0].template, FoundDevice{
+			Ports: portNames[:],
+			MS1OS: MS1OS{pathesToDevices: pathesToDevices},
+		})
 		devs[pack[0].pathToDevice] = newDevice(*pack[0].template, ms1)
 	}
 	//endTime := time.Now()
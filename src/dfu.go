@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+/*
+Устройство в режиме USB DFU 1.1 (например, STM32 со встроенным загрузчиком DfuSe), прошивается через control-запросы
+к интерфейсу DFU без сторонних программ (см. dfuLoader.go).
+
+Устройства ищутся по классу интерфейса DFU среди USB-устройств, pidvid которых указан в шаблоне типа dfu (см. dfuUSB_linux.go).
+*/
+type DFU struct {
+	payload   DFUPayload
+	flashBase uint32
+	// максимальный размер непрерывного образа прошивки (см. BoardTemplate.maxImageSize)
+	maxImageSize int
+	// расположение устройства на шине (<шина>-<порт[.порт]>), по нему устройство открывается повторно
+	location string
+}
+
+// метаданные устройства DFU
+type DFUMetaData struct {
+	DFUVersion   string `json:"dfuVersion"`
+	DfuSe        bool   `json:"dfuse"`
+	TransferSize int    `json:"transferSize"`
+	// название области памяти альтернативной настройки (у DfuSe - раскладка памяти)
+	Memory string `json:"memory,omitempty"`
+}
+
+func init() {
+	registerBoardType(&BoardType{
+		Name:        "dfu",
+		Detection:   CustomDetection,
+		Detect:      detectDFU,
+		ProgressMsg: FlashBacktrackMsg,
+		Timeouts: map[DeviceOperation]int{
+			FlashOperation: 180,
+			PingOperation:  5,
+			MetaOperation:  5,
+		},
+	})
+}
+
+func NewDFU(temp BoardTemplate, location string) *DFU {
+	board := DFU{
+		flashBase:    uint32(temp.FlashBase),
+		maxImageSize: temp.maxImageSize(),
+		location:     location,
+	}
+	if board.flashBase == 0 {
+		board.flashBase = stm32DefaultFlashBase
+	}
+	if len(temp.TypePayload) > 0 {
+		err := json.Unmarshal(temp.TypePayload, &board.payload)
+		if err != nil {
+			printLog("Error, wrong dfu payload!", temp.Name, err.Error())
+		}
+	}
+	return &board
+}
+
+// первый шаблон типа dfu, в pidvid которого есть пара vendorID и productID
+func findDFUTemplate(templates []BoardTemplate, vendorID string, productID string) *BoardTemplate {
+	for i := range templates {
+		if templates[i].Type != "dfu" {
+			continue
+		}
+		for _, pidvid := range templates[i].PidVid {
+			if strings.EqualFold(pidvid.VendorID, vendorID) && strings.EqualFold(pidvid.ProductID, productID) {
+				return &templates[i]
+			}
+		}
+	}
+	return nil
+}
+
+/*
+Открытие интерфейса DFU и перевод устройства в состояние dfuIDLE.
+
+Расширения DfuSe используются, если они включены в шаблоне, либо если версия DFU в дескрипторе равна 0x011A.
+*/
+func (board *DFU) open() (*dfuLoader, error) {
+	transport, info, err := openDFUTransport(board.location, board.payload.Alt)
+	if err != nil {
+		return nil, err
+	}
+	dfuse := info.version == dfuSeVersion
+	if board.payload.DfuSe != nil {
+		dfuse = *board.payload.DfuSe
+	}
+	loader := newDFULoader(transport, info, dfuse)
+	err = loader.toIdle()
+	if err != nil {
+		loader.close()
+		return nil, err
+	}
+	return loader, nil
+}
+
+// устройство отслеживается поиском (см. detectDFU)
+func (board *DFU) IsConnected() bool {
+	return true
+}
+
+// у устройства DFU нет serial-порта
+func (board *DFU) GetSerialPort() string {
+	return ""
+}
+
+/*
+Прошивка файлом в формате BIN (записывается с адреса flashBase), HEX или ELF (записываются по своим адресам).
+
+Для DfuSe перед записью стираются затронутые страницы, после записи устройство запускает программу с начала прошивки.
+Без DfuSe прошивка передаётся устройству непрерывным образом, адрес записи определяет само устройство.
+Прогресс стирания и записи отправляется в logger, после завершения прошивки logger закрывается.
+*/
+func (board *DFU) Flash(ctx context.Context, filePath string, logger chan any) (string, error) {
+	if logger != nil {
+		defer close(logger)
+	}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return err.Error(), err
+	}
+	image, err := loadFirmwareImage(data, detectFirmwareFormat(data), board.flashBase)
+	if err != nil {
+		return err.Error(), err
+	}
+	if len(image.Segments) == 0 {
+		err = errors.New("файл прошивки не содержит данных")
+		return err.Error(), err
+	}
+	loader, err := board.open()
+	if err != nil {
+		return err.Error(), err
+	}
+	defer loader.close()
+	if loader.dfuse {
+		err = loader.writeDfuSe(ctx, image, logger)
+	} else {
+		var binary []byte
+		binary, err = image.Binary(board.flashBase, board.maxImageSize)
+		if err == nil {
+			err = loader.writeDFU(ctx, binary, logger)
+		}
+	}
+	if err != nil {
+		return err.Error(), err
+	}
+	err = loader.leave(ctx, image.Segments[0].Address)
+	if err != nil {
+		err = fmt.Errorf("не удалось завершить прошивку: %w", err)
+		return err.Error(), err
+	}
+	return fmt.Sprintf("записано %d байт блоками по %d байт", image.Size(), loader.info.transferSize), nil
+}
+
+func (board *DFU) FlashPlan(filePath string) []string {
+	plan := []string{"открытие интерфейса DFU " + board.location + fmt.Sprintf(" (альтернативная настройка %d)", board.payload.Alt)}
+	if data, err := os.ReadFile(filePath); err == nil {
+		if image, err := loadFirmwareImage(data, detectFirmwareFormat(data), board.flashBase); err == nil {
+			plan = append(plan, "стирание страниц flash-памяти, затронутых прошивкой (для DfuSe)")
+			for _, segment := range image.Segments {
+				plan = append(plan, fmt.Sprintf("запись %d байт по адресу 0x%08x (DFU_DNLOAD)", len(segment.Data), segment.Address))
+			}
+		}
+	}
+	return append(plan, "завершение прошивки и запуск программы (манифестация)")
+}
+
+// данные обновляются при каждом поиске
+func (board *DFU) Update() bool {
+	return false
+}
+
+func (board *DFU) GetWebMessageType() string {
+	return DeviceMsg
+}
+
+func (board *DFU) GetWebMessage(name string, deviceID string) any {
+	return DeviceMessage{
+		ID:           deviceID,
+		Name:         name,
+		LastFirmware: deviceHistory.Last(deviceID),
+	}
+}
+
+// проверка того, что интерфейс DFU открывается и устройство переходит в состояние dfuIDLE
+func (board *DFU) Ping(ctx context.Context) error {
+	loader, err := board.open()
+	if err != nil {
+		return err
+	}
+	return loader.close()
+}
+
+func (board *DFU) Reset(ctx context.Context) error {
+	return errors.New("устройство в режиме DFU не поддерживает перезагрузку без прошивки")
+}
+
+func (board *DFU) GetMetaData(ctx context.Context) (any, error) {
+	loader, err := board.open()
+	if err != nil {
+		return nil, err
+	}
+	defer loader.close()
+	return DFUMetaData{
+		DFUVersion:   fmt.Sprintf("%x.%02x", loader.info.version>>8, loader.info.version&0xFF),
+		DfuSe:        loader.dfuse,
+		TransferSize: loader.info.transferSize,
+		Memory:       loader.info.name,
+	}, nil
+}
+
+func (board *DFU) Supports(op DeviceOperation) bool {
+	return op != ResetOperation
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// запросы класса DFU (USB DFU 1.1, раздел 3)
+const (
+	DFU_DETACH    = 0x00
+	DFU_DNLOAD    = 0x01
+	DFU_UPLOAD    = 0x02
+	DFU_GETSTATUS = 0x03
+	DFU_CLRSTATUS = 0x04
+	DFU_GETSTATE  = 0x05
+	DFU_ABORT     = 0x06
+)
+
+// состояния устройства DFU (bState в ответе на DFU_GETSTATUS)
+const (
+	DFU_STATE_APP_IDLE                = 0
+	DFU_STATE_APP_DETACH              = 1
+	DFU_STATE_DFU_IDLE                = 2
+	DFU_STATE_DFU_DNLOAD_SYNC         = 3
+	DFU_STATE_DFU_DNBUSY              = 4
+	DFU_STATE_DFU_DNLOAD_IDLE         = 5
+	DFU_STATE_DFU_MANIFEST_SYNC       = 6
+	DFU_STATE_DFU_MANIFEST            = 7
+	DFU_STATE_DFU_MANIFEST_WAIT_RESET = 8
+	DFU_STATE_DFU_UPLOAD_IDLE         = 9
+	DFU_STATE_DFU_ERROR               = 10
+)
+
+// команды DfuSe, передаются через DFU_DNLOAD с номером блока 0 (AN3156)
+const (
+	DFUSE_SET_ADDRESS = 0x21
+	DFUSE_ERASE       = 0x41
+)
+
+// класс и подкласс интерфейса DFU, протокол интерфейса устройства в режиме DFU (а не в режиме приложения)
+const (
+	DFU_INTERFACE_CLASS    = 0xFE
+	DFU_INTERFACE_SUBCLASS = 0x01
+	DFU_PROTOCOL_DFU_MODE  = 0x02
+)
+
+// тип функционального дескриптора DFU
+const DFU_FUNCTIONAL_DESCRIPTOR = 0x21
+
+// версия DFU в функциональном дескрипторе устройств с расширениями DfuSe
+const dfuSeVersion = 0x011A
+
+// размер блока, если его не удалось прочитать из функционального дескриптора
+const dfuDefaultTransferSize = 1024
+
+// максимальное время ожидания выхода устройства из занятого состояния (стирание страницы, запись блока)
+const dfuBusyTimeout = 10 * time.Second
+
+/*
+Передача control-запросов класса DFU интерфейсу устройства.
+
+Реализуется через libusb (см. dfuUSB_linux.go), отделена от протокола, чтобы его можно было проверить без устройства.
+*/
+type dfuTransport interface {
+	// запрос от хоста к устройству, value - wValue запроса (например, номер блока)
+	controlOut(request uint8, value uint16, data []byte) error
+	// запрос от устройства к хосту, возвращает не больше length байт
+	controlIn(request uint8, value uint16, length int) ([]byte, error)
+	close() error
+}
+
+// данные интерфейса DFU, прочитанные из дескрипторов устройства
+type dfuInterfaceInfo struct {
+	// максимальный размер данных в одном DFU_DNLOAD (wTransferSize)
+	transferSize int
+	// версия DFU (bcdDFUVersion), 0x011A для DfuSe
+	version uint16
+	// возможности устройства (bmAttributes)
+	attributes byte
+	// строковый дескриптор альтернативной настройки, у DfuSe - раскладка памяти
+	name string
+}
+
+// ответ на DFU_GETSTATUS
+type dfuStatus struct {
+	status      byte
+	pollTimeout time.Duration
+	state       byte
+}
+
+// описания кодов bStatus (USB DFU 1.1, раздел 6.1.2)
+var dfuStatusDescriptions = []string{
+	"OK",
+	"файл не предназначен для этого устройства",
+	"файл не прошёл проверку устройства",
+	"устройство не может записать память",
+	"ошибка стирания памяти",
+	"ошибка проверки стирания памяти",
+	"ошибка записи памяти",
+	"ошибка проверки записи памяти",
+	"адрес вне допустимого диапазона",
+	"получено меньше данных, чем ожидалось",
+	"прошивка повреждена или не может быть запущена",
+	"ошибка производителя устройства",
+	"устройство неожиданно переподключилось",
+	"устройство неожиданно перезагрузилось",
+	"неизвестная ошибка",
+	"устройство получило неожиданный запрос",
+}
+
+var errDFUAppMode = errors.New("устройство работает в режиме приложения, переведите его в режим DFU (например, удерживая BOOT0 при перезагрузке)")
+
+func dfuStatusError(status byte) error {
+	description := "неизвестный код"
+	if int(status) < len(dfuStatusDescriptions) {
+		description = dfuStatusDescriptions[status]
+	}
+	return fmt.Errorf("устройство DFU сообщило об ошибке 0x%02x: %s", status, description)
+}
+
+/*
+Чтение функционального дескриптора DFU из дескриптора конфигурации config.
+
+Используется дескриптор, следующий за любой альтернативной настройкой интерфейса DFU number
+(у DfuSe он один для всех альтернативных настроек).
+Возвращает false, если дескриптор не найден.
+*/
+func parseDFUFunctionalDescriptor(config []byte, number int) (dfuInterfaceInfo, bool) {
+	info := dfuInterfaceInfo{transferSize: dfuDefaultTransferSize}
+	found := false
+	inDFUInterface := false
+	for offset := 0; offset+2 <= len(config); {
+		length := int(config[offset])
+		if length < 2 || offset+length > len(config) {
+			break
+		}
+		descriptor := config[offset : offset+length]
+		switch descriptor[1] {
+		// дескриптор интерфейса
+		case 0x04:
+			inDFUInterface = length >= 7 && int(descriptor[2]) == number &&
+				descriptor[5] == DFU_INTERFACE_CLASS && descriptor[6] == DFU_INTERFACE_SUBCLASS
+		case DFU_FUNCTIONAL_DESCRIPTOR:
+			if inDFUInterface && length >= 7 && !found {
+				info.attributes = descriptor[2]
+				if size := binary.LittleEndian.Uint16(descriptor[5:]); size > 0 {
+					info.transferSize = int(size)
+				}
+				if length >= 9 {
+					info.version = binary.LittleEndian.Uint16(descriptor[7:])
+				}
+				found = true
+			}
+		}
+		offset += length
+	}
+	return info, found
+}
+
+// участок памяти DfuSe с одинаковыми страницами
+type dfuSeSector struct {
+	address uint32
+	size    uint32
+	// стирается ли участок (атрибуты b, c, f и g)
+	erasable bool
+}
+
+/*
+Разбор раскладки памяти DfuSe из строкового дескриптора альтернативной настройки,
+например: "@Internal Flash  /0x08000000/04*016Kg,01*064Kg,07*128Kg".
+
+Каждая группа задаёт количество страниц, их размер (с множителем K или M) и атрибуты (a-g, бит 1 - стирание).
+Возвращает ошибку, если строка не является раскладкой памяти.
+*/
+func parseDfuSeLayout(name string) ([]dfuSeSector, error) {
+	if !strings.HasPrefix(name, "@") {
+		return nil, errors.New("строка не является раскладкой памяти DfuSe")
+	}
+	parts := strings.Split(name, "/")
+	if len(parts) < 3 {
+		return nil, fmt.Errorf("некорректная раскладка памяти DfuSe: %s", name)
+	}
+	var sectors []dfuSeSector
+	// после названия идут пары "адрес/страницы"
+	for i := 1; i+1 < len(parts); i += 2 {
+		address, err := strconv.ParseUint(strings.TrimSpace(parts[i]), 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("некорректный адрес в раскладке памяти DfuSe: %s", parts[i])
+		}
+		for _, group := range strings.Split(parts[i+1], ",") {
+			group = strings.TrimSpace(group)
+			countStr, sizeStr, found := strings.Cut(group, "*")
+			if !found || len(sizeStr) < 2 {
+				return nil, fmt.Errorf("некорректная группа страниц в раскладке памяти DfuSe: %s", group)
+			}
+			count, err := strconv.Atoi(countStr)
+			if err != nil {
+				return nil, fmt.Errorf("некорректное количество страниц в раскладке памяти DfuSe: %s", group)
+			}
+			attribute := sizeStr[len(sizeStr)-1]
+			sizeStr = sizeStr[:len(sizeStr)-1]
+			multiplier := uint64(1)
+			switch sizeStr[len(sizeStr)-1] {
+			case 'K':
+				multiplier = 1024
+				sizeStr = sizeStr[:len(sizeStr)-1]
+			case 'M':
+				multiplier = 1024 * 1024
+				sizeStr = sizeStr[:len(sizeStr)-1]
+			case ' ', 'B':
+				sizeStr = sizeStr[:len(sizeStr)-1]
+			}
+			size, err := strconv.ParseUint(strings.TrimSpace(sizeStr), 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("некорректный размер страницы в раскладке памяти DfuSe: %s", group)
+			}
+			erasable := attribute >= 'a' && attribute <= 'g' && (attribute-'a'+1)&0x02 != 0
+			for j := 0; j < count; j++ {
+				sectors = append(sectors, dfuSeSector{
+					address:  uint32(address),
+					size:     uint32(size * multiplier),
+					erasable: erasable,
+				})
+				address += size * multiplier
+			}
+		}
+	}
+	return sectors, nil
+}
+
+// соединение с устройством в режиме DFU
+type dfuLoader struct {
+	transport dfuTransport
+	info      dfuInterfaceInfo
+	// true, если используются расширения DfuSe
+	dfuse bool
+	// раскладка памяти DfuSe, nil, если она неизвестна (тогда перед записью стирается вся память)
+	layout []dfuSeSector
+}
+
+func newDFULoader(transport dfuTransport, info dfuInterfaceInfo, dfuse bool) *dfuLoader {
+	loader := &dfuLoader{transport: transport, info: info, dfuse: dfuse}
+	if dfuse {
+		layout, err := parseDfuSeLayout(info.name)
+		if err != nil {
+			printLog("dfu: can't parse memory layout:", err.Error())
+		} else {
+			loader.layout = layout
+		}
+	}
+	return loader
+}
+
+func (loader *dfuLoader) getStatus() (dfuStatus, error) {
+	data, err := loader.transport.controlIn(DFU_GETSTATUS, 0, 6)
+	if err != nil {
+		return dfuStatus{}, err
+	}
+	if len(data) < 6 {
+		return dfuStatus{}, fmt.Errorf("некорректный ответ на DFU_GETSTATUS: %d байт", len(data))
+	}
+	poll := uint32(data[1]) | uint32(data[2])<<8 | uint32(data[3])<<16
+	return dfuStatus{
+		status:      data[0],
+		pollTimeout: time.Duration(poll) * time.Millisecond,
+		state:       data[4],
+	}, nil
+}
+
+/*
+Перевод устройства в состояние dfuIDLE: сброс ошибки (DFU_CLRSTATUS) или прерывание незавершённой операции (DFU_ABORT).
+
+Возвращает errDFUAppMode, если устройство находится в режиме приложения.
+*/
+func (loader *dfuLoader) toIdle() error {
+	status, err := loader.getStatus()
+	if err != nil {
+		return err
+	}
+	switch status.state {
+	case DFU_STATE_DFU_IDLE:
+		return nil
+	case DFU_STATE_APP_IDLE, DFU_STATE_APP_DETACH:
+		return errDFUAppMode
+	case DFU_STATE_DFU_ERROR:
+		err = loader.transport.controlOut(DFU_CLRSTATUS, 0, nil)
+	default:
+		err = loader.transport.controlOut(DFU_ABORT, 0, nil)
+	}
+	if err != nil {
+		return err
+	}
+	status, err = loader.getStatus()
+	if err != nil {
+		return err
+	}
+	if status.state != DFU_STATE_DFU_IDLE {
+		return fmt.Errorf("не удалось перевести устройство DFU в состояние dfuIDLE (состояние %d)", status.state)
+	}
+	return nil
+}
+
+/*
+Ожидание завершения операции после DFU_DNLOAD: DFU_GETSTATUS запрашивается с промежутком bwPollTimeout,
+пока устройство занято.
+*/
+func (loader *dfuLoader) waitReady(ctx context.Context) (dfuStatus, error) {
+	deadline := time.Now().Add(dfuBusyTimeout)
+	for {
+		status, err := loader.getStatus()
+		if err != nil {
+			return status, err
+		}
+		if status.status != 0 {
+			loader.transport.controlOut(DFU_CLRSTATUS, 0, nil)
+			return status, dfuStatusError(status.status)
+		}
+		if status.state != DFU_STATE_DFU_DNBUSY && status.state != DFU_STATE_DFU_DNLOAD_SYNC {
+			return status, nil
+		}
+		if time.Now().After(deadline) {
+			return status, errors.New("устройство DFU не завершило операцию за отведённое время")
+		}
+		select {
+		case <-ctx.Done():
+			return status, ctx.Err()
+		case <-time.After(status.pollTimeout):
+		}
+	}
+}
+
+// отправка блока данных (DFU_DNLOAD) и ожидание его обработки
+func (loader *dfuLoader) download(ctx context.Context, block uint16, data []byte) error {
+	err := loader.transport.controlOut(DFU_DNLOAD, block, data)
+	if err != nil {
+		return err
+	}
+	status, err := loader.waitReady(ctx)
+	if err != nil {
+		return err
+	}
+	if status.state != DFU_STATE_DFU_DNLOAD_IDLE {
+		return fmt.Errorf("неожиданное состояние устройства DFU после записи блока: %d", status.state)
+	}
+	return nil
+}
+
+// установка адреса, с которого DfuSe записывает следующие блоки
+func (loader *dfuLoader) setAddress(ctx context.Context, address uint32) error {
+	command := []byte{DFUSE_SET_ADDRESS, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(command[1:], address)
+	err := loader.download(ctx, 0, command)
+	if err != nil {
+		return fmt.Errorf("не удалось установить адрес 0x%08x: %w", address, err)
+	}
+	return nil
+}
+
+func (loader *dfuLoader) erasePage(ctx context.Context, address uint32) error {
+	command := []byte{DFUSE_ERASE, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(command[1:], address)
+	err := loader.download(ctx, 0, command)
+	if err != nil {
+		return fmt.Errorf("не удалось стереть страницу по адресу 0x%08x: %w", address, err)
+	}
+	return nil
+}
+
+func (loader *dfuLoader) massErase(ctx context.Context) error {
+	err := loader.download(ctx, 0, []byte{DFUSE_ERASE})
+	if err != nil {
+		return fmt.Errorf("не удалось стереть память: %w", err)
+	}
+	return nil
+}
+
+// страницы из раскладки памяти, которые затрагивает образ прошивки
+func (loader *dfuLoader) pagesToErase(image *FirmwareImage) ([]dfuSeSector, error) {
+	var pages []dfuSeSector
+	for _, sector := range loader.layout {
+		for _, segment := range image.Segments {
+			if segment.Address < sector.address+sector.size && sector.address < segment.End() {
+				if !sector.erasable {
+					return nil, fmt.Errorf("прошивка затрагивает нестираемую область памяти по адресу 0x%08x", sector.address)
+				}
+				pages = append(pages, sector)
+				break
+			}
+		}
+	}
+	for _, segment := range image.Segments {
+		if !loader.covers(segment) {
+			return nil, fmt.Errorf("участок прошивки 0x%08x-0x%08x выходит за пределы памяти устройства", segment.Address, segment.End())
+		}
+	}
+	return pages, nil
+}
+
+// true, если участок полностью находится в раскладке памяти
+func (loader *dfuLoader) covers(segment MemorySegment) bool {
+	address := segment.Address
+	for _, sector := range loader.layout {
+		if address >= sector.address && address < sector.address+sector.size {
+			address = sector.address + sector.size
+		}
+		if address >= segment.End() {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Запись образа прошивки через DfuSe: стирание затронутых страниц (или всей памяти, если раскладка неизвестна),
+затем запись блоков по wTransferSize байт, перед каждым блоком устанавливается его адрес.
+*/
+func (loader *dfuLoader) writeDfuSe(ctx context.Context, image *FirmwareImage, logger chan any) error {
+	if loader.layout == nil {
+		reporter := newProgressReporter(logger, ERASING_STAGE)
+		err := loader.massErase(ctx)
+		if err != nil {
+			return err
+		}
+		reporter.report(1, 1)
+	} else {
+		pages, err := loader.pagesToErase(image)
+		if err != nil {
+			return err
+		}
+		reporter := newProgressReporter(logger, ERASING_STAGE)
+		for i, page := range pages {
+			err = loader.erasePage(ctx, page.address)
+			if err != nil {
+				return err
+			}
+			reporter.report(i+1, len(pages))
+		}
+	}
+	reporter := newProgressReporter(logger, WRITING_STAGE)
+	written := 0
+	for _, segment := range image.Segments {
+		for offset := 0; offset < len(segment.Data); offset += loader.info.transferSize {
+			end := min(offset+loader.info.transferSize, len(segment.Data))
+			err := loader.setAddress(ctx, segment.Address+uint32(offset))
+			if err != nil {
+				return err
+			}
+			// блоки с номером 2 и больше записываются по адресу: установленный адрес + (номер - 2) * wTransferSize
+			err = loader.download(ctx, 2, segment.Data[offset:end])
+			if err != nil {
+				return fmt.Errorf("не удалось записать блок по адресу 0x%08x: %w", segment.Address+uint32(offset), err)
+			}
+			written += end - offset
+			reporter.report(written, image.Size())
+		}
+	}
+	return nil
+}
+
+// запись непрерывного образа прошивки по стандарту DFU 1.1, номера блоков идут по порядку с нуля
+func (loader *dfuLoader) writeDFU(ctx context.Context, data []byte, logger chan any) error {
+	reporter := newProgressReporter(logger, WRITING_STAGE)
+	var block uint16
+	for offset := 0; offset < len(data); offset += loader.info.transferSize {
+		end := min(offset+loader.info.transferSize, len(data))
+		err := loader.download(ctx, block, data[offset:end])
+		if err != nil {
+			return fmt.Errorf("не удалось записать блок %d: %w", block, err)
+		}
+		block++
+		reporter.report(end, len(data))
+	}
+	return nil
+}
+
+/*
+Завершение записи: пустой DFU_DNLOAD переводит устройство в фазу манифестации, после которой запускается прошивка.
+
+В DfuSe перед этим устанавливается адрес, с которого запускается программа.
+Устройство может перезагрузиться сразу после манифестации, поэтому ошибки чтения состояния игнорируются.
+*/
+func (loader *dfuLoader) leave(ctx context.Context, start uint32) error {
+	if loader.dfuse {
+		err := loader.setAddress(ctx, start)
+		if err != nil {
+			return err
+		}
+	}
+	// DfuSe ожидает пустой блок с номером 2, блок 0 воспринимается как команда
+	var block uint16
+	if loader.dfuse {
+		block = 2
+	}
+	err := loader.transport.controlOut(DFU_DNLOAD, block, nil)
+	if err != nil {
+		return err
+	}
+	status, err := loader.getStatus()
+	if err != nil {
+		printLog("dfu: device left after manifestation:", err.Error())
+		return nil
+	}
+	if status.status != 0 {
+		return dfuStatusError(status.status)
+	}
+	return nil
+}
+
+func (loader *dfuLoader) close() error {
+	return loader.transport.close()
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// запрос к устройству DFU, записанный mockDFUTransport
+type dfuRequest struct {
+	request uint8
+	value   uint16
+	data    []byte
+}
+
+/*
+Устройство DFU для тестов: записывает блоки в memory, с DfuSe также выполняет команды установки адреса и стирания.
+
+После каждого DFU_DNLOAD первый DFU_GETSTATUS сообщает, что устройство занято (dfuDNBUSY).
+*/
+type mockDFUTransport struct {
+	transferSize int
+	dfuse        bool
+	state        byte
+	// bStatus, который вернёт следующий DFU_GETSTATUS (для проверки ошибок)
+	failStatus byte
+	busy       bool
+	address    uint32
+	memory     map[uint32]byte
+	erased     []uint32
+	massErased bool
+	requests   []dfuRequest
+	closed     bool
+}
+
+func newMockDFUTransport(transferSize int, dfuse bool) *mockDFUTransport {
+	return &mockDFUTransport{
+		transferSize: transferSize,
+		dfuse:        dfuse,
+		state:        DFU_STATE_DFU_IDLE,
+		memory:       make(map[uint32]byte),
+	}
+}
+
+func (mock *mockDFUTransport) controlOut(request uint8, value uint16, data []byte) error {
+	mock.requests = append(mock.requests, dfuRequest{request, value, bytes.Clone(data)})
+	switch request {
+	case DFU_CLRSTATUS, DFU_ABORT:
+		mock.state = DFU_STATE_DFU_IDLE
+		return nil
+	case DFU_DNLOAD:
+	default:
+		return fmt.Errorf("неожиданный запрос 0x%02x", request)
+	}
+	if len(data) == 0 {
+		mock.state = DFU_STATE_DFU_MANIFEST
+		return nil
+	}
+	mock.busy = true
+	mock.state = DFU_STATE_DFU_DNLOAD_SYNC
+	if len(data) > mock.transferSize {
+		return fmt.Errorf("блок %d байт больше wTransferSize", len(data))
+	}
+	if !mock.dfuse {
+		for i, b := range data {
+			mock.memory[uint32(value)*uint32(mock.transferSize)+uint32(i)] = b
+		}
+		return nil
+	}
+	if value >= 2 {
+		base := mock.address + uint32(value-2)*uint32(mock.transferSize)
+		for i, b := range data {
+			mock.memory[base+uint32(i)] = b
+		}
+		return nil
+	}
+	if value != 0 {
+		return fmt.Errorf("блок с номером 1 не используется в DfuSe")
+	}
+	switch {
+	case data[0] == DFUSE_SET_ADDRESS && len(data) == 5:
+		mock.address = binary.LittleEndian.Uint32(data[1:])
+	case data[0] == DFUSE_ERASE && len(data) == 5:
+		mock.erased = append(mock.erased, binary.LittleEndian.Uint32(data[1:]))
+	case data[0] == DFUSE_ERASE && len(data) == 1:
+		mock.massErased = true
+	default:
+		return fmt.Errorf("неизвестная команда DfuSe % x", data)
+	}
+	return nil
+}
+
+func (mock *mockDFUTransport) controlIn(request uint8, value uint16, length int) ([]byte, error) {
+	if request != DFU_GETSTATUS {
+		return nil, fmt.Errorf("неожиданный запрос 0x%02x", request)
+	}
+	mock.requests = append(mock.requests, dfuRequest{request: request, value: value})
+	status := mock.failStatus
+	state := mock.state
+	if status != 0 {
+		mock.failStatus = 0
+		mock.state = DFU_STATE_DFU_ERROR
+		state = DFU_STATE_DFU_ERROR
+	} else if mock.busy {
+		mock.busy = false
+		state = DFU_STATE_DFU_DNBUSY
+		mock.state = DFU_STATE_DFU_DNLOAD_IDLE
+	}
+	return []byte{status, 0, 0, 0, state, 0}[:min(length, 6)], nil
+}
+
+func (mock *mockDFUTransport) close() error {
+	mock.closed = true
+	return nil
+}
+
+// команды DfuSe (блок 0) в порядке отправки в виде "set 0x..." и "erase 0x..."
+func (mock *mockDFUTransport) commands() []string {
+	var commands []string
+	for _, request := range mock.requests {
+		if request.request != DFU_DNLOAD {
+			continue
+		}
+		switch {
+		case len(request.data) == 0:
+			commands = append(commands, fmt.Sprintf("leave %d", request.value))
+		case request.value >= 2:
+			commands = append(commands, fmt.Sprintf("write %d", len(request.data)))
+		case request.data[0] == DFUSE_SET_ADDRESS:
+			commands = append(commands, fmt.Sprintf("set 0x%08x", binary.LittleEndian.Uint32(request.data[1:])))
+		case len(request.data) == 1:
+			commands = append(commands, "mass erase")
+		default:
+			commands = append(commands, fmt.Sprintf("erase 0x%08x", binary.LittleEndian.Uint32(request.data[1:])))
+		}
+	}
+	return commands
+}
+
+// раскладка внутренней flash-памяти STM32F4
+const stm32f4Layout = "@Internal Flash  /0x08000000/04*016Kg,01*064Kg,07*128Kg"
+
+func TestParseDfuSeLayout(t *testing.T) {
+	tests := []struct {
+		name    string
+		layout  string
+		sectors []dfuSeSector
+		wantErr bool
+	}{
+		{
+			name:   "страницы разного размера",
+			layout: "@Internal Flash  /0x08000000/02*016Kg,01*064Kg",
+			sectors: []dfuSeSector{
+				{address: 0x08000000, size: 16 * 1024, erasable: true},
+				{address: 0x08004000, size: 16 * 1024, erasable: true},
+				{address: 0x08008000, size: 64 * 1024, erasable: true},
+			},
+		},
+		{
+			name:   "несколько областей, нестираемая область",
+			layout: "@Option Bytes  /0x1FFFC000/01*016 e/0x1FFEC000/01*016 a",
+			sectors: []dfuSeSector{
+				{address: 0x1FFFC000, size: 16, erasable: false},
+				{address: 0x1FFEC000, size: 16, erasable: false},
+			},
+		},
+		{
+			name:   "страницы в мегабайтах, атрибут только стирания",
+			layout: "@Flash/0x90000000/2*001Mb",
+			sectors: []dfuSeSector{
+				{address: 0x90000000, size: 1024 * 1024, erasable: true},
+				{address: 0x90100000, size: 1024 * 1024, erasable: true},
+			},
+		},
+		{name: "нет @ в начале", layout: "Internal Flash/0x08000000/04*016Kg", wantErr: true},
+		{name: "нет групп страниц", layout: "@Internal Flash/0x08000000", wantErr: true},
+		{name: "некорректный адрес", layout: "@Flash/address/04*016Kg", wantErr: true},
+		{name: "нет размера страницы", layout: "@Flash/0x08000000/04", wantErr: true},
+		{name: "некорректное количество", layout: "@Flash/0x08000000/x*016Kg", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sectors, err := parseDfuSeLayout(test.layout)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("ожидалась ошибка, получено %v", sectors)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(sectors) != fmt.Sprint(test.sectors) {
+				t.Fatalf("получено %v, ожидалось %v", sectors, test.sectors)
+			}
+		})
+	}
+	sectors, err := parseDfuSeLayout(stm32f4Layout)
+	if err != nil || len(sectors) != 12 || sectors[11].address != 0x080E0000 || sectors[11].size != 128*1024 {
+		t.Fatalf("раскладка STM32F4 разобрана неправильно: %v, %v", sectors, err)
+	}
+}
+
+func TestDfuSeWrite(t *testing.T) {
+	tests := []struct {
+		name         string
+		layout       string
+		transferSize int
+		segments     []MemorySegment
+		// команды DfuSe в порядке отправки
+		commands []string
+		wantErr  bool
+	}{
+		{
+			name:         "стирание затронутых страниц и запись блоками",
+			layout:       stm32f4Layout,
+			transferSize: 2048,
+			segments: []MemorySegment{
+				{Address: 0x08000000, Data: bytes.Repeat([]byte{0x11}, 3000)},
+				{Address: 0x08010000, Data: []byte{1, 2, 3, 4}},
+			},
+			commands: []string{
+				"erase 0x08000000",
+				"erase 0x08010000",
+				"set 0x08000000", "write 2048",
+				"set 0x08000800", "write 952",
+				"set 0x08010000", "write 4",
+				"set 0x08000000", "leave 2",
+			},
+		},
+		{
+			name:         "участок на границе страниц",
+			layout:       stm32f4Layout,
+			transferSize: 1024,
+			segments:     []MemorySegment{{Address: 0x08003F00, Data: bytes.Repeat([]byte{0x22}, 512)}},
+			commands: []string{
+				"erase 0x08000000",
+				"erase 0x08004000",
+				"set 0x08003f00", "write 512",
+				"set 0x08003f00", "leave 2",
+			},
+		},
+		{
+			name:         "раскладка неизвестна - стирание всей памяти",
+			layout:       "",
+			transferSize: 1024,
+			segments:     []MemorySegment{{Address: 0x08000000, Data: []byte{5, 6}}},
+			commands: []string{
+				"mass erase",
+				"set 0x08000000", "write 2",
+				"set 0x08000000", "leave 2",
+			},
+		},
+		{
+			name:         "прошивка за пределами памяти",
+			layout:       "@Internal Flash  /0x08000000/02*016Kg",
+			transferSize: 1024,
+			segments:     []MemorySegment{{Address: 0x08007F00, Data: bytes.Repeat([]byte{0x33}, 512)}},
+			wantErr:      true,
+		},
+		{
+			name:         "прошивка затрагивает нестираемую область",
+			layout:       "@Option Bytes  /0x1FFFC000/01*016 e",
+			transferSize: 1024,
+			segments:     []MemorySegment{{Address: 0x1FFFC000, Data: []byte{0xAA}}},
+			wantErr:      true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock := newMockDFUTransport(test.transferSize, true)
+			info := dfuInterfaceInfo{transferSize: test.transferSize, version: dfuSeVersion, name: test.layout}
+			loader := newDFULoader(mock, info, true)
+			image := &FirmwareImage{Segments: test.segments}
+			ctx := context.Background()
+			err := loader.toIdle()
+			if err == nil {
+				err = loader.writeDfuSe(ctx, image, nil)
+			}
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("ожидалась ошибка")
+				}
+				if len(mock.commands()) != 0 {
+					t.Fatalf("при ошибке отправлены команды: %v", mock.commands())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = loader.leave(ctx, image.Segments[0].Address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(mock.commands()) != fmt.Sprint(test.commands) {
+				t.Fatalf("команды:\n%v\nожидалось:\n%v", mock.commands(), test.commands)
+			}
+			for _, segment := range image.Segments {
+				for i, want := range segment.Data {
+					address := segment.Address + uint32(i)
+					if got, written := mock.memory[address]; !written || got != want {
+						t.Fatalf("по адресу 0x%08x записано 0x%02x, ожидалось 0x%02x", address, got, want)
+					}
+				}
+			}
+			if len(mock.memory) != image.Size() {
+				t.Fatalf("записано %d байт, ожидалось %d", len(mock.memory), image.Size())
+			}
+			loader.close()
+			if !mock.closed {
+				t.Fatal("соединение не закрыто")
+			}
+		})
+	}
+}
+
+func TestDFUWriteWithoutDfuSe(t *testing.T) {
+	mock := newMockDFUTransport(64, false)
+	loader := newDFULoader(mock, dfuInterfaceInfo{transferSize: 64, version: 0x0110}, false)
+	data := make([]byte, 150)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	ctx := context.Background()
+	if err := loader.writeDFU(ctx, data, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := loader.leave(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	var blocks []string
+	for _, request := range mock.requests {
+		if request.request == DFU_DNLOAD {
+			blocks = append(blocks, fmt.Sprintf("%d:%d", request.value, len(request.data)))
+		}
+	}
+	// номера блоков идут с нуля, завершающий пустой блок - с номером 0
+	if want := "[0:64 1:64 2:22 0:0]"; fmt.Sprint(blocks) != want {
+		t.Fatalf("блоки %v, ожидалось %s", blocks, want)
+	}
+	for i, want := range data {
+		if got := mock.memory[uint32(i)]; got != want {
+			t.Fatalf("байт %d: 0x%02x, ожидалось 0x%02x", i, got, want)
+		}
+	}
+}
+
+func TestDFUErrors(t *testing.T) {
+	t.Run("режим приложения", func(t *testing.T) {
+		mock := newMockDFUTransport(64, false)
+		mock.state = DFU_STATE_APP_IDLE
+		err := newDFULoader(mock, dfuInterfaceInfo{transferSize: 64}, false).toIdle()
+		if !errors.Is(err, errDFUAppMode) {
+			t.Fatalf("ожидалась errDFUAppMode, получено %v", err)
+		}
+	})
+	t.Run("сброс ошибки перед прошивкой", func(t *testing.T) {
+		mock := newMockDFUTransport(64, false)
+		mock.state = DFU_STATE_DFU_ERROR
+		if err := newDFULoader(mock, dfuInterfaceInfo{transferSize: 64}, false).toIdle(); err != nil {
+			t.Fatal(err)
+		}
+		if mock.requests[1].request != DFU_CLRSTATUS {
+			t.Fatalf("ожидался DFU_CLRSTATUS, запросы: %v", mock.requests)
+		}
+	})
+	t.Run("ошибка записи блока", func(t *testing.T) {
+		mock := newMockDFUTransport(64, true)
+		loader := newDFULoader(mock, dfuInterfaceInfo{transferSize: 64, version: dfuSeVersion, name: stm32f4Layout}, true)
+		mock.failStatus = 0x03
+		err := loader.erasePage(context.Background(), 0x08000000)
+		if err == nil {
+			t.Fatal("ожидалась ошибка стирания")
+		}
+		if mock.state != DFU_STATE_DFU_IDLE {
+			t.Fatalf("после ошибки не отправлен DFU_CLRSTATUS, состояние %d", mock.state)
+		}
+	})
+}
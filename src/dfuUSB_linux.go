@@ -0,0 +1,155 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/gousb"
+)
+
+// типы control-запросов класса DFU к интерфейсу (bmRequestType)
+const (
+	dfuRequestOut = 0x21
+	dfuRequestIn  = 0xA1
+)
+
+// время ожидания ответа на control-запрос
+const dfuControlTimeout = 5 * time.Second
+
+// конфигурация и альтернативная настройка alt интерфейса DFU в режиме DFU, nil, если у устройства её нет
+func findDFUSetting(desc *gousb.DeviceDesc, alt int) (int, *gousb.InterfaceSetting) {
+	for _, config := range desc.Configs {
+		for _, intf := range config.Interfaces {
+			for i, setting := range intf.AltSettings {
+				if setting.Class == DFU_INTERFACE_CLASS && setting.SubClass == DFU_INTERFACE_SUBCLASS &&
+					setting.Protocol == DFU_PROTOCOL_DFU_MODE && setting.Alternate == alt {
+					return config.Number, &intf.AltSettings[i]
+				}
+			}
+		}
+	}
+	return 0, nil
+}
+
+// поиск USB-устройств в режиме DFU, для которых есть шаблон типа dfu, ID устройства - его расположение на шине
+func detectDFU(templates []BoardTemplate) map[string]*Device {
+	ctx := gousb.NewContext()
+	defer ctx.Close()
+	devs := make(map[string]*Device)
+	_, err := ctx.OpenDevices(func(desc *gousb.DeviceDesc) bool {
+		if _, setting := findDFUSetting(desc, 0); setting == nil {
+			return false
+		}
+		temp := findDFUTemplate(templates, desc.Vendor.String(), desc.Product.String())
+		if temp == nil {
+			return false
+		}
+		location := usbLocation(desc)
+		devs["dfu:"+location] = newDevice(*temp, NewDFU(*temp, location))
+		return false
+	})
+	if err != nil {
+		printLog("dfu: OpenDevices():", err.Error())
+	}
+	return devs
+}
+
+// интерфейс DFU, открытый через libusb
+type dfuUSBTransport struct {
+	ctx    *gousb.Context
+	dev    *gousb.Device
+	config *gousb.Config
+	intf   *gousb.Interface
+	number uint16
+}
+
+/*
+Открытие интерфейса DFU устройства, расположенного на шине в location, с альтернативной настройкой alt.
+
+Драйвер ядра отключается от интерфейса на время работы с ним.
+*/
+func openDFUTransport(location string, alt int) (dfuTransport, dfuInterfaceInfo, error) {
+	var info dfuInterfaceInfo
+	ctx := gousb.NewContext()
+	var configNum int
+	var setting *gousb.InterfaceSetting
+	devs, err := ctx.OpenDevices(func(desc *gousb.DeviceDesc) bool {
+		if usbLocation(desc) != location {
+			return false
+		}
+		configNum, setting = findDFUSetting(desc, alt)
+		return setting != nil
+	})
+	if len(devs) == 0 {
+		ctx.Close()
+		if err != nil {
+			return nil, info, err
+		}
+		return nil, info, fmt.Errorf("устройство DFU %s с альтернативной настройкой %d не найдено", location, alt)
+	}
+	for _, extra := range devs[1:] {
+		extra.Close()
+	}
+	dev := devs[0]
+	transport := &dfuUSBTransport{ctx: ctx, dev: dev, number: uint16(setting.Number)}
+	dev.ControlTimeout = dfuControlTimeout
+	dev.SetAutoDetach(true)
+	// GET_DESCRIPTOR (конфигурация), функциональный дескриптор DFU не разбирается gousb
+	raw := make([]byte, 4096)
+	n, err := dev.Control(0x80, 0x06, 0x0200, 0, raw)
+	if err == nil {
+		var found bool
+		info, found = parseDFUFunctionalDescriptor(raw[:n], setting.Number)
+		if !found {
+			printLog("dfu: functional descriptor not found, default transfer size is used")
+		}
+	} else {
+		printLog("dfu: can't read config descriptor:", err.Error())
+		info.transferSize = dfuDefaultTransferSize
+	}
+	info.name, _ = dev.InterfaceDescription(configNum, setting.Number, setting.Alternate)
+	transport.config, err = dev.Config(configNum)
+	if err == nil {
+		transport.intf, err = transport.config.Interface(setting.Number, setting.Alternate)
+	}
+	if err != nil {
+		transport.close()
+		return nil, info, fmt.Errorf("не удалось открыть интерфейс DFU: %w", err)
+	}
+	return transport, info, nil
+}
+
+func (transport *dfuUSBTransport) controlOut(request uint8, value uint16, data []byte) error {
+	n, err := transport.dev.Control(dfuRequestOut, request, value, transport.number, data)
+	if err != nil {
+		return err
+	}
+	if n != len(data) {
+		return fmt.Errorf("передано %d байт из %d", n, len(data))
+	}
+	return nil
+}
+
+func (transport *dfuUSBTransport) controlIn(request uint8, value uint16, length int) ([]byte, error) {
+	data := make([]byte, length)
+	n, err := transport.dev.Control(dfuRequestIn, request, value, transport.number, data)
+	if err != nil {
+		return nil, err
+	}
+	return data[:n], nil
+}
+
+func (transport *dfuUSBTransport) close() error {
+	if transport.intf != nil {
+		transport.intf.Close()
+	}
+	var errs []error
+	if transport.config != nil {
+		errs = append(errs, transport.config.Close())
+	}
+	errs = append(errs, transport.dev.Close(), transport.ctx.Close())
+	return errors.Join(errs...)
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// libusb используется только на Linux, на остальных ОС устройства DFU не обнаруживаются
+func detectDFU(templates []BoardTemplate) map[string]*Device {
+	return nil
+}
+
+func openDFUTransport(location string, alt int) (dfuTransport, dfuInterfaceInfo, error) {
+	return nil, dfuInterfaceInfo{}, errors.New("прошивка устройств DFU поддерживается только на Linux")
+}
@@ -41,6 +41,24 @@ var (
 	ErrIncorrectFileSize = errors.New("incorrect-file-size")
 	// ошибка при записи блока бин. данных в файл
 	ErrFileWriter = errors.New("file-write-error")
+	// прошивка отменена клиентом (flash-cancel), устройство разблокировано
+	ErrFlashCancelled = errors.New("flash-cancelled")
+	// прошивка прервана, так как превышено время ожидания для этого типа устройств
+	ErrFlashTimeout = errors.New("flash-timeout")
+	// устройство не поддерживает проверку прошивки (verify-start)
+	ErrVerifyNotSupported = errors.New("verify-not-supported")
+	// устройство не поддерживает запись EEPROM (eeprom-write)
+	ErrEEPROMNotSupported = errors.New("eeprom-not-supported")
+	// файл прошивки в формате Intel HEX повреждён (неправильная контрольная сумма, неизвестный тип записи, перекрывающиеся записи и т.д.)
+	ErrInvalidHex = errors.New("flash-invalid-hex")
+	// прошивка не помещается во flash-память устройства или затрагивает область загрузчика
+	ErrFirmwareOutOfRange = errors.New("flash-out-of-range")
+	// не удалось преобразовать файл прошивки в формат, который ожидает устройство
+	ErrFirmwareConversion = errors.New("flash-conversion-error")
+	// устройство не поддерживает резервное копирование прошивки перед прошивкой
+	ErrBackupNotSupported = errors.New("backup-not-supported")
+	// не удалось сохранить текущую прошивку перед прошивкой, устройство не прошивалось
+	ErrBackupFailed = errors.New("flash-backup-failed")
 )
 
 func errorHandler(err error, c *WebSocketConnection) {
@@ -52,7 +70,7 @@ func errorHandler(err error, c *WebSocketConnection) {
 	switch err {
 	case ErrFlashLargeBlock:
 		c.StopFlashingSync()
-	case ErrAvrdude:
+	case ErrAvrdude, ErrFlashTimeout, ErrInvalidHex, ErrFirmwareOutOfRange, ErrFirmwareConversion, ErrBackupFailed:
 		c.StopFlashingSync()
 		payload = c.GetFlasherMessageSync()
 		defer func() {
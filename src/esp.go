@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/albenik/go-serial/v2"
+)
+
+/*
+Устройство на ESP8266 или ESP32, прошивается через загрузчик, записанный в ROM микросхемы (см. espLoader.go).
+
+Порт и серийный номер устройства определяются так же, как у Arduino.
+*/
+type ESP struct {
+	payload ESPPayload
+	// размер flash-памяти
+	flashSize int
+	// используется только для поиска и отслеживания порта устройства
+	port *Arduino
+}
+
+// метаданные устройства ESP
+type ESPMetaData struct {
+	Chip string `json:"chip"`
+}
+
+func init() {
+	registerBoardType(&BoardType{
+		Name:      "esp",
+		Detection: SerialDetection,
+		New: func(temp BoardTemplate, found FoundDevice) Board {
+			return NewESP(temp, found.Ports[0], found.ArduinoOS, found.SerialID)
+		},
+		Refresh: func(old *Device, found *Device) bool {
+			oldPort := old.Board.(*ESP).port
+			newPort := found.Board.(*ESP).port
+			if oldPort.portName == newPort.portName {
+				return false
+			}
+			oldPort.portName = newPort.portName
+			return true
+		},
+		ProgressMsg:          FlashBacktrackMsg,
+		FlashesThroughSerial: true,
+		Timeouts: map[DeviceOperation]int{
+			FlashOperation: 300,
+			PingOperation:  15,
+			ResetOperation: 15,
+			MetaOperation:  15,
+		},
+	})
+}
+
+func NewESP(temp BoardTemplate, portName string, ardOS ArduinoOS, serialID string) *ESP {
+	board := ESP{
+		flashSize: temp.FlashSize,
+		port: &Arduino{
+			bootloaderID: -1,
+			serialID:     serialID,
+			portName:     portName,
+			ardOS:        ardOS,
+		},
+	}
+	if board.flashSize <= 0 {
+		board.flashSize = espDefaultFlashSize
+	}
+	if len(temp.TypePayload) > 0 {
+		err := json.Unmarshal(temp.TypePayload, &board.payload)
+		if err != nil {
+			printLog("Error, wrong esp payload!", temp.Name, err.Error())
+		}
+	}
+	return &board
+}
+
+func (board *ESP) open(ctx context.Context, baud int) (*espLoader, error) {
+	loader, err := openESPLoader(ctx, board.port.portName, board.payload.Reset, baud)
+	if err != nil {
+		return nil, err
+	}
+	if board.payload.Chip != "" && !strings.EqualFold(board.payload.Chip, loader.chip.name) {
+		loader.close()
+		return nil, fmt.Errorf("модель микросхемы %s не совпадает с моделью, указанной в описании устройства (%s)", loader.chip.name, board.payload.Chip)
+	}
+	return loader, nil
+}
+
+func (board *ESP) IsConnected() bool {
+	return board.port.IsConnected()
+}
+
+func (board *ESP) GetSerialPort() string {
+	return board.port.portName
+}
+
+// прогресс записи отправляется в logger, после завершения прошивки logger закрывается
+func (board *ESP) Flash(ctx context.Context, filePath string, logger chan any) (string, error) {
+	if logger != nil {
+		defer close(logger)
+	}
+	image, err := os.ReadFile(filePath)
+	if err != nil {
+		return err.Error(), err
+	}
+	address := board.payload.Address
+	if address+len(image) > board.flashSize {
+		err = fmt.Errorf("прошивка (%d байт по адресу 0x%x) не помещается во flash-память (%d байт)", len(image), address, board.flashSize)
+		return err.Error(), err
+	}
+	loader, err := board.open(ctx, board.payload.Baud)
+	if err != nil {
+		return err.Error(), err
+	}
+	defer loader.close()
+	err = loader.attachFlash(board.flashSize)
+	if err == nil {
+		err = loader.writeFlash(ctx, address, image, newProgressReporter(logger, WRITING_STAGE))
+	}
+	if err != nil {
+		return err.Error(), err
+	}
+	loader.finish()
+	msg := fmt.Sprintf("%s: записано %d байт по адресу 0x%x", loader.chip.name, len(image), address)
+	if loader.canCheckMD5() {
+		msg += ", MD5 совпадает"
+	}
+	return msg, nil
+}
+
+func (board *ESP) FlashPlan(filePath string) []string {
+	plan := []string{"перезагрузка в загрузчик через DTR/RTS"}
+	if board.payload.Baud > 0 && board.payload.Baud != espROMBaud {
+		plan = append(plan, fmt.Sprintf("переключение скорости на %d бод", board.payload.Baud))
+	}
+	size := "файла"
+	if info, err := os.Stat(filePath); err == nil {
+		size = fmt.Sprintf("%d байт", info.Size())
+	}
+	return append(plan,
+		fmt.Sprintf("стирание и запись %s по адресу 0x%x", size, board.payload.Address),
+		"проверка MD5 записанной прошивки",
+		"перезагрузка через RTS",
+	)
+}
+
+func (board *ESP) Update() bool {
+	return board.port.Update()
+}
+
+func (board *ESP) GetWebMessageType() string {
+	return DeviceMsg
+}
+
+func (board *ESP) GetWebMessage(name string, deviceID string) any {
+	return DeviceMessage{
+		ID:           deviceID,
+		Name:         name,
+		Controller:   board.payload.Chip,
+		SerialID:     board.port.serialID,
+		PortName:     board.port.portName,
+		LastFirmware: deviceHistory.Last(deviceID),
+	}
+}
+
+// проверка связи с загрузчиком, после неё устройство перезагружается
+func (board *ESP) Ping(ctx context.Context) error {
+	loader, err := board.open(ctx, 0)
+	if err != nil {
+		return err
+	}
+	return loader.close()
+}
+
+func (board *ESP) Reset(ctx context.Context) error {
+	port, err := serial.Open(board.port.portName, serial.WithBaudrate(espROMBaud))
+	if err != nil {
+		return err
+	}
+	espHardReset(port)
+	return port.Close()
+}
+
+// модель микросхемы, определённая загрузчиком
+func (board *ESP) GetMetaData(ctx context.Context) (any, error) {
+	loader, err := board.open(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer loader.close()
+	return ESPMetaData{Chip: loader.chip.name}, nil
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/albenik/go-serial/v2"
+)
+
+// команды загрузчика ESP8266 и ESP32, записанного в ROM
+const (
+	ESP_FLASH_BEGIN     = 0x02
+	ESP_FLASH_DATA      = 0x03
+	ESP_FLASH_END       = 0x04
+	ESP_SYNC            = 0x08
+	ESP_READ_REG        = 0x0A
+	ESP_SPI_SET_PARAMS  = 0x0B
+	ESP_SPI_ATTACH      = 0x0D
+	ESP_CHANGE_BAUDRATE = 0x0F
+	ESP_SPI_FLASH_MD5   = 0x13
+)
+
+// SLIP: пакеты разделяются байтом SLIP_END, который (как и SLIP_ESC) внутри пакета заменяется двумя байтами
+const (
+	SLIP_END     = 0xC0
+	SLIP_ESC     = 0xDB
+	SLIP_ESC_END = 0xDC
+	SLIP_ESC_ESC = 0xDD
+)
+
+// способы перезагрузки в загрузчик (поле reset в typePayload)
+const (
+	// DTR/RTS подключены к IO0 и EN через транзисторы (большинство плат с USB-UART)
+	ESP_CLASSIC_RESET = "classic"
+	// встроенный USB-JTAG-Serial контроллер (ESP32-S3, ESP32-C3 и т.д.)
+	ESP_USB_JTAG_RESET = "usb-jtag"
+)
+
+// скорость, на которой работает загрузчик после перезагрузки
+const espROMBaud = 115200
+
+// размер блока данных, который загрузчик в ROM принимает за одну команду
+const espFlashBlockSize = 0x400
+
+// начальное значение контрольной суммы блока данных
+const espChecksumSeed = 0xEF
+
+// регистр, по значению которого определяется модель микросхемы
+const espChipDetectMagicReg = 0x40001000
+
+// время ожидания ответа на обычную команду
+const espCommandTimeout = 3 * time.Second
+
+// время ожидания ответа на синхронизацию
+const espSyncTimeout = 100 * time.Millisecond
+
+// время ожидания ответа на FLASH_END, после которого устройство перезагружается и может не ответить
+const espFinishTimeout = 500 * time.Millisecond
+
+// время стирания и вычисления MD5 пропорционально размеру прошивки
+const espEraseTimeoutPerMB = 30 * time.Second
+const espMD5TimeoutPerMB = 8 * time.Second
+
+// количество перезагрузок в загрузчик и попыток синхронизации после каждой из них
+const espResetAttempts = 3
+const espSyncAttempts = 7
+
+// размер flash-памяти по-умолчанию, если он не указан в шаблоне
+const espDefaultFlashSize = 4 * 1024 * 1024
+
+var errESPNoSync = errors.New("загрузчик ESP не отвечает, проверьте, что устройство перезагружается в загрузчик (или зажмите кнопку BOOT)")
+
+// модель микросхемы ESP
+type espChip struct {
+	name string
+	// размер статуса в конце ответа загрузчика
+	statusSize int
+	// true, если перед работой с flash-памятью нужно подключить её командами SPI_ATTACH и SPI_SET_PARAMS
+	spiAttach bool
+	// true, если FLASH_BEGIN принимает пятый параметр (шифрование)
+	encryptedFlag bool
+}
+
+var espChips = map[uint32]espChip{
+	0xFFF0C101: {name: "ESP8266", statusSize: 2},
+	0x00F01D83: {name: "ESP32", statusSize: 4, spiAttach: true},
+	0x000007C6: {name: "ESP32-S2", statusSize: 4, spiAttach: true, encryptedFlag: true},
+	0x00000009: {name: "ESP32-S3", statusSize: 4, spiAttach: true, encryptedFlag: true},
+	0x6921506F: {name: "ESP32-C3", statusSize: 4, spiAttach: true, encryptedFlag: true},
+	0x1B31506F: {name: "ESP32-C3", statusSize: 4, spiAttach: true, encryptedFlag: true},
+	0x4881606F: {name: "ESP32-C3", statusSize: 4, spiAttach: true, encryptedFlag: true},
+	0x4361606F: {name: "ESP32-C3", statusSize: 4, spiAttach: true, encryptedFlag: true},
+	0x6F51306F: {name: "ESP32-C2", statusSize: 4, spiAttach: true, encryptedFlag: true},
+	0x7C41A06F: {name: "ESP32-C2", statusSize: 4, spiAttach: true, encryptedFlag: true},
+	0x2CE0806F: {name: "ESP32-C6", statusSize: 4, spiAttach: true, encryptedFlag: true},
+}
+
+// ошибки, которые возвращает загрузчик в статусе ответа
+var espROMErrors = map[byte]string{
+	0x05: "некорректное сообщение",
+	0x06: "не удалось выполнить команду",
+	0x07: "неверная контрольная сумма",
+	0x08: "ошибка записи во flash-память",
+	0x09: "ошибка чтения flash-памяти",
+	0x0A: "неверная длина при чтении flash-памяти",
+}
+
+// соединение с загрузчиком ESP
+type espLoader struct {
+	port *serial.Port
+	chip espChip
+	// прочитанные, но ещё не обработанные байты
+	buffer  []byte
+	readBuf [256]byte
+}
+
+/*
+Открытие порта, перезагрузка устройства в загрузчик, синхронизация с ним и определение модели микросхемы.
+
+baud - скорость, на которую загрузчик переключается после синхронизации (0 - не переключать).
+*/
+func openESPLoader(ctx context.Context, portName string, reset string, baud int) (*espLoader, error) {
+	port, err := serial.Open(
+		portName,
+		serial.WithBaudrate(espROMBaud),
+		serial.WithReadTimeout(50),
+		serial.WithWriteTimeout(int(espCommandTimeout.Milliseconds())),
+	)
+	if err != nil {
+		return nil, err
+	}
+	// до определения модели статус считается двухбайтовым, у ESP32 за ним идут ещё два нулевых байта
+	loader := &espLoader{port: port, chip: espChip{name: "ESP", statusSize: 2}}
+	err = loader.connect(ctx, reset)
+	if err != nil {
+		port.Close()
+		return nil, err
+	}
+	magic, err := loader.readReg(espChipDetectMagicReg)
+	if err != nil {
+		port.Close()
+		return nil, fmt.Errorf("не удалось определить модель микросхемы: %w", err)
+	}
+	chip, exists := espChips[magic]
+	if !exists {
+		port.Close()
+		return nil, fmt.Errorf("неизвестная модель микросхемы ESP (0x%08x)", magic)
+	}
+	loader.chip = chip
+	printLog("esp: chip", chip.name)
+	if baud > 0 && baud != espROMBaud {
+		err = loader.changeBaud(baud)
+		if err != nil {
+			printLog("esp: can't change baud:", err.Error())
+		}
+	}
+	return loader, nil
+}
+
+// перезагрузка в загрузчик и синхронизация, загрузчик может не ответить с первого раза, поэтому попытки повторяются
+func (loader *espLoader) connect(ctx context.Context, reset string) error {
+	for i := 0; i < espResetAttempts; i++ {
+		loader.resetToBootloader(reset)
+		for j := 0; j < espSyncAttempts; j++ {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			err := loader.sync()
+			if err == nil {
+				// загрузчик отвечает на одну синхронизацию несколькими ответами, лишние ответы отбрасываются
+				time.Sleep(50 * time.Millisecond)
+				loader.flush()
+				return nil
+			}
+			printLog("esp: sync attempt", i+1, j+1, err.Error())
+		}
+	}
+	return errESPNoSync
+}
+
+func (loader *espLoader) sync() error {
+	data := []byte{0x07, 0x07, 0x12, 0x20}
+	for i := 0; i < 32; i++ {
+		data = append(data, 0x55)
+	}
+	_, _, err := loader.command(ESP_SYNC, data, 0, espSyncTimeout)
+	return err
+}
+
+/*
+Перезагрузка в загрузчик: на время снятия сигнала EN (RTS) на IO0 подаётся низкий уровень (DTR).
+
+Ошибки игнорируются, так как не все порты поддерживают управление линиями.
+*/
+func (loader *espLoader) resetToBootloader(reset string) {
+	port := loader.port
+	if reset == ESP_USB_JTAG_RESET {
+		port.SetRTS(false)
+		port.SetDTR(false)
+		time.Sleep(100 * time.Millisecond)
+		port.SetDTR(true)
+		port.SetRTS(false)
+		time.Sleep(100 * time.Millisecond)
+		port.SetRTS(true)
+		port.SetDTR(false)
+		// повторная установка RTS нужна для драйвера usbser.sys в Windows
+		port.SetRTS(true)
+		time.Sleep(100 * time.Millisecond)
+		port.SetDTR(false)
+		port.SetRTS(false)
+	} else {
+		port.SetDTR(false)
+		port.SetRTS(true)
+		time.Sleep(100 * time.Millisecond)
+		port.SetDTR(true)
+		port.SetRTS(false)
+		time.Sleep(50 * time.Millisecond)
+		port.SetDTR(false)
+	}
+	loader.flush()
+}
+
+// перезагрузка устройства через EN (RTS), после которой запускается записанная программа
+func espHardReset(port *serial.Port) {
+	port.SetDTR(false)
+	port.SetRTS(true)
+	time.Sleep(100 * time.Millisecond)
+	port.SetRTS(false)
+}
+
+func (loader *espLoader) flush() {
+	loader.port.ResetInputBuffer()
+	loader.buffer = nil
+}
+
+func (loader *espLoader) changeBaud(baud int) error {
+	if loader.chip.name == "ESP8266" {
+		return errors.New("загрузчик ESP8266 не поддерживает смену скорости")
+	}
+	_, _, err := loader.command(ESP_CHANGE_BAUDRATE, espPack(uint32(baud), 0), 0, espCommandTimeout)
+	if err != nil {
+		return err
+	}
+	err = loader.port.Reconfigure(serial.WithBaudrate(baud))
+	if err != nil {
+		return err
+	}
+	time.Sleep(50 * time.Millisecond)
+	loader.flush()
+	return nil
+}
+
+/*
+Отправка команды и получение ответа.
+
+Команда имеет вид: направление (0), код команды, размер данных (2 байта), контрольная сумма (4 байта), данные;
+ответ: направление (1), код команды, размер данных, значение (4 байта), данные, в конце которых находится статус.
+Все числа передаются в little-endian. Возвращает значение и данные ответа без статуса.
+*/
+func (loader *espLoader) command(op byte, data []byte, checksum uint32, timeout time.Duration) (uint32, []byte, error) {
+	packet := make([]byte, 8, 8+len(data))
+	packet[1] = op
+	binary.LittleEndian.PutUint16(packet[2:], uint16(len(data)))
+	binary.LittleEndian.PutUint32(packet[4:], checksum)
+	packet = append(packet, data...)
+	_, err := loader.port.Write(slipEncode(packet))
+	if err != nil {
+		return 0, nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		frame, err := loader.readFrame(deadline)
+		if err != nil {
+			return 0, nil, err
+		}
+		// ответы на другие команды (например, лишние ответы на синхронизацию) пропускаются
+		if len(frame) < 8 || frame[0] != 1 || frame[1] != op {
+			continue
+		}
+		value := binary.LittleEndian.Uint32(frame[4:])
+		body := frame[8:]
+		statusSize := loader.chip.statusSize
+		if len(body) < statusSize {
+			return 0, nil, fmt.Errorf("слишком короткий ответ на команду 0x%02x", op)
+		}
+		status := body[len(body)-statusSize:]
+		if status[0] != 0 {
+			description, exists := espROMErrors[status[1]]
+			if !exists {
+				description = fmt.Sprintf("код ошибки 0x%02x", status[1])
+			}
+			return 0, nil, fmt.Errorf("загрузчик не смог выполнить команду 0x%02x: %s", op, description)
+		}
+		return value, body[:len(body)-statusSize], nil
+	}
+}
+
+// чтение одного SLIP-пакета, байты до начала пакета (например, вывод загрузчика при запуске) пропускаются
+func (loader *espLoader) readFrame(deadline time.Time) ([]byte, error) {
+	var frame []byte
+	inFrame := false
+	escaped := false
+	for {
+		b, err := loader.readByte(deadline)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case !inFrame:
+			inFrame = b == SLIP_END
+		case escaped:
+			escaped = false
+			switch b {
+			case SLIP_ESC_END:
+				frame = append(frame, SLIP_END)
+			case SLIP_ESC_ESC:
+				frame = append(frame, SLIP_ESC)
+			default:
+				return nil, fmt.Errorf("некорректная SLIP-последовательность 0x%02x 0x%02x", SLIP_ESC, b)
+			}
+		case b == SLIP_ESC:
+			escaped = true
+		case b == SLIP_END:
+			// два SLIP_END подряд: предыдущий был концом другого пакета
+			if len(frame) > 0 {
+				return frame, nil
+			}
+		default:
+			frame = append(frame, b)
+		}
+	}
+}
+
+func (loader *espLoader) readByte(deadline time.Time) (byte, error) {
+	for len(loader.buffer) == 0 {
+		if time.Now().After(deadline) {
+			return 0, errors.New("превышено время ожидания ответа загрузчика")
+		}
+		n, err := loader.port.Read(loader.readBuf[:])
+		if err != nil {
+			return 0, err
+		}
+		loader.buffer = loader.readBuf[:n]
+	}
+	b := loader.buffer[0]
+	loader.buffer = loader.buffer[1:]
+	return b, nil
+}
+
+func slipEncode(packet []byte) []byte {
+	encoded := make([]byte, 0, len(packet)+2)
+	encoded = append(encoded, SLIP_END)
+	for _, b := range packet {
+		switch b {
+		case SLIP_END:
+			encoded = append(encoded, SLIP_ESC, SLIP_ESC_END)
+		case SLIP_ESC:
+			encoded = append(encoded, SLIP_ESC, SLIP_ESC_ESC)
+		default:
+			encoded = append(encoded, b)
+		}
+	}
+	return append(encoded, SLIP_END)
+}
+
+// числа в порядке little-endian, как их принимает загрузчик
+func espPack(values ...uint32) []byte {
+	data := make([]byte, 4*len(values))
+	for i, value := range values {
+		binary.LittleEndian.PutUint32(data[4*i:], value)
+	}
+	return data
+}
+
+func espChecksum(data []byte) uint32 {
+	checksum := byte(espChecksumSeed)
+	for _, b := range data {
+		checksum ^= b
+	}
+	return uint32(checksum)
+}
+
+// время ожидания операции, которая длится perMB на каждый мегабайт, но не меньше espCommandTimeout
+func espTimeoutPerMB(perMB time.Duration, size int) time.Duration {
+	return max(espCommandTimeout, time.Duration(float64(perMB)*float64(size)/1e6))
+}
+
+func (loader *espLoader) readReg(address uint32) (uint32, error) {
+	value, _, err := loader.command(ESP_READ_REG, espPack(address), 0, espCommandTimeout)
+	return value, err
+}
+
+// подключение SPI flash-памяти, без которого загрузчик ESP32 не может с ней работать
+func (loader *espLoader) attachFlash(flashSize int) error {
+	if !loader.chip.spiAttach {
+		return nil
+	}
+	_, _, err := loader.command(ESP_SPI_ATTACH, espPack(0, 0), 0, espCommandTimeout)
+	if err != nil {
+		return err
+	}
+	// ID, размер, размер блока, сектора, страницы и маска регистра состояния
+	params := espPack(0, uint32(flashSize), 64*1024, 4*1024, 256, 0xFFFF)
+	_, _, err = loader.command(ESP_SPI_SET_PARAMS, params, 0, espCommandTimeout)
+	return err
+}
+
+/*
+Размер стираемой области для FLASH_BEGIN.
+
+Загрузчик ESP8266 стирает лишние секторы, поэтому размер вычисляется так же, как в esptool (ESP8266ROM.get_erase_size).
+*/
+func (loader *espLoader) eraseSize(address int, size int) int {
+	if loader.chip.name != "ESP8266" {
+		return size
+	}
+	const sectorsPerBlock = 16
+	const sectorSize = 4096
+	sectors := (size + sectorSize - 1) / sectorSize
+	startSector := address / sectorSize
+	headSectors := sectorsPerBlock - startSector%sectorsPerBlock
+	if sectors < headSectors {
+		headSectors = sectors
+	}
+	if sectors < 2*headSectors {
+		return (sectors + 1) / 2 * sectorSize
+	}
+	return (sectors - headSectors) * sectorSize
+}
+
+/*
+Запись образа image по адресу address: стирание области (FLASH_BEGIN), запись блоками (FLASH_DATA) и проверка MD5,
+если загрузчик её поддерживает (см. canCheckMD5).
+
+Прогресс записи отправляется в reporter.
+*/
+func (loader *espLoader) writeFlash(ctx context.Context, address int, image []byte, reporter *progressReporter) error {
+	blocks := (len(image) + espFlashBlockSize - 1) / espFlashBlockSize
+	params := espPack(uint32(loader.eraseSize(address, len(image))), uint32(blocks), espFlashBlockSize, uint32(address))
+	if loader.chip.encryptedFlag {
+		params = append(params, espPack(0)...)
+	}
+	_, _, err := loader.command(ESP_FLASH_BEGIN, params, 0, espTimeoutPerMB(espEraseTimeoutPerMB, len(image)))
+	if err != nil {
+		return fmt.Errorf("не удалось стереть flash-память: %w", err)
+	}
+	for seq := 0; seq < blocks; seq++ {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		block := make([]byte, espFlashBlockSize)
+		n := copy(block, image[seq*espFlashBlockSize:])
+		// неполный последний блок дополняется значением стёртой памяти
+		for i := n; i < len(block); i++ {
+			block[i] = 0xFF
+		}
+		data := append(espPack(uint32(len(block)), uint32(seq), 0, 0), block...)
+		_, _, err = loader.command(ESP_FLASH_DATA, data, espChecksum(block), espCommandTimeout)
+		if err != nil {
+			return fmt.Errorf("не удалось записать блок %d из %d: %w", seq+1, blocks, err)
+		}
+		reporter.report(seq+1, blocks)
+	}
+	if !loader.canCheckMD5() {
+		printLog("esp: MD5 check is not supported by", loader.chip.name, "ROM loader, skipped")
+		return nil
+	}
+	return loader.checkMD5(address, image)
+}
+
+// загрузчик ESP8266 в ROM не поддерживает ESP_SPI_FLASH_MD5, поэтому записанная прошивка у него не проверяется (как в esptool)
+func (loader *espLoader) canCheckMD5() bool {
+	return loader.chip.name != "ESP8266"
+}
+
+// сравнение MD5 записанной области с MD5 образа
+func (loader *espLoader) checkMD5(address int, image []byte) error {
+	_, body, err := loader.command(ESP_SPI_FLASH_MD5, espPack(uint32(address), uint32(len(image)), 0, 0), 0, espTimeoutPerMB(espMD5TimeoutPerMB, len(image)))
+	if err != nil {
+		return fmt.Errorf("не удалось вычислить MD5 записанной прошивки: %w", err)
+	}
+	var flashMD5 string
+	switch len(body) {
+	// загрузчик в ROM возвращает MD5 в виде 32 шестнадцатеричных символов
+	case 32:
+		flashMD5 = strings.ToLower(string(body))
+	case md5.Size:
+		flashMD5 = hex.EncodeToString(body)
+	default:
+		return fmt.Errorf("некорректный ответ на вычисление MD5 (%d байт)", len(body))
+	}
+	imageMD5 := md5.Sum(image)
+	if flashMD5 != hex.EncodeToString(imageMD5[:]) {
+		return fmt.Errorf("MD5 записанной прошивки (%s) не совпадает с MD5 файла (%s)", flashMD5, hex.EncodeToString(imageMD5[:]))
+	}
+	return nil
+}
+
+// завершение записи с выходом из загрузчика, ответ может не прийти, так как устройство сразу перезагружается
+func (loader *espLoader) finish() {
+	_, _, err := loader.command(ESP_FLASH_END, espPack(0), 0, espFinishTimeout)
+	if err != nil {
+		printLog("esp: flash end:", err.Error())
+	}
+}
+
+// перезагрузка в записанную программу и закрытие порта
+func (loader *espLoader) close() error {
+	espHardReset(loader.port)
+	return loader.port.Close()
+}
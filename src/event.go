@@ -2,10 +2,14 @@
 package main
 
 import (
+	"context"
 	b64 "encoding/base64"
 	"encoding/json"
+	"errors"
 	"log"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/polyus-nt/ms1-go/pkg/ms1"
 )
@@ -29,12 +33,16 @@ type DeviceMessage struct {
 	Programmer string `json:"programmer,omitempty"`
 	PortName   string `json:"portName,omitempty"`
 	SerialID   string `json:"serialID,omitempty"`
+	// последняя успешная прошивка устройства (см. history.go)
+	LastFirmware *FirmwareRecord `json:"lastFirmware,omitempty"`
 }
 
 type MSDeviceMessage struct {
 	ID        string    `json:"deviceID"`
 	Name      string    `json:"name,omitempty"`
 	PortNames [4]string `json:"portNames,omitempty"`
+	// последняя успешная прошивка устройства (см. history.go)
+	LastFirmware *FirmwareRecord `json:"lastFirmware,omitempty"`
 }
 
 type BlgMbDeviceMessage struct {
@@ -42,6 +50,8 @@ type BlgMbDeviceMessage struct {
 	Name     string `json:"name,omitempty"`
 	SerialID string `json:"serialID,omitempty"`
 	Version  string `json:"version,omitempty"`
+	// последняя успешная прошивка устройства (см. history.go)
+	LastFirmware *FirmwareRecord `json:"lastFirmware,omitempty"`
 }
 
 // минимальная информация об устройстве
@@ -54,6 +64,9 @@ type SimpleDeviceMessage struct {
 type FlashStartMessage struct {
 	ID       string `json:"deviceID"`
 	FileSize int    `json:"fileSize"` // размер прошивки
+	DryRun   bool   `json:"dryRun"`   // если true, то вместо прошивки клиенту отправляются команды, которые были бы выполнены
+	FileName string `json:"fileName"` // имя файла прошивки, сохраняется в истории прошивок устройства
+	Backup   bool   `json:"backup"`   // если true, то перед прошивкой сохраняется текущая прошивка, которая восстанавливается при ошибке
 }
 
 // тип данных для ms-bin-start (для МС-ТЮК)
@@ -62,6 +75,88 @@ type MSBinStartMessage struct {
 	FileSize     int    `json:"fileSize"`     // размер прошивки
 	Address      string `json:"address"`      // киберген
 	Verification bool   `json:"verification"` // если true, то загрузчик потратит дополнительное время на проверку прошивки
+	DryRun       bool   `json:"dryRun"`       // если true, то вместо прошивки клиенту отправляются операции, которые были бы выполнены
+	FileName     string `json:"fileName"`     // имя файла прошивки, сохраняется в истории прошивок устройства
+	Backup       bool   `json:"backup"`       // если true, то перед прошивкой сохраняется текущая прошивка, которая восстанавливается при ошибке
+}
+
+// результат автоматического восстановления прошивки после неудачной прошивки
+type FlashRollbackMessage struct {
+	ID         string `json:"deviceID"`
+	FlasherMsg string `json:"flasherMsg"` // сообщение прошивающей программы о неудачной прошивке
+	Backup     string `json:"backup"`     // имя резервной копии
+	Code       int    `json:"code"`
+	Comment    string `json:"comment"`
+}
+
+// тип данных для restore-backup
+type RestoreBackupMessage struct {
+	ID   string `json:"deviceID"`
+	Name string `json:"name"` // имя резервной копии
+}
+
+// результат get-backups
+type BackupsMessage struct {
+	ID      string   `json:"deviceID"`
+	Backups []Backup `json:"backups"`
+}
+
+// результат get-device-history
+type DeviceHistoryMessage struct {
+	ID      string           `json:"deviceID"`
+	History []FirmwareRecord `json:"history"`
+}
+
+// результат flash-start или ms-bin-start с dryRun = true
+type FlashDryRunMessage struct {
+	ID       string   `json:"deviceID"`
+	Commands []string `json:"commands"`
+}
+
+// тип данных для verify-start
+type VerifyStartMessage struct {
+	ID       string `json:"deviceID"`
+	FileSize int    `json:"fileSize"` // размер файла прошивки
+	Address  string `json:"address"`  // киберген, только для МС-ТЮК
+}
+
+// результат проверки прошивки (verify-result)
+type VerifyResultMessage struct {
+	ID         string `json:"deviceID"`
+	Match      bool   `json:"match"`      // true, если прошивка устройства совпадает с файлом
+	Address    int    `json:"address"`    // адрес первого несовпадающего байта, -1, если прошивки совпадают
+	FlasherMsg string `json:"flasherMsg"` // сообщение от прошивающей программы
+}
+
+// результат чтения fuse-битов (fuses)
+type FusesMessage struct {
+	ID      string            `json:"deviceID"`
+	Code    int               `json:"code"`
+	Comment string            `json:"comment"`
+	Fuses   map[string]string `json:"fuses,omitempty"` // значения в шестнадцатеричном виде (lfuse, hfuse, efuse, lock)
+}
+
+// тип данных для inspect-firmware
+type InspectFirmwareMessage struct {
+	ID         string `json:"deviceID"`
+	TemplateID *int   `json:"templateID"` // используется, если deviceID не указан
+	FileSize   int    `json:"fileSize"`
+	Hash       string `json:"hash"` // SHA-256 ранее загруженного файла, если указан, то файл не загружается
+}
+
+// результат inspect-firmware
+type FirmwareInfoMessage struct {
+	ID         string `json:"deviceID,omitempty"`
+	TemplateID *int   `json:"templateID,omitempty"`
+	Code       int    `json:"code"`
+	Comment    string `json:"comment"`
+	*FirmwareInfo
+}
+
+// тип данных для write-fuses
+type WriteFusesMessage struct {
+	ID    string            `json:"deviceID"`
+	Fuses map[string]string `json:"fuses"` // записываются только указанные fuse-биты
 }
 
 type DeviceUpdateDeleteMessage struct {
@@ -148,6 +243,14 @@ type FlashBacktrackMsMessage struct {
 	TotalPacks uint16 `json:"TotalPacks"`
 }
 
+// прогресс прошивки устройств, отличных от МС-ТЮК
+type FlashBacktrackMessage struct {
+	Stage   string  `json:"stage"`   // этап прошивки (reading, writing, verifying)
+	Percent int     `json:"percent"` // прогресс текущего этапа (0-100)
+	Elapsed float64 `json:"elapsed"` // время с начала этапа (в секундах)
+	Eta     float64 `json:"eta"`     // оценка оставшегося времени этапа (в секундах)
+}
+
 type MSAddressAndMetaMessage struct {
 	ID        string         `json:"deviceID"`
 	Address   string         `json:"address"`
@@ -209,12 +312,32 @@ const (
 	FlashStartMsg = "flash-start"
 	// прошивка прошла успешна
 	FlashDoneMsg = "flash-done"
+	// команды, которые были бы выполнены при прошивке (dry-run)
+	FlashDryRunMsg = "flash-dry-run"
+	// запрос на проверку прошивки устройства (сравнение с файлом без перезаписи)
+	VerifyStartMsg = "verify-start"
+	// результат проверки прошивки
+	VerifyResultMsg = "verify-result"
+	// запрос на запись файла в EEPROM устройства, файл загружается так же, как и для flash-start
+	EEPROMWriteMsg = "eeprom-write"
+	// запись EEPROM прошла успешно
+	EEPROMWriteDoneMsg = "eeprom-write-done"
+	// запрос на чтение EEPROM устройства
+	EEPROMReadMsg = "eeprom-read"
+	// одобрение запроса на чтение EEPROM
+	EEPROMReadApproveMsg = "eeprom-read-approve"
+	// отчёт о завершении чтения EEPROM
+	EEPROMReadFinishMsg = "eeprom-read-finish"
 	// запрос на следующий блок бинарных данных
 	FlashNextBlockMsg = "flash-next-block"
 	// сообщение, для отметки бинарных данных загружаемого файла прошивки, прикрепляется сервером к сообщению после получения данных бинарного типа
 	FlashBinaryBlockMsg = "flash-block"
+	// отмена текущей прошивки или выгрузки прошивки
+	FlashCancelMsg = "flash-cancel"
 	// обратная связь от программы загрузки прошивки МС-ТЮК
 	FlashBackTrackMs = "flash-backtrack-ms"
+	// прогресс прошивки остальных устройств (этап и процент выполнения)
+	FlashBacktrackMsg = "flash-backtrack"
 	// устройство удалено из списка
 	DeviceUpdateDeleteMsg = "device-update-delete"
 	// устройство поменяло порт
@@ -297,6 +420,32 @@ const (
 	resetMsg = "reset"
 	// результат операции reset
 	resetResultMsg = "reset-result"
+	// чтение fuse-битов и lock-битов
+	readFusesMsg = "read-fuses"
+	// значения fuse-битов или ошибка их чтения
+	fusesMsg = "fuses"
+	// запись fuse-битов и lock-битов
+	writeFusesMsg = "write-fuses"
+	// результат операции write-fuses
+	writeFusesResultMsg = "write-fuses-result"
+	// проверка прошивки для устройства или шаблона без прошивки
+	inspectFirmwareMsg = "inspect-firmware"
+	// результат проверки прошивки
+	firmwareInfoMsg = "firmware-info"
+	// результат восстановления прошивки из резервной копии после неудачной прошивки
+	flashRollbackMsg = "flash-rollback"
+	// запрос списка резервных копий прошивок устройства
+	getBackupsMsg = "get-backups"
+	// список резервных копий прошивок устройства
+	backupsMsg = "backups"
+	// восстановление прошивки устройства из резервной копии
+	restoreBackupMsg = "restore-backup"
+	// результат restore-backup
+	restoreBackupResultMsg = "restore-backup-result"
+	// запрос истории прошивок устройства
+	getDeviceHistoryMsg = "get-device-history"
+	// история прошивок устройства
+	deviceHistoryMsg = "device-history"
 	// сигнал клиенту перед началом передачи бинарных данных
 	prepareForBinary = "ready-for-binary"
 )
@@ -351,7 +500,11 @@ func FlashStart(event Event, c *WebSocketConnection) error {
 	var fileSize int
 	var address string    // адрес, только для МС-ТЮК
 	var verification bool // верификация, только для МС-ТЮК
-	if event.Type == FlashStartMsg {
+	var dryRun bool
+	var backup bool
+	var fileName string
+	switch event.Type {
+	case FlashStartMsg, EEPROMWriteMsg:
 		var msg FlashStartMessage
 		err := json.Unmarshal(event.Payload, &msg)
 		if err != nil {
@@ -359,7 +512,19 @@ func FlashStart(event Event, c *WebSocketConnection) error {
 		}
 		deviceID = msg.ID
 		fileSize = msg.FileSize
-	} else {
+		dryRun = msg.DryRun && event.Type == FlashStartMsg
+		backup = msg.Backup && event.Type == FlashStartMsg
+		fileName = msg.FileName
+	case VerifyStartMsg:
+		var msg VerifyStartMessage
+		err := json.Unmarshal(event.Payload, &msg)
+		if err != nil {
+			return ErrUnmarshal
+		}
+		deviceID = msg.ID
+		fileSize = msg.FileSize
+		address = msg.Address
+	default:
 		var msg MSBinStartMessage
 		err := json.Unmarshal(event.Payload, &msg)
 		if err != nil {
@@ -369,6 +534,9 @@ func FlashStart(event Event, c *WebSocketConnection) error {
 		fileSize = msg.FileSize
 		address = msg.Address
 		verification = msg.Verification
+		dryRun = msg.DryRun
+		backup = msg.Backup
+		fileName = msg.FileName
 	}
 	if fileSize < 1 {
 		return ErrIncorrectFileSize
@@ -412,19 +580,28 @@ func FlashStart(event Event, c *WebSocketConnection) error {
 				return nil
 			}
 		}
-		switch dev.Board.(type) {
-		case *Arduino:
-			if dev.SerialMonitor.isOpen() {
-				return ErrFlashOpenSerialMonitor
+		switch event.Type {
+		case VerifyStartMsg:
+			if _, canVerify := dev.Board.(Verifier); !canVerify {
+				return ErrVerifyNotSupported
 			}
-		case *MS1:
-			if event.Type == MSBinStartMsg {
-				if address != "" {
-					dev.Board.(*MS1).address = address
-				}
-				dev.Board.(*MS1).verify = verification
+		case EEPROMWriteMsg:
+			if _, hasEEPROM := dev.Board.(EEPROMAccessor); !hasEEPROM {
+				return ErrEEPROMNotSupported
 			}
 		}
+		if _, canBackup := dev.Board.(Snapshotter); backup && !canBackup {
+			return ErrBackupNotSupported
+		}
+		if dev.flashesThroughSerial() && dev.SerialMonitor.isOpen() {
+			return ErrFlashOpenSerialMonitor
+		}
+		if board, isAddressable := dev.Board.(Addressable); isAddressable && address != "" {
+			board.SetAddress(address)
+		}
+		if board, canVerify := dev.Board.(FlashVerificationSetter); canVerify && event.Type == MSBinStartMsg {
+			board.SetFlashVerification(verification)
+		}
 		// блокировка устройства и клиента для прошивки, необходимо разблокировать после завершения прошивки
 		// это sync функция, но она блокирует клиент, а не устройство
 		c.SetFlashingBoard(dev, deviceID)
@@ -436,6 +613,8 @@ func FlashStart(event Event, c *WebSocketConnection) error {
 	if err != nil {
 		return err
 	}
+	ctx := c.StartOperationSync()
+	defer c.StopOperationSync()
 	FileWriter := newFlashFileWriter()
 	FileWriter.Start(fileSize, dev.TypeDesc.FlashFileExtension)
 	defer func() {
@@ -453,46 +632,242 @@ func FlashStart(event Event, c *WebSocketConnection) error {
 		}
 		c.SetFlashingBoard(nil, "")
 	}()
-	FlashNextBlock(c)
-	for {
-		binData, isOpen := <-c.binDataChan
-		if !isOpen {
-			//TODO
-			break
+	fileCreated, err := receiveFile(ctx, FileWriter, c)
+	if err != nil {
+		return err
+	}
+	if !fileCreated {
+		//TODO
+		return nil
+	}
+	uploadedHash, err := fileHash(FileWriter.GetFilePath())
+	if err != nil {
+		return ErrFileWriter
+	}
+	// EEPROM не преобразуется и не проверяется, так как адреса в её файлах не относятся к flash-памяти
+	if event.Type != EEPROMWriteMsg {
+		conversionMsg, err := convertFirmwareFile(dev.TypeDesc, FileWriter.GetFilePath())
+		if err != nil {
+			c.SetFlasherMessageSync(conversionMsg)
+			return err
 		}
-		fileCreated, err := FileWriter.AddBlock(binData)
+		validationMsg, err := validateFirmwareFile(dev.TypeDesc, FileWriter.GetFilePath())
 		if err != nil {
-			return ErrFileWriter
+			c.SetFlasherMessageSync(validationMsg)
+			return err
+		}
+	}
+	switch event.Type {
+	case VerifyStartMsg:
+		return verifyFlashFile(ctx, dev, deviceID, FileWriter.GetFilePath(), c)
+	case EEPROMWriteMsg:
+		return writeEEPROMFile(ctx, dev, FileWriter.GetFilePath(), c)
+	}
+	if dryRun {
+		return sendFlashPlan(dev, deviceID, FileWriter.GetFilePath(), backup, c)
+	}
+	// хэш исходного файла, так как файл мог быть преобразован
+	record := FirmwareRecord{
+		Hash:     uploadedHash,
+		Size:     fileSize,
+		FileName: fileName,
+		Client:   c.wsc.RemoteAddr().String(),
+		Address:  address,
+	}
+	var snapshot *Backup
+	if backup {
+		snapshot, err = makeBackup(ctx, dev, deviceID)
+		if err != nil {
+			if ctx.Err() != nil {
+				printLog("flash-start: backup is cancelled")
+				return ErrFlashCancelled
+			}
+			c.SetFlasherMessageSync("Не удалось сохранить текущую прошивку, устройство не прошивалось. " + err.Error())
+			return ErrBackupFailed
 		}
-		if fileCreated {
-			logger := make(chan any)
-			go LogSend(c, logger)
-			flasherMsg, err := dev.Board.Flash(FileWriter.GetFilePath(), logger)
-			c.flasherMsg = flasherMsg
+	}
+	logger := make(chan any)
+	go LogSend(c, logger)
+	flashCtx, cancel := dev.operationContext(ctx, FlashOperation)
+	flasherMsg, err := dev.Board.Flash(flashCtx, FileWriter.GetFilePath(), logger)
+	cancel()
+	if err != nil && snapshot != nil {
+		rollback(dev, deviceID, *snapshot, flasherMsg, c)
+	}
+	if err != nil && ctx.Err() != nil {
+		printLog("flash-start: flashing is cancelled", flasherMsg)
+		return ErrFlashCancelled
+	}
+	c.flasherMsg = flasherMsg
+	if err != nil {
+		if isTimeout(flashCtx) {
+			return ErrFlashTimeout
+		}
+		return ErrAvrdude
+	}
+	record.Time = time.Now()
+	deviceHistory.Add(deviceID, record)
+	err = c.sendOutgoingEventMessage(FlashDoneMsg, c.GetFlasherMessageSync(), false)
+	c.SetFlasherMessageSync("")
+	return err
+}
+
+// отправка клиенту команд, которые были бы выполнены при прошивке (dry-run), устройство не прошивается
+func sendFlashPlan(dev *Device, deviceID string, filePath string, backup bool, c *WebSocketConnection) error {
+	var commands []string
+	if backup {
+		commands = append(commands, "сохранение текущей прошивки в резервную копию")
+	}
+	if planner, canPlan := dev.Board.(FlashPlanner); canPlan {
+		commands = append(commands, planner.FlashPlan(filePath)...)
+	} else {
+		commands = append(commands, "прошивка устройства (команды для этого типа устройства неизвестны)")
+	}
+	printLog("flash-start: dry run", commands)
+	return c.sendOutgoingEventMessage(FlashDryRunMsg, FlashDryRunMessage{deviceID, commands}, false)
+}
+
+// сохранение текущей прошивки устройства в резервную копию перед прошивкой
+func makeBackup(ctx context.Context, dev *Device, deviceID string) (*Backup, error) {
+	snapshotCtx, cancel := dev.operationContext(ctx, ExtractOperation)
+	defer cancel()
+	data, err := dev.Board.(Snapshotter).Snapshot(snapshotCtx)
+	if err != nil {
+		if isTimeout(snapshotCtx) {
+			return nil, errors.New("превышено время ожидания выгрузки прошивки")
+		}
+		return nil, err
+	}
+	var address string
+	if board, isAddressable := dev.Board.(Addressable); isAddressable {
+		address = board.GetAddress()
+	}
+	backup, err := backupStore.Save(deviceID, address, data)
+	if err != nil {
+		return nil, err
+	}
+	printLog("flash-start: backup is saved", backup.Name)
+	return &backup, nil
+}
+
+/*
+Восстановление прошивки из резервной копии после неудачной прошивки, результат отправляется через flash-rollback.
+
+Восстановление выполняется, даже если прошивка была отменена клиентом, так как на устройстве может остаться повреждённая прошивка.
+*/
+func rollback(dev *Device, deviceID string, backup Backup, flasherMsg string, c *WebSocketConnection) {
+	const (
+		ROLLBACK_OK  = 0
+		ROLLBACK_ERR = 1
+		TIMEOUT      = 2
+	)
+	result := FlashRollbackMessage{
+		ID:         deviceID,
+		FlasherMsg: flasherMsg,
+		Backup:     backup.Name,
+	}
+	rollbackCtx, cancel := dev.operationContext(context.Background(), FlashOperation)
+	defer cancel()
+	rollbackMsg, err := dev.Board.Flash(rollbackCtx, backupStore.Path(backup), nil)
+	result.Comment = rollbackMsg
+	switch {
+	case err == nil:
+		result.Code = ROLLBACK_OK
+	case isTimeout(rollbackCtx):
+		result.Code = TIMEOUT
+	default:
+		result.Code = ROLLBACK_ERR
+	}
+	printLog("flash-start: rollback", backup.Name, result.Code, rollbackMsg)
+	c.sendOutgoingEventMessage(flashRollbackMsg, result, false)
+}
+
+/*
+Приём файла от клиента по блокам (flash-next-block, flash-block).
+
+Возвращает true, когда все блоки получены и записаны в файл,
+false и nil, если канал с данными закрыт, ErrFlashCancelled, если загрузка отменена клиентом.
+*/
+func receiveFile(ctx context.Context, fileWriter *FlashFileWriter, c *WebSocketConnection) (bool, error) {
+	for {
+		FlashNextBlock(c)
+		select {
+		case <-ctx.Done():
+			// полученные данные удаляются вместе с fileWriter
+			printLog("uploading is cancelled")
+			return false, ErrFlashCancelled
+		case data, isOpen := <-c.binDataChan:
+			if !isOpen {
+				return false, nil
+			}
+			fileCreated, err := fileWriter.AddBlock(data)
 			if err != nil {
-				return ErrAvrdude
+				return false, ErrFileWriter
+			}
+			if fileCreated {
+				return true, nil
 			}
-			err = c.sendOutgoingEventMessage(FlashDoneMsg, c.GetFlasherMessageSync(), false)
-			c.SetFlasherMessageSync("")
-			return err
-		} else {
-			FlashNextBlock(c)
 		}
 	}
-	return nil
+}
+
+// сравнение загруженного файла с прошивкой устройства, результат отправляется клиенту через verify-result
+func verifyFlashFile(ctx context.Context, dev *Device, deviceID string, filePath string, c *WebSocketConnection) error {
+	logger := make(chan any)
+	go LogSend(c, logger)
+	verifyCtx, cancel := dev.operationContext(ctx, VerifyOperation)
+	result, err := dev.Board.(Verifier).Verify(verifyCtx, filePath, logger)
+	cancel()
+	if err != nil && ctx.Err() != nil {
+		printLog("verify-start: verification is cancelled", result.Message)
+		return ErrFlashCancelled
+	}
+	if err != nil {
+		c.SetFlasherMessageSync(result.Message)
+		if isTimeout(verifyCtx) {
+			return ErrFlashTimeout
+		}
+		return ErrAvrdude
+	}
+	return c.sendOutgoingEventMessage(VerifyResultMsg, VerifyResultMessage{
+		ID:         deviceID,
+		Match:      result.Match,
+		Address:    result.Address,
+		FlasherMsg: result.Message,
+	}, false)
+}
+
+// запись загруженного файла в EEPROM устройства, при успехе клиенту отправляется eeprom-write-done
+func writeEEPROMFile(ctx context.Context, dev *Device, filePath string, c *WebSocketConnection) error {
+	writeCtx, cancel := dev.operationContext(ctx, FlashOperation)
+	flasherMsg, err := dev.Board.(EEPROMAccessor).WriteEEPROM(writeCtx, filePath)
+	cancel()
+	if err != nil && ctx.Err() != nil {
+		printLog("eeprom-write: writing is cancelled", flasherMsg)
+		return ErrFlashCancelled
+	}
+	if err != nil {
+		c.SetFlasherMessageSync(flasherMsg)
+		if isTimeout(writeCtx) {
+			return ErrFlashTimeout
+		}
+		return ErrAvrdude
+	}
+	return c.sendOutgoingEventMessage(EEPROMWriteDoneMsg, flasherMsg, false)
 }
 
 func LogSend(client *WebSocketConnection, logger chan any) {
 	if client.FlashingBoard == nil || logger == nil {
 		return
 	}
-	switch client.FlashingBoard.Board.(type) {
-	case *MS1:
-		for log := range logger {
-			client.sendOutgoingEventMessage(FlashBackTrackMs, log, false)
-		}
-		printLog("firmware logging is over")
+	progressMsg := client.FlashingBoard.TypeDesc.BoardType().ProgressMsg
+	if progressMsg == "" {
+		return
+	}
+	for log := range logger {
+		client.sendOutgoingEventMessage(progressMsg, log, false)
 	}
+	printLog("firmware logging is over")
 }
 
 // принятие блока с бинарными данными файла
@@ -501,7 +876,25 @@ func FlashBinaryBlock(event Event, c *WebSocketConnection) error {
 	if !c.IsBinChanBusySync() {
 		return ErrFlashNotStarted
 	}
-	c.binDataChan <- event.Payload
+	ctx := c.GetOperationCtxSync()
+	if ctx == nil {
+		return ErrFlashNotStarted
+	}
+	select {
+	case c.binDataChan <- event.Payload:
+	case <-ctx.Done():
+		// прошивка отменена, оставшиеся блоки игнорируются
+	}
+	return nil
+}
+
+// отмена текущей прошивки или выгрузки прошивки,
+// результат отмены отправляется обработчиком самой операции
+func FlashCancel(event Event, c *WebSocketConnection) error {
+	printLog("flash-cancel")
+	if !c.CancelOperationSync() {
+		return ErrFlashNotStarted
+	}
 	return nil
 }
 
@@ -513,7 +906,7 @@ func FlashNextBlock(c *WebSocketConnection) {
 func newDeviceUpdatePortMessage(dev *Device, deviceID string) *DeviceUpdatePortMessage {
 	boardMessage := DeviceUpdatePortMessage{
 		deviceID,
-		dev.Board.(*Arduino).portName,
+		dev.Board.GetSerialPort(),
 	}
 	return &boardMessage
 }
@@ -574,7 +967,7 @@ func SerialConnect(event Event, c *WebSocketConnection) error {
 			return nil
 		}
 	}
-	if _, isArduino := dev.Board.(*Arduino); isArduino && dev.IsFlashBlocked() {
+	if dev.flashesThroughSerial() && dev.IsFlashBlocked() {
 		SerialConnectionStatus(DeviceCommentCodeMessage{
 			ID:   msg.ID,
 			Code: 5,
@@ -791,8 +1184,14 @@ func MSPing(event Event, c *WebSocketConnection) error {
 		}
 	}
 	board.address = msg.Address
-	err = board.Ping()
+	ctx, cancel := dev.operationContext(context.Background(), PingOperation)
+	defer cancel()
+	err = board.Ping(ctx)
 	if err != nil {
+		if isTimeout(ctx) {
+			MSPingResult(msg.ID, 5, err.Error(), c)
+			return err
+		}
 		MSPingResult(msg.ID, 2, err.Error(), c)
 		return err
 	}
@@ -831,8 +1230,14 @@ func MSGetAddress(event Event, c *WebSocketConnection) error {
 			return nil
 		}
 	}
-	address, err := board.getAddress()
+	ctx, cancel := dev.operationContext(context.Background(), MetaOperation)
+	defer cancel()
+	address, err := board.getAddress(ctx)
 	if err != nil {
+		if isTimeout(ctx) {
+			MSAddressSend(msg.ID, 5, err.Error(), c)
+			return err
+		}
 		MSAddressSend(msg.ID, 2, err.Error(), c)
 		return err
 	}
@@ -888,8 +1293,14 @@ func MSReset(event Event, c *WebSocketConnection) error {
 		}
 	}
 	board.address = msg.Address
-	err = board.Reset()
+	ctx, cancel := dev.operationContext(context.Background(), ResetOperation)
+	defer cancel()
+	err = board.Reset(ctx)
 	if err != nil {
+		if isTimeout(ctx) {
+			MSResetSend(msg.ID, 5, err.Error(), c)
+			return err
+		}
 		MSResetSend(msg.ID, 2, err.Error(), c)
 		return err
 	}
@@ -910,6 +1321,7 @@ const (
 	META_NO_DEVICE    = 2
 	META_WRONG_DEVICE = 3
 	META_JSON_ERROR   = 4
+	META_TIMEOUT      = 5
 )
 
 func MSGetMetaData(event Event, c *WebSocketConnection) error {
@@ -944,8 +1356,14 @@ func MSGetMetaData(event Event, c *WebSocketConnection) error {
 		}
 	}
 	board.address = msg.Address
-	value, err := board.GetMetaData()
+	ctx, cancel := dev.operationContext(context.Background(), MetaOperation)
+	defer cancel()
+	value, err := board.GetMetaData(ctx)
 	if err != nil {
+		if isTimeout(ctx) {
+			MetaDataError(msg.ID, META_TIMEOUT, err.Error(), c)
+			return err
+		}
 		MetaDataError(msg.ID, META_ERROR, err.Error(), c)
 		return err
 	}
@@ -975,6 +1393,10 @@ func GetMetaData(event Event, c *WebSocketConnection) error {
 		MetaDataError(msg.ID, META_NO_DEVICE, "", c)
 		return nil
 	}
+	if !supportsOperation(dev.Board, MetaOperation) {
+		MetaDataError(msg.ID, META_WRONG_DEVICE, "", c)
+		return nil
+	}
 	dev.Mu.Lock()
 	defer dev.Mu.Unlock()
 	board := dev.Board
@@ -989,8 +1411,14 @@ func GetMetaData(event Event, c *WebSocketConnection) error {
 			return nil
 		}
 	}
-	value, err := board.GetMetaData()
+	ctx, cancel := dev.operationContext(context.Background(), MetaOperation)
+	defer cancel()
+	value, err := board.GetMetaData(ctx)
 	if err != nil {
+		if isTimeout(ctx) {
+			MetaDataError(msg.ID, META_TIMEOUT, err.Error(), c)
+			return err
+		}
 		MetaDataError(msg.ID, META_ERROR, err.Error(), c)
 		return err
 	}
@@ -1017,6 +1445,7 @@ func MSGetAddressAndMeta(event Event, c *WebSocketConnection) error {
 		NO_META   = 2
 		NO_DEV    = 3
 		WRONG_DEV = 4
+		TIMEOUT   = 5
 	)
 	var msg MSGetAddressMessage
 	err := json.Unmarshal(event.Payload, &msg)
@@ -1073,9 +1502,20 @@ func MSGetAddressAndMeta(event Event, c *WebSocketConnection) error {
 			}, c)
 		}
 	}
-	addr, meta, err := board.getAddressAndMeta()
+	ctx, cancel := dev.operationContext(context.Background(), MetaOperation)
+	defer cancel()
+	addr, meta, err := board.getAddressAndMeta(ctx)
 	if err != nil {
-		if addr == "" {
+		if isTimeout(ctx) {
+			MSAddressAndMeta(MSAddressAndMetaMessage{
+				ID:        msg.ID,
+				ErrorMsg:  err.Error(),
+				ErrorCode: TIMEOUT,
+				MSType:    "",
+				Address:   addr,
+				Meta:      MetaSubMessage{},
+			}, c)
+		} else if addr == "" {
 			MSAddressAndMeta(MSAddressAndMetaMessage{
 				ID:        msg.ID,
 				ErrorMsg:  err.Error(),
@@ -1116,6 +1556,9 @@ const (
 	GET_FIRMWARE_DEVICE_BUSY          = 5
 	GET_FIRMWARE_INCORRECT_BLOCK_SIZE = 6
 	GET_FIRMWARE_TIMEOUT              = 7
+	GET_FIRMWARE_CANCELLED            = 8
+	GET_FIRMWARE_DEVICE_TIMEOUT       = 9
+	GET_FIRMWARE_OPEN_SERIAL_MONITOR  = 10
 )
 
 func MSGetFirmwareFinish(msg MSOperationReportMessage, c *WebSocketConnection) {
@@ -1193,6 +1636,8 @@ func GetMsFirmwareStart(event Event, c *WebSocketConnection) error {
 	// блокировка устройства и клиента для выгрузки, необходимо разблокировать после завершения выгрузки
 	c.SetFlashingBoard(dev, msg.ID)
 	c.FlashingBoard.SetLock(true)
+	ctx := c.StartOperationSync()
+	defer c.StopOperationSync()
 	transmission := newDataTransmission()
 	defer func() {
 		if c.GetFlashingBoardSync() != nil {
@@ -1213,9 +1658,28 @@ func GetMsFirmwareStart(event Event, c *WebSocketConnection) error {
 	board := dev.Board.(*MS1)
 	logger := make(chan any)
 	go LogSend(c, logger)
-	bytes, err := board.getFirmware(msg.Address, logger, msg.RefBlChip)
+	extractCtx, cancel := dev.operationContext(ctx, ExtractOperation)
+	defer cancel()
+	bytes, err := board.getFirmware(extractCtx, msg.Address, logger, msg.RefBlChip)
 	if err != nil {
 		close(logger)
+		if ctx.Err() != nil {
+			MSGetFirmwareFinish(MSOperationReportMessage{
+				ID:      msg.ID,
+				Address: msg.Address,
+				Code:    GET_FIRMWARE_CANCELLED,
+			}, c)
+			return nil
+		}
+		if isTimeout(extractCtx) {
+			MSGetFirmwareFinish(MSOperationReportMessage{
+				ID:      msg.ID,
+				Address: msg.Address,
+				Comment: err.Error(),
+				Code:    GET_FIRMWARE_DEVICE_TIMEOUT,
+			}, c)
+			return err
+		}
 		MSGetFirmwareFinish(MSOperationReportMessage{
 			ID:      msg.ID,
 			Address: msg.Address,
@@ -1226,39 +1690,80 @@ func GetMsFirmwareStart(event Event, c *WebSocketConnection) error {
 	}
 	transmission.set(bytes, msg.BlockSize)
 	c.sendOutgoingEventMessage(prepareForBinary, nil, false)
-	for {
-		if transmission.isFinish() {
-			c.binDataChan <- []byte{}
-			MSGetFirmwareFinish(MSOperationReportMessage{
-				ID:      msg.ID,
-				Address: msg.Address,
-				Code:    GET_FIRMWARE_DONE,
-			}, c)
-			return nil
-		}
-		c.binDataChan <- transmission.popBlock()
+	if !sendFirmwareBlocks(ctx, transmission, c) {
+		MSGetFirmwareFinish(MSOperationReportMessage{
+			ID:      msg.ID,
+			Address: msg.Address,
+			Code:    GET_FIRMWARE_CANCELLED,
+		}, c)
+		return nil
 	}
+	MSGetFirmwareFinish(MSOperationReportMessage{
+		ID:      msg.ID,
+		Address: msg.Address,
+		Code:    GET_FIRMWARE_DONE,
+	}, c)
+	return nil
 }
 
 // обработка запроса на выгрузку прошивки из устройства
 func GetFirmwareStart(event Event, c *WebSocketConnection) error {
+	return readbackStart(event, c, GetFirmwareApproveMsg, GetFirmwareFinishMsg, func(board Board) (readFunc, bool) {
+		extractor, canExtract := board.(Extractor)
+		if !canExtract {
+			return nil, false
+		}
+		if !supportsOperation(board, ExtractOperation) {
+			return nil, false
+		}
+		return extractor.Extract, true
+	})
+}
+
+// обработка запроса на чтение EEPROM устройства
+func EEPROMReadStart(event Event, c *WebSocketConnection) error {
+	return readbackStart(event, c, EEPROMReadApproveMsg, EEPROMReadFinishMsg, func(board Board) (readFunc, bool) {
+		accessor, hasEEPROM := board.(EEPROMAccessor)
+		if !hasEEPROM {
+			return nil, false
+		}
+		return accessor.ReadEEPROM, true
+	})
+}
+
+// функция чтения данных из устройства, прерывается при отмене контекста ctx
+type readFunc func(ctx context.Context) ([]byte, error)
+
+/*
+Общая часть выгрузки данных из устройства (get-firmware, eeprom-read).
+
+getReader возвращает функцию чтения данных для устройства, либо false, если устройство не поддерживает операцию.
+Данные передаются клиенту блоками через ready-for-binary и get-firmware-next-block,
+о результате клиент узнаёт через сообщение finishMsg.
+*/
+func readbackStart(event Event, c *WebSocketConnection, approveMsg string, finishMsg string, getReader func(board Board) (readFunc, bool)) error {
 	var msg GetFirmwareMessage
 	err := json.Unmarshal(event.Payload, &msg)
 	if err != nil {
-		DeviceCommentCode(GetFirmwareFinishMsg, msg.ID, GET_FIRMWARE_ERROR, err.Error(), c)
+		DeviceCommentCode(finishMsg, msg.ID, GET_FIRMWARE_ERROR, err.Error(), c)
 		return err
 	}
 	if c.IsBinChanBusySync() {
-		DeviceCommentCode(GetFirmwareFinishMsg, msg.ID, GET_FIRMWARE_CLIENT_BUSY, "", c)
+		DeviceCommentCode(finishMsg, msg.ID, GET_FIRMWARE_CLIENT_BUSY, "", c)
 		return nil
 	}
 	if msg.BlockSize < 1 {
-		DeviceCommentCode(GetFirmwareFinishMsg, msg.ID, GET_FIRMWARE_INCORRECT_BLOCK_SIZE, "", c)
+		DeviceCommentCode(finishMsg, msg.ID, GET_FIRMWARE_INCORRECT_BLOCK_SIZE, "", c)
 		return nil
 	}
 	dev, exists := detector.GetBoardSync(msg.ID)
 	if !exists {
-		DeviceCommentCode(GetFirmwareFinishMsg, msg.ID, GET_FIRMWARE_NO_DEV, "", c)
+		DeviceCommentCode(finishMsg, msg.ID, GET_FIRMWARE_NO_DEV, "", c)
+		return nil
+	}
+	read, canRead := getReader(dev.Board)
+	if !canRead {
+		DeviceCommentCode(finishMsg, msg.ID, GET_FIRMWARE_WRONG_DEV, "", c)
 		return nil
 	}
 	// плата блокируется!!!
@@ -1272,17 +1777,23 @@ func GetFirmwareStart(event Event, c *WebSocketConnection) error {
 		} else {
 			detector.DeleteBoard(msg.ID)
 			DeviceUpdateDelete(msg.ID, c)
-			DeviceCommentCode(GetFirmwareFinishMsg, msg.ID, GET_FIRMWARE_NO_DEV, "", c)
+			DeviceCommentCode(finishMsg, msg.ID, GET_FIRMWARE_NO_DEV, "", c)
 			return nil
 		}
 	}
 	if dev.IsFlashBlocked() {
-		DeviceCommentCode(GetFirmwareFinishMsg, msg.ID, GET_FIRMWARE_DEVICE_BUSY, "", c)
+		DeviceCommentCode(finishMsg, msg.ID, GET_FIRMWARE_DEVICE_BUSY, "", c)
+		return nil
+	}
+	if dev.flashesThroughSerial() && dev.SerialMonitor.isOpen() {
+		DeviceCommentCode(finishMsg, msg.ID, GET_FIRMWARE_OPEN_SERIAL_MONITOR, "", c)
 		return nil
 	}
 	// блокировка устройства и клиента для выгрузки, необходимо разблокировать после завершения выгрузки
 	c.SetFlashingBoard(dev, msg.ID)
 	c.FlashingBoard.SetLock(true)
+	ctx := c.StartOperationSync()
+	defer c.StopOperationSync()
 	transmission := newDataTransmission()
 	defer func() {
 		if c.GetFlashingBoardSync() != nil {
@@ -1295,25 +1806,52 @@ func GetFirmwareStart(event Event, c *WebSocketConnection) error {
 		transmission.Clear()
 	}()
 
-	c.sendOutgoingEventMessage(GetFirmwareApproveMsg, DeviceIdMessage{
+	c.sendOutgoingEventMessage(approveMsg, DeviceIdMessage{
 		ID: msg.ID,
 	}, false)
 
-	board := dev.Board.(*BlgMb)
-	bytes, err := board.Extract()
+	extractCtx, cancel := dev.operationContext(ctx, ExtractOperation)
+	defer cancel()
+	bytes, err := read(extractCtx)
 	if err != nil {
-		DeviceCommentCode(GetFirmwareFinishMsg, msg.ID, GET_FIRMWARE_ERROR, err.Error(), c)
+		if ctx.Err() != nil {
+			DeviceCommentCode(finishMsg, msg.ID, GET_FIRMWARE_CANCELLED, "", c)
+			return nil
+		}
+		if isTimeout(extractCtx) {
+			DeviceCommentCode(finishMsg, msg.ID, GET_FIRMWARE_DEVICE_TIMEOUT, err.Error(), c)
+			return err
+		}
+		DeviceCommentCode(finishMsg, msg.ID, GET_FIRMWARE_ERROR, err.Error(), c)
 		return err
 	}
 	transmission.set(bytes, msg.BlockSize)
 	c.sendOutgoingEventMessage(prepareForBinary, nil, false)
+	if !sendFirmwareBlocks(ctx, transmission, c) {
+		DeviceCommentCode(finishMsg, msg.ID, GET_FIRMWARE_CANCELLED, "", c)
+		return nil
+	}
+	DeviceCommentCode(finishMsg, msg.ID, GET_FIRMWARE_DONE, "", c)
+	return nil
+}
+
+/*
+Передача выгруженной прошивки блоками, по одному блоку на каждый запрос get-firmware-next-block.
+
+Возвращает false, если передача была отменена клиентом.
+*/
+func sendFirmwareBlocks(ctx context.Context, transmission *DataTransmission, c *WebSocketConnection) bool {
 	for {
-		if transmission.isFinish() {
-			c.binDataChan <- []byte{}
-			DeviceCommentCode(GetFirmwareFinishMsg, msg.ID, GET_FIRMWARE_DONE, "", c)
-			return nil
+		block := transmission.popBlock()
+		select {
+		case c.binDataChan <- block:
+		case <-ctx.Done():
+			return false
+		}
+		// пустой блок сообщает о том, что все данные переданы
+		if len(block) == 0 {
+			return true
 		}
-		c.binDataChan <- transmission.popBlock()
 	}
 }
 
@@ -1322,7 +1860,16 @@ func GetFirmwareNextBlock(event Event, c *WebSocketConnection) error {
 		//FIXME: на клиенте нужно не забыть обработать случай, когда ошибка приходит от выгрузки прошивки, а не от загрузки
 		return ErrFlashNotStarted
 	}
-	bin := <-c.binDataChan
+	ctx := c.GetOperationCtxSync()
+	if ctx == nil {
+		return ErrFlashNotStarted
+	}
+	var bin []byte
+	select {
+	case bin = <-c.binDataChan:
+	case <-ctx.Done():
+		return nil
+	}
 	if len(bin) == 0 {
 		return nil
 	}
@@ -1427,6 +1974,7 @@ func Reset(event Event, c *WebSocketConnection) error {
 		RESET_ERR = 2
 		WRONG_DEV = 3
 		JSON_ERR  = 4
+		TIMEOUT   = 5
 	)
 	resetResult := func(resetResultMessage DeviceCommentCodeMessage) {
 		c.sendOutgoingEventMessage(resetResultMsg, resetResultMessage, false)
@@ -1449,6 +1997,13 @@ func Reset(event Event, c *WebSocketConnection) error {
 		})
 		return nil
 	}
+	if !supportsOperation(dev.Board, ResetOperation) {
+		resetResult(DeviceCommentCodeMessage{
+			ID:   msg.ID,
+			Code: WRONG_DEV,
+		})
+		return nil
+	}
 	dev.Mu.Lock()
 	defer dev.Mu.Unlock()
 	updated := dev.Board.Update()
@@ -1465,8 +2020,18 @@ func Reset(event Event, c *WebSocketConnection) error {
 			return nil
 		}
 	}
-	err = dev.Board.Reset()
+	ctx, cancel := dev.operationContext(context.Background(), ResetOperation)
+	defer cancel()
+	err = dev.Board.Reset(ctx)
 	if err != nil {
+		if isTimeout(ctx) {
+			resetResult(DeviceCommentCodeMessage{
+				ID:      msg.ID,
+				Code:    TIMEOUT,
+				Comment: err.Error(),
+			})
+			return err
+		}
 		resetResult(DeviceCommentCodeMessage{
 			ID:      msg.ID,
 			Code:    RESET_ERR,
@@ -1488,6 +2053,7 @@ func Ping(event Event, c *WebSocketConnection) error {
 		NO_PONG   = 2
 		WRONG_DEV = 3
 		JSON_ERR  = 4
+		TIMEOUT   = 5
 	)
 	pong := func(pongMessage DeviceCommentCodeMessage) {
 		c.sendOutgoingEventMessage(pongMsg, pongMessage, false)
@@ -1510,6 +2076,13 @@ func Ping(event Event, c *WebSocketConnection) error {
 		})
 		return nil
 	}
+	if !supportsOperation(dev.Board, PingOperation) {
+		pong(DeviceCommentCodeMessage{
+			ID:   msg.ID,
+			Code: WRONG_DEV,
+		})
+		return nil
+	}
 	dev.Mu.Lock()
 	defer dev.Mu.Unlock()
 	updated := dev.Board.Update()
@@ -1526,8 +2099,18 @@ func Ping(event Event, c *WebSocketConnection) error {
 			return nil
 		}
 	}
-	err = dev.Board.Ping()
+	ctx, cancel := dev.operationContext(context.Background(), PingOperation)
+	defer cancel()
+	err = dev.Board.Ping(ctx)
 	if err != nil {
+		if isTimeout(ctx) {
+			pong(DeviceCommentCodeMessage{
+				ID:      msg.ID,
+				Code:    TIMEOUT,
+				Comment: err.Error(),
+			})
+			return err
+		}
 		pong(DeviceCommentCodeMessage{
 			ID:      msg.ID,
 			Code:    NO_PONG,
@@ -1541,3 +2124,426 @@ func Ping(event Event, c *WebSocketConnection) error {
 	})
 	return nil
 }
+
+// чтение fuse-битов и lock-битов устройства
+func ReadFuses(event Event, c *WebSocketConnection) error {
+	const (
+		FUSES_OK  = 0
+		NO_DEV    = 1
+		FUSES_ERR = 2
+		WRONG_DEV = 3
+		JSON_ERR  = 4
+		TIMEOUT   = 5
+		DEV_BUSY  = 6
+	)
+	fuses := func(fusesMessage FusesMessage) {
+		c.sendOutgoingEventMessage(fusesMsg, fusesMessage, false)
+	}
+	var msg DeviceIdMessage
+	err := json.Unmarshal(event.Payload, &msg)
+	if err != nil {
+		fuses(FusesMessage{
+			Code:    JSON_ERR,
+			Comment: err.Error(),
+		})
+		return err
+	}
+	dev, exists := detector.GetBoardSync(msg.ID)
+	if !exists {
+		DeviceUpdateDelete(msg.ID, c)
+		fuses(FusesMessage{
+			ID:   msg.ID,
+			Code: NO_DEV,
+		})
+		return nil
+	}
+	accessor, hasFuses := dev.Board.(FuseAccessor)
+	if !hasFuses || !supportsOperation(dev.Board, FuseOperation) {
+		fuses(FusesMessage{
+			ID:   msg.ID,
+			Code: WRONG_DEV,
+		})
+		return nil
+	}
+	dev.Mu.Lock()
+	defer dev.Mu.Unlock()
+	updated := dev.Board.Update()
+	if updated {
+		if dev.Board.IsConnected() {
+			DeviceUpdatePort(msg.ID, dev, c)
+		} else {
+			detector.DeleteBoard(msg.ID)
+			DeviceUpdateDelete(msg.ID, c)
+			fuses(FusesMessage{
+				ID:   msg.ID,
+				Code: NO_DEV,
+			})
+			return nil
+		}
+	}
+	if dev.IsFlashBlocked() || dev.SerialMonitor.isOpen() {
+		fuses(FusesMessage{
+			ID:   msg.ID,
+			Code: DEV_BUSY,
+		})
+		return nil
+	}
+	ctx, cancel := dev.operationContext(context.Background(), FuseOperation)
+	defer cancel()
+	values, err := accessor.ReadFuses(ctx)
+	if err != nil {
+		if isTimeout(ctx) {
+			fuses(FusesMessage{
+				ID:      msg.ID,
+				Code:    TIMEOUT,
+				Comment: err.Error(),
+			})
+			return err
+		}
+		fuses(FusesMessage{
+			ID:      msg.ID,
+			Code:    FUSES_ERR,
+			Comment: err.Error(),
+		})
+		return err
+	}
+	fuses(FusesMessage{
+		ID:    msg.ID,
+		Code:  FUSES_OK,
+		Fuses: fusesToJSON(values),
+	})
+	return nil
+}
+
+/*
+Запись fuse-битов и lock-битов устройства.
+
+Запись доступна, только если сервер запущен с флагом -allowFuseWrite,
+значения проверяются по таблице безопасности контроллера (см. fuses.go).
+*/
+func WriteFuses(event Event, c *WebSocketConnection) error {
+	const (
+		WRITE_OK       = 0
+		NO_DEV         = 1
+		WRITE_ERR      = 2
+		WRONG_DEV      = 3
+		JSON_ERR       = 4
+		TIMEOUT        = 5
+		DEV_BUSY       = 6
+		WRITE_DISABLED = 7
+		UNSAFE_VALUE   = 8
+		WRONG_VALUE    = 9
+	)
+	writeFusesResult := func(resultMessage DeviceCommentCodeMessage) {
+		c.sendOutgoingEventMessage(writeFusesResultMsg, resultMessage, false)
+	}
+	var msg WriteFusesMessage
+	err := json.Unmarshal(event.Payload, &msg)
+	if err != nil {
+		writeFusesResult(DeviceCommentCodeMessage{
+			Code:    JSON_ERR,
+			Comment: err.Error(),
+		})
+		return err
+	}
+	if !allowFuseWrite {
+		writeFusesResult(DeviceCommentCodeMessage{
+			ID:   msg.ID,
+			Code: WRITE_DISABLED,
+		})
+		return nil
+	}
+	values, err := parseFuses(msg.Fuses)
+	if err == nil && len(values) == 0 {
+		err = errors.New("не указаны значения fuse-битов")
+	}
+	if err != nil {
+		writeFusesResult(DeviceCommentCodeMessage{
+			ID:      msg.ID,
+			Code:    WRONG_VALUE,
+			Comment: err.Error(),
+		})
+		return nil
+	}
+	dev, exists := detector.GetBoardSync(msg.ID)
+	if !exists {
+		DeviceUpdateDelete(msg.ID, c)
+		writeFusesResult(DeviceCommentCodeMessage{
+			ID:   msg.ID,
+			Code: NO_DEV,
+		})
+		return nil
+	}
+	accessor, hasFuses := dev.Board.(FuseAccessor)
+	if !hasFuses || !supportsOperation(dev.Board, FuseOperation) || !accessor.CanWriteFuses() {
+		writeFusesResult(DeviceCommentCodeMessage{
+			ID:   msg.ID,
+			Code: WRONG_DEV,
+		})
+		return nil
+	}
+	err = accessor.CheckFuses(values)
+	if err != nil {
+		writeFusesResult(DeviceCommentCodeMessage{
+			ID:      msg.ID,
+			Code:    UNSAFE_VALUE,
+			Comment: err.Error(),
+		})
+		return nil
+	}
+	dev.Mu.Lock()
+	defer dev.Mu.Unlock()
+	updated := dev.Board.Update()
+	if updated {
+		if dev.Board.IsConnected() {
+			DeviceUpdatePort(msg.ID, dev, c)
+		} else {
+			detector.DeleteBoard(msg.ID)
+			DeviceUpdateDelete(msg.ID, c)
+			writeFusesResult(DeviceCommentCodeMessage{
+				ID:   msg.ID,
+				Code: NO_DEV,
+			})
+			return nil
+		}
+	}
+	if dev.IsFlashBlocked() || dev.SerialMonitor.isOpen() {
+		writeFusesResult(DeviceCommentCodeMessage{
+			ID:   msg.ID,
+			Code: DEV_BUSY,
+		})
+		return nil
+	}
+	ctx, cancel := dev.operationContext(context.Background(), FuseOperation)
+	defer cancel()
+	flasherMsg, err := accessor.WriteFuses(ctx, values)
+	if err != nil {
+		if isTimeout(ctx) {
+			writeFusesResult(DeviceCommentCodeMessage{
+				ID:      msg.ID,
+				Code:    TIMEOUT,
+				Comment: flasherMsg,
+			})
+			return err
+		}
+		writeFusesResult(DeviceCommentCodeMessage{
+			ID:      msg.ID,
+			Code:    WRITE_ERR,
+			Comment: flasherMsg,
+		})
+		return err
+	}
+	writeFusesResult(DeviceCommentCodeMessage{
+		ID:      msg.ID,
+		Code:    WRITE_OK,
+		Comment: flasherMsg,
+	})
+	return nil
+}
+
+/*
+Проверка прошивки для устройства (deviceID) или шаблона устройства (templateID) без обращения к устройству.
+
+Файл загружается так же, как при flash-start, либо берётся из памяти сервера по хэшу (hash) ранее проверенного файла.
+*/
+func InspectFirmware(event Event, c *WebSocketConnection) error {
+	const (
+		INSPECT_OK  = 0
+		NO_DEV      = 1
+		NO_TEMPLATE = 2
+		NO_TARGET   = 3
+		NO_FILE     = 4
+		PARSE_ERR   = 5
+		JSON_ERR    = 6
+	)
+	firmwareInfo := func(firmwareInfoMessage FirmwareInfoMessage) {
+		c.sendOutgoingEventMessage(firmwareInfoMsg, firmwareInfoMessage, false)
+	}
+	var msg InspectFirmwareMessage
+	err := json.Unmarshal(event.Payload, &msg)
+	if err != nil {
+		firmwareInfo(FirmwareInfoMessage{
+			Code:    JSON_ERR,
+			Comment: err.Error(),
+		})
+		return err
+	}
+	reply := FirmwareInfoMessage{
+		ID:         msg.ID,
+		TemplateID: msg.TemplateID,
+	}
+	var temp *BoardTemplate
+	switch {
+	case msg.ID != "":
+		dev, exists := detector.GetBoardSync(msg.ID)
+		if !exists {
+			DeviceUpdateDelete(msg.ID, c)
+			reply.Code = NO_DEV
+			firmwareInfo(reply)
+			return nil
+		}
+		temp = dev.TypeDesc
+	case msg.TemplateID != nil:
+		var exists bool
+		temp, exists = detector.findTemplate(*msg.TemplateID)
+		if !exists {
+			reply.Code = NO_TEMPLATE
+			firmwareInfo(reply)
+			return nil
+		}
+	default:
+		reply.Code = NO_TARGET
+		firmwareInfo(reply)
+		return nil
+	}
+	var data []byte
+	if msg.Hash != "" {
+		cached, exists := firmwareCache.Get(msg.Hash)
+		if !exists {
+			reply.Code = NO_FILE
+			firmwareInfo(reply)
+			return nil
+		}
+		data = cached
+	} else {
+		data, err = uploadFirmwareData(msg.FileSize, c)
+		if err != nil {
+			return err
+		}
+		if data == nil {
+			return nil
+		}
+	}
+	hash := firmwareCache.Add(data)
+	info, err := inspectFirmware(data, hash, temp)
+	if err != nil {
+		reply.Code = PARSE_ERR
+		reply.Comment = err.Error()
+		firmwareInfo(reply)
+		return err
+	}
+	reply.Code = INSPECT_OK
+	reply.FirmwareInfo = info
+	firmwareInfo(reply)
+	return nil
+}
+
+// загрузка файла от клиента без блокировки устройства, возвращает nil без ошибки, если соединение закрыто
+func uploadFirmwareData(fileSize int, c *WebSocketConnection) ([]byte, error) {
+	if c.IsBinChanBusySync() {
+		return nil, ErrFlashNotFinished
+	}
+	if fileSize < 1 {
+		return nil, ErrIncorrectFileSize
+	}
+	if fileSize > maxFileSize {
+		return nil, ErrFlashLargeFile
+	}
+	c.SetUploadingSync(true)
+	defer c.SetUploadingSync(false)
+	ctx := c.StartOperationSync()
+	defer c.StopOperationSync()
+	fileWriter := newFlashFileWriter()
+	fileWriter.Start(fileSize, "firmware")
+	defer fileWriter.Clear()
+	fileCreated, err := receiveFile(ctx, fileWriter, c)
+	if err != nil || !fileCreated {
+		return nil, err
+	}
+	data, err := os.ReadFile(fileWriter.GetFilePath())
+	if err != nil {
+		return nil, ErrFileWriter
+	}
+	return data, nil
+}
+
+// история прошивок устройства, устройство может быть не подключено
+func GetDeviceHistory(event Event, c *WebSocketConnection) error {
+	var msg DeviceIdMessage
+	err := json.Unmarshal(event.Payload, &msg)
+	if err != nil {
+		return ErrUnmarshal
+	}
+	return c.sendOutgoingEventMessage(deviceHistoryMsg, DeviceHistoryMessage{msg.ID, deviceHistory.Get(msg.ID)}, false)
+}
+
+// список резервных копий прошивок устройства, устройство может быть не подключено
+func GetBackups(event Event, c *WebSocketConnection) error {
+	var msg DeviceIdMessage
+	err := json.Unmarshal(event.Payload, &msg)
+	if err != nil {
+		return ErrUnmarshal
+	}
+	return c.sendOutgoingEventMessage(backupsMsg, BackupsMessage{msg.ID, backupStore.List(msg.ID)}, false)
+}
+
+// восстановление прошивки устройства из резервной копии, сделанной перед прошивкой
+func RestoreBackup(event Event, c *WebSocketConnection) error {
+	const (
+		RESTORE_OK  = 0
+		NO_DEV      = 1
+		RESTORE_ERR = 2
+		WRONG_DEV   = 3
+		JSON_ERR    = 4
+		TIMEOUT     = 5
+		DEV_BUSY    = 6
+		NO_BACKUP   = 7
+	)
+	result := func(code int, comment string, deviceID string) {
+		DeviceCommentCode(restoreBackupResultMsg, deviceID, code, comment, c)
+	}
+	var msg RestoreBackupMessage
+	err := json.Unmarshal(event.Payload, &msg)
+	if err != nil {
+		result(JSON_ERR, err.Error(), "")
+		return err
+	}
+	backup, exists := backupStore.Find(msg.ID, msg.Name)
+	if !exists {
+		result(NO_BACKUP, "", msg.ID)
+		return nil
+	}
+	dev, exists := detector.GetBoardSync(msg.ID)
+	if !exists {
+		DeviceUpdateDelete(msg.ID, c)
+		result(NO_DEV, "", msg.ID)
+		return nil
+	}
+	if _, canBackup := dev.Board.(Snapshotter); !canBackup {
+		result(WRONG_DEV, "", msg.ID)
+		return nil
+	}
+	dev.Mu.Lock()
+	defer dev.Mu.Unlock()
+	updated := dev.Board.Update()
+	if updated {
+		if dev.Board.IsConnected() {
+			DeviceUpdatePort(msg.ID, dev, c)
+		} else {
+			detector.DeleteBoard(msg.ID)
+			DeviceUpdateDelete(msg.ID, c)
+			result(NO_DEV, "", msg.ID)
+			return nil
+		}
+	}
+	if dev.IsFlashBlocked() || dev.SerialMonitor.isOpen() {
+		result(DEV_BUSY, "", msg.ID)
+		return nil
+	}
+	if board, isAddressable := dev.Board.(Addressable); isAddressable {
+		board.SetAddress(backup.Address)
+	}
+	ctx, cancel := dev.operationContext(context.Background(), FlashOperation)
+	defer cancel()
+	flasherMsg, err := dev.Board.Flash(ctx, backupStore.Path(backup), nil)
+	if err != nil {
+		if isTimeout(ctx) {
+			result(TIMEOUT, flasherMsg, msg.ID)
+			return err
+		}
+		result(RESTORE_ERR, flasherMsg, msg.ID)
+		return err
+	}
+	result(RESTORE_OK, flasherMsg, msg.ID)
+	return nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"time"
 )
@@ -22,13 +23,33 @@ func (board *FakeBoard) GetSerialPort() string {
 	return board.portName
 }
 
-func (board *FakeBoard) Flash(filePath string, logger chan any) (string, error) {
-	time.Sleep(3 * time.Second)
+func (board *FakeBoard) Flash(ctx context.Context, filePath string, logger chan any) (string, error) {
+	select {
+	case <-time.After(3 * time.Second):
+	case <-ctx.Done():
+		return "Fake flashing is cancelled", ctx.Err()
+	}
 	printLog(fmt.Sprintf("Fake uploading of file %s in board %v is completed", filePath, board))
 	fakeMessage := "Fake flashing is completed"
 	return fakeMessage, nil
 }
 
+func (board *FakeBoard) FlashPlan(filePath string) []string {
+	return []string{"fake: имитация прошивки файла " + filePath + " (3 секунды)"}
+}
+
+func (board *FakeBoard) Verify(ctx context.Context, filePath string, logger chan any) (VerifyResult, error) {
+	if logger != nil {
+		defer close(logger)
+	}
+	select {
+	case <-time.After(3 * time.Second):
+	case <-ctx.Done():
+		return VerifyResult{Address: -1, Message: "Fake verification is cancelled"}, ctx.Err()
+	}
+	return VerifyResult{Match: true, Address: -1, Message: "Fake verification is completed"}, nil
+}
+
 func (board *FakeBoard) Update() bool {
 	return false
 }
@@ -39,23 +60,24 @@ func (board *FakeBoard) GetWebMessageType() string {
 
 func (board *FakeBoard) GetWebMessage(name string, deviceID string) any {
 	return DeviceMessage{
-		ID:         deviceID,
-		Name:       name,
-		Controller: board.controller,
-		Programmer: board.programmer,
-		SerialID:   board.serialID,
-		PortName:   board.portName,
+		ID:           deviceID,
+		Name:         name,
+		Controller:   board.controller,
+		Programmer:   board.programmer,
+		SerialID:     board.serialID,
+		PortName:     board.portName,
+		LastFirmware: deviceHistory.Last(deviceID),
 	}
 }
 
-func (board *FakeBoard) Ping() error {
+func (board *FakeBoard) Ping(ctx context.Context) error {
 	return nil
 }
 
-func (board *FakeBoard) Reset() error {
+func (board *FakeBoard) Reset(ctx context.Context) error {
 	return nil
 }
 
-func (board *FakeBoard) GetMetaData() (any, error) {
+func (board *FakeBoard) GetMetaData(ctx context.Context) (any, error) {
 	return "fake metadata", nil
 }
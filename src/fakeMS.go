@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"time"
 )
@@ -19,25 +20,46 @@ func (board *FakeMS) IsConnected() bool {
 	return board.portNames[0] != NOT_FOUND
 }
 
-func (board *FakeMS) Flash(filePath string, logger chan any) (string, error) {
+func (board *FakeMS) FlashPlan(filePath string) []string {
+	return []string{"fake ms: имитация прошивки файла " + filePath + " (3 секунды)"}
+}
+
+func (board *FakeMS) Flash(ctx context.Context, filePath string, logger chan any) (string, error) {
 	if board.fakeAddress != board.clientAddress {
 		return "Address doesn't match", nil
 	}
-	time.Sleep(3 * time.Second)
+	select {
+	case <-time.After(3 * time.Second):
+	case <-ctx.Done():
+		return "Fake flashing is cancelled", ctx.Err()
+	}
 	printLog(fmt.Sprintf("Fake uploading of file %s in board %v is completed", filePath, board))
 	fakeMessage := "Fake flashing is completed"
 	return fakeMessage, nil
 }
 
+func (board *FakeMS) Verify(ctx context.Context, filePath string, logger chan any) (VerifyResult, error) {
+	if logger != nil {
+		defer close(logger)
+	}
+	select {
+	case <-time.After(3 * time.Second):
+	case <-ctx.Done():
+		return VerifyResult{Address: -1, Message: "Fake verification is cancelled"}, ctx.Err()
+	}
+	return VerifyResult{Match: true, Address: -1, Message: "Fake verification is completed"}, nil
+}
+
 func (board *FakeMS) GetWebMessageType() string {
 	return MSDeviceMsg
 }
 
 func (board *FakeMS) GetWebMessage(name string, deviceID string) any {
 	return MSDeviceMessage{
-		ID:        deviceID,
-		Name:      name,
-		PortNames: board.portNames,
+		ID:           deviceID,
+		Name:         name,
+		PortNames:    board.portNames,
+		LastFirmware: deviceHistory.Last(deviceID),
 	}
 }
 
@@ -45,14 +67,14 @@ func (board *FakeMS) Update() bool {
 	return false
 }
 
-func (board *FakeMS) Ping() error {
+func (board *FakeMS) Ping(ctx context.Context) error {
 	return nil
 }
 
-func (board *FakeMS) Reset() error {
+func (board *FakeMS) Reset(ctx context.Context) error {
 	return nil
 }
 
-func (board *FakeMS) GetMetaData() (any, error) {
+func (board *FakeMS) GetMetaData(ctx context.Context) (any, error) {
 	return "fake metadata", nil
 }
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// форматы файлов прошивки
+const (
+	FIRMWARE_HEX = "hex"
+	FIRMWARE_BIN = "bin"
+	FIRMWARE_ELF = "elf"
+	// преобразуется в UF2 самим устройством при прошивке (см. uf2.go)
+	FIRMWARE_UF2 = "uf2"
+)
+
+// адреса AVR, начиная с которого в ELF-файлах располагаются RAM, EEPROM и fuse-биты, а не flash-память
+const avrNonFlashAddress = 0x800000
+
+// значение, которым заполняются промежутки между участками прошивки при преобразовании в BIN
+const binPadding = 0xFF
+
+// определение формата прошивки по её содержимому
+func detectFirmwareFormat(data []byte) string {
+	if bytes.HasPrefix(data, []byte(elf.ELFMAG)) {
+		return FIRMWARE_ELF
+	}
+	if bytes.HasPrefix(bytes.TrimLeft(data, " \t\r\n"), []byte(":")) {
+		return FIRMWARE_HEX
+	}
+	return FIRMWARE_BIN
+}
+
+/*
+Преобразование загруженного файла прошивки в формат, который ожидает прошивающая программа устройства
+(поле flashFileExtension шаблона). Файл перезаписывается на месте.
+
+Поддерживаются форматы ELF, BIN и HEX, формат загруженного файла определяется по содержимому.
+Если формат совпадает с ожидаемым, либо устройство ожидает другой формат, то файл не изменяется.
+Возвращает ErrFirmwareConversion и описание проблемы для клиента.
+*/
+func convertFirmwareFile(temp *BoardTemplate, filePath string) (string, error) {
+	target := strings.ToLower(temp.FlashFileExtension)
+	if target != FIRMWARE_HEX && target != FIRMWARE_BIN {
+		return "", nil
+	}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return "Не удалось прочитать файл прошивки: " + err.Error(), ErrFirmwareConversion
+	}
+	format := detectFirmwareFormat(data)
+	if format == target {
+		return "", nil
+	}
+	image, err := loadFirmwareImage(data, format, uint32(temp.FlashBase))
+	if err != nil {
+		return fmt.Sprintf("Не удалось прочитать прошивку в формате %s: %s", format, err.Error()), ErrFirmwareConversion
+	}
+	if len(image.Segments) == 0 {
+		return "Файл прошивки не содержит данных для записи во flash-память", ErrFirmwareConversion
+	}
+	// размещение проверяется до преобразования, так как в BIN адреса участков уже не сохраняются
+	if msg, err := temp.validateFirmwareImage(image); err != nil {
+		return msg, err
+	}
+	var converted []byte
+	switch target {
+	case FIRMWARE_HEX:
+		converted = image.IntelHex()
+	case FIRMWARE_BIN:
+		converted, err = image.Binary(uint32(temp.FlashBase), temp.maxImageSize())
+		if err != nil {
+			return "Не удалось преобразовать прошивку в BIN: " + err.Error(), ErrFirmwareConversion
+		}
+	}
+	err = os.WriteFile(filePath, converted, 0600)
+	if err != nil {
+		return "Не удалось записать преобразованную прошивку: " + err.Error(), ErrFirmwareConversion
+	}
+	printLog(fmt.Sprintf("firmware: %s converted to %s (%d bytes)", format, target, image.Size()))
+	return "", nil
+}
+
+// чтение образа прошивки из данных в формате format, base - адрес, с которого начинается прошивка в формате BIN
+func loadFirmwareImage(data []byte, format string, base uint32) (*FirmwareImage, error) {
+	switch format {
+	case FIRMWARE_ELF:
+		return parseELF(data)
+	case FIRMWARE_HEX:
+		return parseIntelHex(bytes.NewReader(data))
+	case FIRMWARE_BIN:
+		return &FirmwareImage{Segments: []MemorySegment{{Address: base, Data: data}}}, nil
+	}
+	return nil, fmt.Errorf("неизвестный формат прошивки: %s", format)
+}
+
+/*
+Извлечение загружаемых сегментов (PT_LOAD) из ELF-файла.
+
+Используются физические адреса сегментов (LMA), так как именно по ним данные располагаются во flash-памяти
+(например, начальные значения переменных из .data).
+*/
+func parseELF(data []byte) (*FirmwareImage, error) {
+	file, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var records []MemorySegment
+	for _, prog := range file.Progs {
+		if prog.Type != elf.PT_LOAD || prog.Filesz == 0 {
+			continue
+		}
+		if file.Machine == elf.EM_AVR && prog.Paddr >= avrNonFlashAddress {
+			continue
+		}
+		if prog.Paddr+prog.Filesz > 1<<32 {
+			return nil, fmt.Errorf("сегмент по адресу 0x%x выходит за пределы 32-битного адресного пространства", prog.Paddr)
+		}
+		segmentData := make([]byte, prog.Filesz)
+		_, err := prog.ReadAt(segmentData, 0)
+		if err != nil {
+			return nil, errors.New("не удалось прочитать сегмент: " + err.Error())
+		}
+		records = append(records, MemorySegment{Address: uint32(prog.Paddr), Data: segmentData})
+	}
+	segments, err := mergeSegments(records)
+	if err != nil {
+		return nil, err
+	}
+	entry := uint32(file.Entry)
+	return &FirmwareImage{Segments: segments, Entry: &entry}, nil
+}
+
+/*
+Непрерывный образ прошивки, начиная с адреса base, промежутки между участками заполняются binPadding.
+Если base равен 0 (в шаблоне не указан flashBase), то образ начинается с адреса первого участка прошивки.
+
+Возвращает ошибку, если прошивка начинается до адреса base, либо если образ получается больше limit байт
+(например, из-за записи по далёкому адресу), память под такой образ не выделяется.
+*/
+func (image *FirmwareImage) Binary(base uint32, limit int) ([]byte, error) {
+	if len(image.Segments) == 0 {
+		return nil, nil
+	}
+	if base == 0 {
+		base = image.Segments[0].Address
+	}
+	if image.Segments[0].Address < base {
+		return nil, fmt.Errorf("прошивка начинается по адресу 0x%x, до начала образа (0x%x)", image.Segments[0].Address, base)
+	}
+	last := image.Segments[len(image.Segments)-1]
+	span := int64(last.Address) + int64(len(last.Data)) - int64(base)
+	if span > int64(limit) {
+		return nil, fmt.Errorf("образ прошивки с адреса 0x%x занимает %d байт, это больше допустимого размера (%d байт)", base, span, limit)
+	}
+	binary := bytes.Repeat([]byte{binPadding}, int(span))
+	for _, segment := range image.Segments {
+		copy(binary[segment.Address-base:], segment.Data)
+	}
+	return binary, nil
+}
+
+// максимальный размер непрерывного образа прошивки: размер flash-памяти, если он указан в шаблоне, иначе максимальный размер файла
+func (temp *BoardTemplate) maxImageSize() int {
+	if temp.FlashSize > 0 {
+		return temp.FlashSize
+	}
+	return maxFileSize
+}
+
+/*
+Проверка файла прошивки перед передачей его прошивающей программе.
+
+Файл разбирается в образ прошивки (формат определяется по содержимому, как при преобразовании),
+который сравнивается с памятью устройства (поля flashSize и bootloader шаблона).
+Возвращает ErrInvalidHex, ErrFirmwareConversion или ErrFirmwareOutOfRange и подробное описание проблемы для клиента.
+*/
+func validateFirmwareFile(temp *BoardTemplate, filePath string) (string, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return "Не удалось прочитать файл прошивки: " + err.Error(), ErrFirmwareConversion
+	}
+	// UF2-файл передаётся устройству без изменений, адреса в нём проверяет само устройство
+	if isUF2(data) {
+		return "", nil
+	}
+	format := detectFirmwareFormat(data)
+	image, err := loadFirmwareImage(data, format, uint32(temp.FlashBase))
+	if err != nil {
+		if format == FIRMWARE_HEX {
+			return "Некорректный файл Intel HEX: " + err.Error(), ErrInvalidHex
+		}
+		return fmt.Sprintf("Не удалось прочитать прошивку в формате %s: %s", format, err.Error()), ErrFirmwareConversion
+	}
+	return temp.validateFirmwareImage(image)
+}
+
+// проверка размещения образа прошивки в памяти устройства, возвращает ErrFirmwareOutOfRange и описание проблем для клиента
+func (temp *BoardTemplate) validateFirmwareImage(image *FirmwareImage) (string, error) {
+	problems := temp.checkFirmwareLayout(image)
+	if len(problems) > 0 {
+		return "Прошивка не подходит для устройства " + temp.Name + ":\n" + strings.Join(problems, "\n"), ErrFirmwareOutOfRange
+	}
+	return "", nil
+}
+
+// проверка того, что прошивка помещается во flash-память и не затрагивает загрузчик, возвращает список проблем
+func (temp *BoardTemplate) checkFirmwareLayout(image *FirmwareImage) []string {
+	var problems []string
+	flashStart := temp.FlashBase
+	flashEnd := temp.FlashBase + temp.FlashSize
+	for _, segment := range image.Segments {
+		start := int(segment.Address)
+		end := int(segment.End())
+		if temp.FlashSize > 0 && start < flashStart {
+			problems = append(problems, fmt.Sprintf(
+				"диапазон %s находится до начала flash-памяти (%d байт, %s)",
+				formatRange(start, min(end, flashStart)),
+				temp.FlashSize,
+				formatRange(flashStart, flashEnd),
+			))
+		}
+		if temp.FlashSize > 0 && end > flashEnd {
+			problems = append(problems, fmt.Sprintf(
+				"диапазон %s выходит за пределы flash-памяти (%d байт, %s)",
+				formatRange(max(start, flashEnd), end),
+				temp.FlashSize,
+				formatRange(flashStart, flashEnd),
+			))
+		}
+		if temp.Bootloader != nil {
+			bootloaderStart := temp.Bootloader.Start
+			bootloaderEnd := temp.Bootloader.Start + temp.Bootloader.Size
+			overlapStart := max(start, bootloaderStart)
+			overlapEnd := min(end, bootloaderEnd)
+			if overlapStart < overlapEnd {
+				problems = append(problems, fmt.Sprintf(
+					"диапазон %s пересекается с областью загрузчика (%s)",
+					formatRange(overlapStart, overlapEnd),
+					formatRange(bootloaderStart, bootloaderEnd),
+				))
+			}
+		}
+	}
+	return problems
+}
+
+// диапазон адресов [start, end) в виде "0x0000-0x7fff"
+func formatRange(start int, end int) string {
+	return fmt.Sprintf("0x%04x-0x%04x", start, end-1)
+}
@@ -1,10 +1,91 @@
 package main
 
 import (
+	"errors"
 	"sync"
 )
 
-var flasherSync sync.Mutex
+/*
+Синхронизация поиска bootloader'ов устройств, которые прошиваются через отдельный bootloader (например, Arduino Micro).
+
+После перезагрузки устройство появляется в системе как новое устройство типа bootloader, и его нужно отличить
+от bootloader'ов других устройств, которые прошиваются в это же время.
+Если расположение устройства на шине известно (см. ArduinoOS.usbLocation), то bootloader ищется по нему,
+иначе перезагрузка и поиск bootloader'ов одного типа выполняются по очереди (lockTemplate).
+Найденный bootloader занимается до конца прошивки, чтобы его не выбрали другие прошивки.
+*/
+type bootloaderSync struct {
+	mu sync.Mutex
+	// блокировки перезагрузки и поиска для каждого типа bootloader (ID шаблона)
+	templates map[int]*sync.Mutex
+	// ID занятых bootloader'ов
+	claimed map[string]void
+}
+
+var bootloaders = bootloaderSync{
+	templates: make(map[int]*sync.Mutex),
+	claimed:   make(map[string]void),
+}
+
+// устройство, расположение которого на шине известно
+type usbLocator interface {
+	usbLocation() string
+}
+
+// блокировка перезагрузки и поиска bootloader'ов с шаблоном templateID, возвращает функцию для снятия блокировки
+func (s *bootloaderSync) lockTemplate(templateID int) func() {
+	s.mu.Lock()
+	lock, exists := s.templates[templateID]
+	if !exists {
+		lock = &sync.Mutex{}
+		s.templates[templateID] = lock
+	}
+	s.mu.Unlock()
+	lock.Lock()
+	return lock.Unlock
+}
+
+/*
+Выбор и занятие bootloader'а с шаблоном templateID среди devs.
+
+Занятые bootloader'ы пропускаются, если location не пустая, то выбирается только bootloader с таким же расположением на шине.
+Возвращает nil, если подходящего bootloader'а нет, и ошибку, если подходящих bootloader'ов несколько.
+*/
+func (s *bootloaderSync) claim(devs map[string]*Device, templateID int, location string) (string, *Device, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var foundID string
+	var found *Device
+	for id, dev := range devs {
+		if dev.TypeDesc.ID != templateID {
+			continue
+		}
+		if _, isClaimed := s.claimed[id]; isClaimed {
+			continue
+		}
+		if location != "" {
+			locator, ok := dev.Board.(usbLocator)
+			if !ok || locator.usbLocation() != location {
+				continue
+			}
+		}
+		if found != nil {
+			return "", nil, errors.New("bootloader: too many")
+		}
+		foundID, found = id, dev
+	}
+	if found != nil {
+		s.claimed[foundID] = void{}
+	}
+	return foundID, found, nil
+}
+
+// освобождение bootloader'а после прошивки
+func (s *bootloaderSync) release(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.claimed, id)
+}
 
 func handleFlashResult(flashOutput string, flashError error) (result string) {
 	if flashError != nil {
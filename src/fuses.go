@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// fuse-биты и lock-биты, которые можно прочитать и записать (названия областей памяти avrdude)
+var fuseNames = []string{"lfuse", "hfuse", "efuse", "lock"}
+
+/*
+Правило, запрещающее запись значения fuse-битов.
+
+Значение запрещено, если (значение & mask) == forbidden.
+Биты AVR считаются запрограммированными, если они равны 0.
+*/
+type fuseRule struct {
+	fuse        string
+	mask        byte
+	forbidden   byte
+	description string
+}
+
+var (
+	// SPIEN (hfuse, бит 5) должен быть запрограммирован, иначе устройство нельзя будет прошить программатором
+	spienRule = fuseRule{"hfuse", 0x20, 0x20, "отключение SPIEN запрещает прошивку через SPI-программатор"}
+	// CKSEL = 0000 - внешний тактовый сигнал, на платах с кварцем контроллер перестанет запускаться
+	externalClockRule = fuseRule{"lfuse", 0x0F, 0x00, "CKSEL = 0000 (внешний тактовый сигнал) остановит контроллер на плате без генератора"}
+	// RSTDISBL (hfuse, бит 7 у ATmega328P) превращает вывод reset в обычный вывод
+	rstdisblRule = fuseRule{"hfuse", 0x80, 0x00, "включение RSTDISBL отключает вывод reset, после чего прошивка через SPI невозможна"}
+	// DWEN (hfuse, бит 6 у ATmega328P) включает debugWIRE, который занимает вывод reset
+	dwenRule = fuseRule{"hfuse", 0x40, 0x00, "включение DWEN (debugWIRE) отключает прошивку через SPI"}
+	// BOOTRST (hfuse, бит 0) должен быть запрограммирован, иначе после сброса загрузчик не запустится
+	bootrstRule = fuseRule{"hfuse", 0x01, 0x01, "отключение BOOTRST запрещает прошивку через загрузчик"}
+)
+
+// протоколы avrdude, которые работают через загрузчик, а не через ISP-программатор
+var bootloaderProgrammers = []string{"arduino", "avr109", "butterfly", "wiring", "urclock"}
+
+// загрузчики, которые не могут читать fuse-биты (Optiboot отвечает нулями вместо значений),
+// Caterina (avr109, butterfly) и загрузчик stk500v2 (wiring) возвращают настоящие значения
+var fuselessBootloaderProgrammers = []string{"arduino", "urclock"}
+
+// минимальный размер загрузочной области (BOOTSZ = 11) в байтах, ключ - название контроллера в нижнем регистре
+var bootSectionMinSize = map[string]int{
+	"atmega328p": 512,
+	"m328p":      512,
+	"atmega32u4": 512,
+	"m32u4":      512,
+	"atmega2560": 1024,
+	"m2560":      1024,
+}
+
+// таблица безопасности для каждого контроллера, в качестве ключа используется название контроллера в нижнем регистре
+var fuseSafetyRules = map[string][]fuseRule{
+	"atmega328p": {spienRule, rstdisblRule, dwenRule, externalClockRule},
+	"m328p":      {spienRule, rstdisblRule, dwenRule, externalClockRule},
+	"atmega32u4": {spienRule, externalClockRule},
+	"m32u4":      {spienRule, externalClockRule},
+	"atmega2560": {spienRule, externalClockRule},
+	"m2560":      {spienRule, externalClockRule},
+}
+
+// true, если программатор работает через загрузчик, который не может записывать fuse-биты (их записывает только ISP-программатор)
+func isBootloaderProgrammer(programmer string) bool {
+	return slices.Contains(bootloaderProgrammers, strings.ToLower(programmer))
+}
+
+// true, если fuse-биты можно прочитать через этот программатор
+func canReadFuses(programmer string) bool {
+	return !slices.Contains(fuselessBootloaderProgrammers, strings.ToLower(programmer))
+}
+
+/*
+Правила для устройств с загрузчиком: BOOTRST должен оставаться запрограммированным,
+а BOOTSZ (hfuse, биты 1-2) должен соответствовать размеру загрузчика, иначе загрузчик перестанет запускаться.
+
+Если размер загрузчика не соответствует ни одному значению BOOTSZ, то изменение BOOTSZ запрещено полностью.
+*/
+func bootSectionRules(controller string, bootloader MemoryRegion) []fuseRule {
+	rules := []fuseRule{bootrstRule}
+	minSize := bootSectionMinSize[strings.ToLower(controller)]
+	for code := 0; code < 4; code++ {
+		// BOOTSZ = 11 - минимальная область, каждое следующее значение вдвое больше
+		if minSize<<(3-code) == bootloader.Size {
+			continue
+		}
+		rules = append(rules, fuseRule{
+			"hfuse", 0x06, byte(code << 1),
+			fmt.Sprintf("BOOTSZ = %02b не соответствует размеру загрузчика (%d байт)", code, bootloader.Size),
+		})
+	}
+	return rules
+}
+
+/*
+Проверка значений fuse-битов перед записью.
+
+Запись запрещается для контроллеров, которых нет в таблице fuseSafetyRules,
+а также если хотя бы одно значение нарушает правило из таблицы.
+Если у устройства есть загрузчик (bootloader не nil), то дополнительно проверяются BOOTRST и BOOTSZ.
+*/
+func checkFuseSafety(controller string, bootloader *MemoryRegion, fuses map[string]byte) error {
+	rules, known := fuseSafetyRules[strings.ToLower(controller)]
+	if !known {
+		return fmt.Errorf("для контроллера %s нет таблицы безопасных значений fuse-битов, запись запрещена", controller)
+	}
+	if bootloader != nil {
+		rules = append(slices.Clone(rules), bootSectionRules(controller, *bootloader)...)
+	}
+	for _, rule := range rules {
+		value, ok := fuses[rule.fuse]
+		if !ok {
+			continue
+		}
+		if value&rule.mask == rule.forbidden {
+			return fmt.Errorf("значение %s = 0x%02x запрещено: %s", rule.fuse, value, rule.description)
+		}
+	}
+	return nil
+}
+
+// преобразование значений fuse-битов из шестнадцатеричных строк ("0xFF" или "FF")
+func parseFuses(values map[string]string) (map[string]byte, error) {
+	fuses := make(map[string]byte, len(values))
+	for fuse, value := range values {
+		if !slices.Contains(fuseNames, fuse) {
+			return nil, fmt.Errorf("неизвестный fuse: %s", fuse)
+		}
+		parsed, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(value), "0x"), 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("неправильное значение %s: %s", fuse, value)
+		}
+		fuses[fuse] = byte(parsed)
+	}
+	return fuses, nil
+}
+
+// представление значений fuse-битов для клиента в виде шестнадцатеричных строк
+func fusesToJSON(fuses map[string]byte) map[string]string {
+	values := make(map[string]string, len(fuses))
+	for fuse, value := range fuses {
+		values[fuse] = fmt.Sprintf("0x%02x", value)
+	}
+	return values
+}
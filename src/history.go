@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// количество последних прошивок, которые хранятся для каждого устройства
+const deviceHistorySize = 10
+
+// запись об успешной прошивке устройства
+type FirmwareRecord struct {
+	// SHA-256 загруженного клиентом файла (до преобразования формата), совпадает с hash из firmware-info
+	Hash string `json:"hash"`
+	// размер загруженного файла в байтах
+	Size int `json:"size"`
+	// имя файла, указанное клиентом
+	FileName string    `json:"fileName,omitempty"`
+	Time     time.Time `json:"time"`
+	// адрес клиента, который прошил устройство
+	Client string `json:"client"`
+	// адрес платы, только для МС-ТЮК
+	Address string `json:"address,omitempty"`
+}
+
+/*
+История прошивок устройств, ключ - deviceID (серийный номер устройства, если он есть).
+
+История сохраняется в JSON-файл после каждого изменения, если путь к файлу пустой, то история хранится только в памяти.
+*/
+type DeviceHistory struct {
+	mu   sync.Mutex
+	path string
+	// записи от старых к новым
+	records map[string][]FirmwareRecord
+}
+
+// история прошивок, загружается при запуске сервера
+var deviceHistory *DeviceHistory
+
+// стандартный путь к файлу с историей, пустая строка, если не удалось определить папку для конфигурации пользователя
+func defaultHistoryPath() string {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(configDir, "lapki-flasher", "device-history.json")
+}
+
+// чтение истории из файла, если файла нет или он повреждён, то история начинается заново
+func loadDeviceHistory(path string) *DeviceHistory {
+	history := DeviceHistory{
+		path:    path,
+		records: make(map[string][]FirmwareRecord),
+	}
+	if path == "" {
+		return &history
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Println("Не удалось прочитать историю прошивок:", err.Error())
+		}
+		return &history
+	}
+	err = json.Unmarshal(data, &history.records)
+	if err != nil {
+		log.Println("Не удалось распарсить историю прошивок, история будет перезаписана:", err.Error())
+		history.records = make(map[string][]FirmwareRecord)
+	}
+	return &history
+}
+
+// добавление записи о прошивке, сохраняются только последние deviceHistorySize записей
+func (history *DeviceHistory) Add(deviceID string, record FirmwareRecord) {
+	history.mu.Lock()
+	defer history.mu.Unlock()
+	records := append(history.records[deviceID], record)
+	if len(records) > deviceHistorySize {
+		records = records[len(records)-deviceHistorySize:]
+	}
+	history.records[deviceID] = records
+	err := history.save()
+	if err != nil {
+		log.Println("Не удалось сохранить историю прошивок:", err.Error())
+	}
+}
+
+// история прошивок устройства, начиная с последней
+func (history *DeviceHistory) Get(deviceID string) []FirmwareRecord {
+	history.mu.Lock()
+	defer history.mu.Unlock()
+	records := slices.Clone(history.records[deviceID])
+	slices.Reverse(records)
+	return records
+}
+
+// последняя прошивка устройства, nil, если устройство ещё не прошивалось
+func (history *DeviceHistory) Last(deviceID string) *FirmwareRecord {
+	history.mu.Lock()
+	defer history.mu.Unlock()
+	records := history.records[deviceID]
+	if len(records) == 0 {
+		return nil
+	}
+	last := records[len(records)-1]
+	return &last
+}
+
+// запись истории во временный файл с последующей заменой, чтобы файл не повредился при аварийном завершении
+func (history *DeviceHistory) save() error {
+	if history.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(history.records, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(history.path), 0755)
+	if err != nil {
+		return err
+	}
+	tempPath := history.path + ".tmp"
+	err = os.WriteFile(tempPath, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempPath, history.path)
+}
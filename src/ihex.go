@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+// типы записей Intel HEX
+const (
+	IHEX_DATA                     = 0x00
+	IHEX_END_OF_FILE              = 0x01
+	IHEX_EXTENDED_SEGMENT_ADDRESS = 0x02
+	IHEX_START_SEGMENT_ADDRESS    = 0x03
+	IHEX_EXTENDED_LINEAR_ADDRESS  = 0x04
+	IHEX_START_LINEAR_ADDRESS     = 0x05
+)
+
+// непрерывный участок памяти с данными прошивки
+type MemorySegment struct {
+	Address uint32
+	Data    []byte
+}
+
+// адрес, следующий за последним байтом сегмента
+func (segment MemorySegment) End() uint32 {
+	return segment.Address + uint32(len(segment.Data))
+}
+
+// образ прошивки, состоящий из непрерывных участков, отсортированных по адресу
+type FirmwareImage struct {
+	Segments []MemorySegment
+	// адрес начала выполнения, nil, если он не указан в файле
+	Entry *uint32
+}
+
+// общий размер данных прошивки в байтах
+func (image *FirmwareImage) Size() int {
+	size := 0
+	for _, segment := range image.Segments {
+		size += len(segment.Data)
+	}
+	return size
+}
+
+// чтение и проверка файла в формате Intel HEX
+func parseIntelHexFile(filePath string) (*FirmwareImage, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parseIntelHex(file)
+}
+
+/*
+Разбор прошивки в формате Intel HEX.
+
+Проверяются формат и контрольные суммы записей, типы записей и наличие записи конца файла.
+Записи с данными объединяются в непрерывные участки, при перекрытии используются данные более поздней записи.
+*/
+func parseIntelHex(reader io.Reader) (*FirmwareImage, error) {
+	var records []MemorySegment
+	var baseAddress uint32
+	var entry *uint32
+	endOfFile := false
+	scanner := bufio.NewScanner(reader)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if endOfFile {
+			return nil, fmt.Errorf("строка %d: данные после записи конца файла", lineNum)
+		}
+		if !strings.HasPrefix(line, ":") {
+			return nil, fmt.Errorf("строка %d: запись должна начинаться с ':'", lineNum)
+		}
+		record, err := hex.DecodeString(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("строка %d: запись содержит некорректные шестнадцатеричные символы", lineNum)
+		}
+		// байт длины, два байта адреса, байт типа и контрольная сумма
+		if len(record) < 5 || len(record) != int(record[0])+5 {
+			return nil, fmt.Errorf("строка %d: длина записи не совпадает с указанной", lineNum)
+		}
+		var checksum byte
+		for _, b := range record {
+			checksum += b
+		}
+		if checksum != 0 {
+			return nil, fmt.Errorf("строка %d: неправильная контрольная сумма", lineNum)
+		}
+		address := uint32(record[1])<<8 | uint32(record[2])
+		recordType := record[3]
+		data := record[4 : len(record)-1]
+		switch recordType {
+		case IHEX_DATA:
+			records = append(records, MemorySegment{Address: baseAddress + address, Data: data})
+		case IHEX_END_OF_FILE:
+			endOfFile = true
+		case IHEX_EXTENDED_SEGMENT_ADDRESS:
+			if len(data) != 2 {
+				return nil, fmt.Errorf("строка %d: запись расширенного адреса сегмента должна содержать 2 байта", lineNum)
+			}
+			baseAddress = (uint32(data[0])<<8 | uint32(data[1])) << 4
+		case IHEX_EXTENDED_LINEAR_ADDRESS:
+			if len(data) != 2 {
+				return nil, fmt.Errorf("строка %d: запись расширенного линейного адреса должна содержать 2 байта", lineNum)
+			}
+			baseAddress = (uint32(data[0])<<8 | uint32(data[1])) << 16
+		case IHEX_START_SEGMENT_ADDRESS, IHEX_START_LINEAR_ADDRESS:
+			// адрес начала выполнения не влияет на содержимое памяти
+			if len(data) != 4 {
+				return nil, fmt.Errorf("строка %d: запись стартового адреса должна содержать 4 байта", lineNum)
+			}
+			start := binary.BigEndian.Uint32(data)
+			if recordType == IHEX_START_SEGMENT_ADDRESS {
+				// CS:IP
+				start = (start>>16)<<4 + start&0xFFFF
+			}
+			entry = &start
+		default:
+			return nil, fmt.Errorf("строка %d: неизвестный тип записи 0x%02x", lineNum, recordType)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !endOfFile {
+		return nil, fmt.Errorf("отсутствует запись конца файла")
+	}
+	segments, err := mergeSegments(records)
+	if err != nil {
+		return nil, err
+	}
+	return &FirmwareImage{Segments: segments, Entry: entry}, nil
+}
+
+/*
+Объединение записей в непрерывные участки памяти.
+
+Перекрывающиеся записи означают, что файл повреждён, поэтому в этом случае возвращается ошибка.
+*/
+func mergeSegments(records []MemorySegment) ([]MemorySegment, error) {
+	slices.SortFunc(records, func(a, b MemorySegment) int {
+		return int(int64(a.Address) - int64(b.Address))
+	})
+	var segments []MemorySegment
+	for _, record := range records {
+		if len(record.Data) == 0 {
+			continue
+		}
+		if len(segments) == 0 || record.Address > segments[len(segments)-1].End() {
+			segments = append(segments, MemorySegment{Address: record.Address, Data: slices.Clone(record.Data)})
+			continue
+		}
+		last := &segments[len(segments)-1]
+		if record.Address < last.End() {
+			return nil, fmt.Errorf("данные по адресу 0x%x перекрываются с предыдущими записями", record.Address)
+		}
+		last.Data = append(last.Data, record.Data...)
+	}
+	return segments, nil
+}
+
+// количество байтов данных в одной записи при формировании Intel HEX
+const ihexRecordSize = 16
+
+// формирование файла в формате Intel HEX из образа прошивки
+func (image *FirmwareImage) IntelHex() []byte {
+	var builder strings.Builder
+	// верхние 16 бит адреса, заданные последней записью расширенного линейного адреса
+	upperAddress := uint32(0)
+	for _, segment := range image.Segments {
+		for offset := 0; offset < len(segment.Data); {
+			address := segment.Address + uint32(offset)
+			if address>>16 != upperAddress {
+				upperAddress = address >> 16
+				writeIntelHexRecord(&builder, 0, IHEX_EXTENDED_LINEAR_ADDRESS, []byte{byte(upperAddress >> 8), byte(upperAddress)})
+			}
+			// запись не должна пересекать границу 64 КБ
+			size := min(ihexRecordSize, len(segment.Data)-offset, int(0x10000-address&0xFFFF))
+			writeIntelHexRecord(&builder, uint16(address), IHEX_DATA, segment.Data[offset:offset+size])
+			offset += size
+		}
+	}
+	if image.Entry != nil {
+		writeIntelHexRecord(&builder, 0, IHEX_START_LINEAR_ADDRESS, binary.BigEndian.AppendUint32(nil, *image.Entry))
+	}
+	writeIntelHexRecord(&builder, 0, IHEX_END_OF_FILE, nil)
+	return []byte(builder.String())
+}
+
+func writeIntelHexRecord(builder *strings.Builder, address uint16, recordType byte, data []byte) {
+	record := make([]byte, 0, len(data)+5)
+	record = append(record, byte(len(data)), byte(address>>8), byte(address), recordType)
+	record = append(record, data...)
+	var checksum byte
+	for _, b := range record {
+		checksum += b
+	}
+	record = append(record, -checksum)
+	builder.WriteString(":")
+	builder.WriteString(strings.ToUpper(hex.EncodeToString(record)))
+	builder.WriteString("\n")
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// количество файлов прошивок, которые хранятся в памяти для повторной проверки по хэшу
+const firmwareCacheSize = 8
+
+/*
+Недавно загруженные файлы прошивок, ключ - SHA-256 содержимого файла в шестнадцатеричном виде.
+
+Позволяет клиенту проверить уже загруженную прошивку для другого устройства, не отправляя файл повторно.
+При переполнении удаляется самый старый файл.
+*/
+type FirmwareCache struct {
+	mu    sync.Mutex
+	files map[string][]byte
+	// хэши в порядке добавления
+	order []string
+}
+
+var firmwareCache = newFirmwareCache()
+
+func newFirmwareCache() *FirmwareCache {
+	return &FirmwareCache{
+		files: make(map[string][]byte),
+	}
+}
+
+// сохранение файла, возвращает его хэш
+func (cache *FirmwareCache) Add(data []byte) string {
+	hash := firmwareHash(data)
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if _, exists := cache.files[hash]; exists {
+		return hash
+	}
+	if len(cache.order) >= firmwareCacheSize {
+		delete(cache.files, cache.order[0])
+		cache.order = cache.order[1:]
+	}
+	cache.files[hash] = data
+	cache.order = append(cache.order, hash)
+	return hash
+}
+
+// получение файла по хэшу, false, если такого файла нет
+func (cache *FirmwareCache) Get(hash string) ([]byte, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	data, exists := cache.files[strings.ToLower(hash)]
+	return data, exists
+}
+
+func firmwareHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// SHA-256 файла в шестнадцатеричном виде
+func fileHash(filePath string) (string, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return "", err
+	}
+	return firmwareHash(data), nil
+}
+
+// диапазон адресов, занятый прошивкой
+type FirmwareRange struct {
+	Start uint32 `json:"start"`
+	Size  int    `json:"size"`
+}
+
+// результат проверки прошивки для устройства (inspect-firmware)
+type FirmwareInfo struct {
+	// формат загруженного файла (elf, bin, hex)
+	Format string `json:"format"`
+	// формат, который ожидает прошивающая программа устройства
+	TargetFormat string `json:"targetFormat"`
+	FileSize     int    `json:"fileSize"`
+	// размер данных, записываемых во flash-память
+	Size   int             `json:"size"`
+	Ranges []FirmwareRange `json:"ranges"`
+	// адрес начала выполнения, отсутствует, если он не указан в файле
+	Entry *uint32 `json:"entry,omitempty"`
+	// SHA-256 загруженного файла, по нему можно повторно проверить прошивку без загрузки файла
+	Hash string `json:"hash"`
+	// CRC-32 (IEEE) непрерывного образа прошивки, промежутки заполнены 0xFF
+	CRC32 uint32 `json:"crc32"`
+	// доступный для прошивки объём flash-памяти (без загрузчика), 0, если размер памяти устройства неизвестен
+	Available int `json:"available"`
+	// доля доступной памяти в процентах, которую займёт прошивка
+	Usage float64 `json:"usage"`
+	// true, если прошивка помещается во flash-память и не затрагивает загрузчик
+	Fits     bool     `json:"fits"`
+	Warnings []string `json:"warnings"`
+}
+
+/*
+Проверка прошивки для шаблона устройства без обращения к устройству.
+
+Возвращает ошибку, если файл не удалось разобрать.
+Проблемы, из-за которых прошивка будет отклонена или может работать неправильно, перечисляются в Warnings.
+*/
+func inspectFirmware(data []byte, hash string, temp *BoardTemplate) (*FirmwareInfo, error) {
+	format := detectFirmwareFormat(data)
+	image, err := loadFirmwareImage(data, format, uint32(temp.FlashBase))
+	if err != nil {
+		return nil, fmt.Errorf("не удалось прочитать прошивку в формате %s: %s", format, err.Error())
+	}
+	info := FirmwareInfo{
+		Format:       format,
+		TargetFormat: strings.ToLower(temp.FlashFileExtension),
+		FileSize:     len(data),
+		Size:         image.Size(),
+		Ranges:       []FirmwareRange{},
+		Entry:        image.Entry,
+		Hash:         hash,
+		CRC32:        image.crc32(),
+		Warnings:     []string{},
+	}
+	for _, segment := range image.Segments {
+		info.Ranges = append(info.Ranges, FirmwareRange{segment.Address, len(segment.Data)})
+	}
+	if len(image.Segments) == 0 {
+		info.Warnings = append(info.Warnings, "файл прошивки не содержит данных для записи во flash-память")
+	}
+	if format != info.TargetFormat {
+		if slices.Contains([]string{FIRMWARE_HEX, FIRMWARE_BIN, FIRMWARE_UF2}, info.TargetFormat) {
+			info.Warnings = append(info.Warnings, fmt.Sprintf("файл будет преобразован из %s в %s перед прошивкой", format, info.TargetFormat))
+		} else {
+			info.Warnings = append(info.Warnings, fmt.Sprintf("устройство ожидает файл в формате %s, преобразование из %s не поддерживается", info.TargetFormat, format))
+		}
+	}
+	problems := temp.checkFirmwareLayout(image)
+	info.Fits = len(problems) == 0
+	info.Warnings = append(info.Warnings, problems...)
+	if temp.FlashSize > 0 {
+		info.Available = temp.FlashSize
+		if temp.Bootloader != nil {
+			info.Available -= temp.Bootloader.Size
+		}
+		if info.Available > 0 {
+			info.Usage = math.Round(float64(info.Size)*1000/float64(info.Available)) / 10
+		}
+	} else {
+		info.Warnings = append(info.Warnings, "размер flash-памяти устройства неизвестен, размещение прошивки не проверялось")
+	}
+	if image.Entry != nil && len(image.Segments) > 0 && !image.contains(*image.Entry) {
+		info.Warnings = append(info.Warnings, fmt.Sprintf("адрес начала выполнения 0x%04x находится вне данных прошивки", *image.Entry))
+	}
+	return &info, nil
+}
+
+// true, если адрес принадлежит одному из участков прошивки
+/*
+CRC32 непрерывного образа прошивки (как у Binary, начиная с адреса первого участка).
+
+Образ не собирается в памяти: промежутки между участками добавляются в контрольную сумму блоками,
+поэтому запись по далёкому адресу не приводит к выделению памяти под весь промежуток.
+*/
+func (image *FirmwareImage) crc32() uint32 {
+	hash := crc32.NewIEEE()
+	padding := bytes.Repeat([]byte{binPadding}, 4096)
+	for i, segment := range image.Segments {
+		if i > 0 {
+			gap := int64(segment.Address) - int64(image.Segments[i-1].End())
+			for ; gap > 0; gap -= int64(len(padding)) {
+				hash.Write(padding[:min(gap, int64(len(padding)))])
+			}
+		}
+		hash.Write(segment.Data)
+	}
+	return hash.Sum32()
+}
+
+func (image *FirmwareImage) contains(address uint32) bool {
+	for _, segment := range image.Segments {
+		if address >= segment.Address && address < segment.End() {
+			return true
+		}
+	}
+	return false
+}
@@ -25,6 +25,10 @@ func main() {
 	setArgs()
 	printArgsDesc()
 
+	deviceHistory = loadDeviceHistory(historyPath)
+	backupStore = loadBackupStore(backupPath)
+	loadPlugins(pluginsPath)
+
 	detector = NewDetector()
 	manager := NewWebSocketManager()
 
@@ -2,8 +2,11 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"os"
 
 	"github.com/polyus-nt/ms1-go/pkg/ms1"
 )
@@ -42,6 +45,26 @@ var ms1Type = map[string]string{
 	"9cd7735665c44c15": "ard-a1",
 }
 
+func init() {
+	registerBoardType(&BoardType{
+		Name:      "tjc-ms",
+		Detection: MSDetection,
+		New: func(temp BoardTemplate, found FoundDevice) Board {
+			return NewMS1([4]string(found.Ports), found.MS1OS)
+		},
+		ProgressMsg: FlashBackTrackMs,
+		Timeouts: map[DeviceOperation]int{
+			// прошивка с проверкой может занять несколько минут
+			FlashOperation:   300,
+			PingOperation:    10,
+			ResetOperation:   10,
+			MetaOperation:    10,
+			ExtractOperation: 300,
+			VerifyOperation:  300,
+		},
+	})
+}
+
 func NewMS1(portNames [4]string, ms1OS MS1OS) *MS1 {
 	ms1 := MS1{
 		portNames: portNames,
@@ -52,6 +75,18 @@ func NewMS1(portNames [4]string, ms1OS MS1OS) *MS1 {
 	return &ms1
 }
 
+func (board *MS1) GetAddress() string {
+	return board.address
+}
+
+func (board *MS1) SetAddress(address string) {
+	board.address = address
+}
+
+func (board *MS1) SetFlashVerification(verify bool) {
+	board.verify = verify
+}
+
 func (board *MS1) GetSerialPort() string {
 	return board.portNames[3]
 }
@@ -60,12 +95,13 @@ func (board *MS1) IsConnected() bool {
 	return board.portNames[0] != NOT_FOUND
 }
 
-func (board *MS1) Flash(filePath string, logger chan any) (string, error) {
+func (board *MS1) Flash(ctx context.Context, filePath string, logger chan any) (string, error) {
 	port, err := ms1.MkSerial(board.getFlashPort())
 	if err != nil {
 		return err.Error(), err
 	}
 	defer port.Close()
+	defer closeOnCancel(ctx, port)()
 
 	device := ms1.NewDevice(port)
 	if board.address != "" {
@@ -85,6 +121,15 @@ func (board *MS1) Flash(filePath string, logger chan any) (string, error) {
 	return flashMessage, err
 }
 
+// операции библиотеки ms1-go, которые будут выполнены при прошивке
+func (board *MS1) FlashPlan(filePath string) []string {
+	plan := []string{"ms1: открытие порта " + board.getFlashPort()}
+	if board.address != "" {
+		plan = append(plan, "ms1: SetAddress("+board.address+")")
+	}
+	return append(plan, fmt.Sprintf("ms1: WriteFirmware(%s, verification = %v)", filePath, board.verify))
+}
+
 func (board *MS1) getFlashPort() string {
 	return board.portNames[0]
 }
@@ -95,33 +140,36 @@ func (board *MS1) GetWebMessageType() string {
 
 func (board *MS1) GetWebMessage(name string, deviceID string) any {
 	return MSDeviceMessage{
-		ID:        deviceID,
-		Name:      name,
-		PortNames: board.portNames,
+		ID:           deviceID,
+		Name:         name,
+		PortNames:    board.portNames,
+		LastFirmware: deviceHistory.Last(deviceID),
 	}
 }
 
-func (board *MS1) Reset() error {
+func (board *MS1) Reset(ctx context.Context) error {
 	portMS, err := ms1.MkSerial(board.getFlashPort())
 	if err != nil {
 		return err
 	}
 	defer portMS.Close()
+	defer closeOnCancel(ctx, portMS)()
 	deviceMS := ms1.NewDevice(portMS)
 	err = deviceMS.SetAddress(board.address)
 	if err != nil {
 		return err
 	}
 	deviceMS.Reset(true)
-	return nil
+	return ctx.Err()
 }
 
-func (board *MS1) Ping() error {
+func (board *MS1) Ping(ctx context.Context) error {
 	portMS, err := ms1.MkSerial(board.getFlashPort())
 	if err != nil {
 		return err
 	}
 	defer portMS.Close()
+	defer closeOnCancel(ctx, portMS)()
 	deviceMS := ms1.NewDevice(portMS)
 	err = deviceMS.SetAddress(board.address)
 	if err != nil {
@@ -135,12 +183,13 @@ func (board *MS1) Ping() error {
 }
 
 // получить адрес для МС-ТЮК
-func (board *MS1) getAddress() (string, error) {
+func (board *MS1) getAddress(ctx context.Context) (string, error) {
 	portMS, err := ms1.MkSerial(board.getFlashPort())
 	if err != nil {
 		return "", err
 	}
 	defer portMS.Close()
+	defer closeOnCancel(ctx, portMS)()
 	deviceMS := ms1.NewDevice(portMS)
 	_, err, updated := deviceMS.GetId(true, true)
 	if err != nil {
@@ -153,12 +202,13 @@ func (board *MS1) getAddress() (string, error) {
 }
 
 // Возвращает *ms1.Meta
-func (board *MS1) GetMetaData() (any, error) {
+func (board *MS1) GetMetaData(ctx context.Context) (any, error) {
 	portMS, err := ms1.MkSerial(board.getFlashPort())
 	if err != nil {
 		return nil, err
 	}
 	defer portMS.Close()
+	defer closeOnCancel(ctx, portMS)()
 	deviceMS := ms1.NewDevice(portMS)
 	err = deviceMS.SetAddress(board.address)
 	if err != nil {
@@ -204,12 +254,13 @@ func metaToJSON(meta *ms1.Meta) MetaSubMessage {
 Если адрес не удалось получить, то вернётся пустая строка,  nil и ошибкой.
 Если метаданные не удалось получить то вернётся адрес, nil и ошибка.
 */
-func (board *MS1) getAddressAndMeta() (string, *ms1.Meta, error) {
+func (board *MS1) getAddressAndMeta(ctx context.Context) (string, *ms1.Meta, error) {
 	portMS, err := ms1.MkSerial(board.getFlashPort())
 	if err != nil {
 		return "", nil, err
 	}
 	defer portMS.Close()
+	defer closeOnCancel(ctx, portMS)()
 	deviceMS := ms1.NewDevice(portMS)
 	// получение адреса
 	_, err, updated := deviceMS.GetId(true, true)
@@ -224,12 +275,13 @@ func (board *MS1) getAddressAndMeta() (string, *ms1.Meta, error) {
 	return deviceMS.GetAddress(), &meta, err
 }
 
-func (board *MS1) getFirmware(address string, logger chan any, RefBlChip string) ([]byte, error) {
+func (board *MS1) getFirmware(ctx context.Context, address string, logger chan any, RefBlChip string) ([]byte, error) {
 	portMS, err := ms1.MkSerial(board.getFlashPort())
 	if err != nil {
 		return nil, err
 	}
 	defer portMS.Close()
+	defer closeOnCancel(ctx, portMS)()
 	deviceMS := ms1.NewDevice(portMS)
 	err = deviceMS.SetAddress(address)
 	if err != nil {
@@ -259,6 +311,60 @@ func (board *MS1) getFirmware(address string, logger chan any, RefBlChip string)
 	return b.Bytes(), err
 }
 
+// выгрузка прошивки платы по адресу, указанному для прошивки, для резервной копии
+func (board *MS1) Snapshot(ctx context.Context) ([]byte, error) {
+	if board.address == "" {
+		return nil, errors.New("для резервной копии прошивки МС-ТЮК необходимо указать адрес платы")
+	}
+	return board.getFirmware(ctx, board.address, nil, "")
+}
+
+// размер одного фрейма прошивки МС-ТЮК в байтах
+const ms1FrameSize = 128
+
+/*
+Сравнение прошивки МС-ТЮК по адресу address с файлом.
+
+Из устройства выгружается столько фреймов, сколько занимает файл, после чего они сравниваются с файлом побайтово.
+*/
+func (board *MS1) Verify(ctx context.Context, filePath string, logger chan any) (VerifyResult, error) {
+	if logger != nil {
+		defer close(logger)
+	}
+	return verifyExtracted(filePath, func() ([]byte, error) {
+		info, err := os.Stat(filePath)
+		if err != nil {
+			return nil, err
+		}
+		portMS, err := ms1.MkSerial(board.getFlashPort())
+		if err != nil {
+			return nil, err
+		}
+		defer portMS.Close()
+		defer closeOnCancel(ctx, portMS)()
+		deviceMS := ms1.NewDevice(portMS)
+		err = deviceMS.SetAddress(board.address)
+		if err != nil {
+			return nil, err
+		}
+		frames := (int(info.Size()) + ms1FrameSize - 1) / ms1FrameSize
+		var b bytes.Buffer
+		err = deviceMS.GetFirmware(&b, frames)
+		return b.Bytes(), err
+	})
+}
+
+/*
+Закрывает порт при отмене контекста ctx, из-за чего текущая операция ms1 завершится ошибкой чтения.
+
+Возвращает функцию, которую нужно вызвать после завершения операции.
+*/
+func closeOnCancel(ctx context.Context, port io.Closer) func() bool {
+	return context.AfterFunc(ctx, func() {
+		port.Close()
+	})
+}
+
 func collectLogs(deviceMS *ms1.Device, logger chan any) {
 	devLogger := deviceMS.ActivateLog()
 	go func() {
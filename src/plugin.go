@@ -0,0 +1,565 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Внешние плагины - программы, которые реализуют работу с устройствами определённого типа.
+
+Загрузчик запускает программу плагина и обменивается с ней сообщениями JSON-RPC 2.0 через stdin и stdout
+(одно сообщение - одна строка), описание протокола находится в README.md.
+*/
+
+// версия протокола, передаётся плагину в initialize
+const pluginProtocolVersion = 1
+
+// ID шаблона первого плагина, следующие плагины получают ID на единицу меньше (положительные ID заняты шаблонами из списка устройств, -1 и -2 - фальшивыми устройствами)
+const pluginTemplateIDBase = -100
+
+// максимальное время поиска устройств одним плагином
+const pluginDetectTimeout = 5 * time.Second
+
+// максимальное время запуска плагина (initialize)
+const pluginStartTimeout = 5 * time.Second
+
+// максимальный размер одного сообщения от плагина (выгруженная прошивка передаётся одним сообщением)
+const pluginMaxMessageSize = 64 * 1024 * 1024
+
+// количество сообщений о прогрессе, которые могут ожидать отправки клиенту, остальные отбрасываются
+const pluginProgressBuffer = 16
+
+// код ошибки JSON-RPC, означающий, что плагин не поддерживает метод
+const rpcMethodNotFound = -32601
+
+var errPluginStopped = errors.New("плагин завершил работу")
+
+// описание плагина (JSON-файл в папке pluginsPath)
+type PluginConfig struct {
+	// тип устройств, должен отличаться от встроенных типов и типов других плагинов
+	Type string `json:"type"`
+	// название устройств, если плагин не сообщил название при поиске
+	Name string `json:"name"`
+	// программа плагина и её аргументы, относительный путь к программе отсчитывается от папки с описанием плагина
+	Command            []string `json:"command"`
+	FlashFileExtension string   `json:"flashFileExtension"`
+	// true, если плагин прошивает устройство через порт, который может быть открыт монитором порта
+	FlashesThroughSerial bool                    `json:"flashesThroughSerial,omitempty"`
+	Timeouts             map[DeviceOperation]int `json:"timeouts,omitempty"`
+}
+
+type rpcRequest struct {
+	JSONRPC string `json:"jsonrpc"`
+	// nil для уведомлений
+	ID     *int64 `json:"id,omitempty"`
+	Method string `json:"method"`
+	Params any    `json:"params,omitempty"`
+}
+
+// сообщение от плагина: ответ на запрос (ID != nil) или уведомление (Method != "")
+type rpcMessage struct {
+	ID     *int64          `json:"id,omitempty"`
+	Method string          `json:"method,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (err *rpcError) Error() string {
+	return err.Message
+}
+
+// уведомление о прогрессе операции, Request - ID запроса, к которому относится прогресс
+type pluginProgress struct {
+	Request int64  `json:"request"`
+	Stage   string `json:"stage"`
+	Percent int    `json:"percent"`
+}
+
+// запрос, ожидающий ответа от плагина
+type pluginCall struct {
+	response chan rpcMessage
+	progress chan pluginProgress
+}
+
+type Plugin struct {
+	config PluginConfig
+	// папка с описанием плагина, в ней запускается программа плагина
+	dir      string
+	template BoardTemplate
+	// устройства из последнего успешного поиска, используется только в detect (обновления списка устройств выполняются по очереди)
+	lastFound []pluginDevice
+	// блокировка запуска процесса, чтобы плагин не запускался одновременно несколькими запросами
+	startMu sync.Mutex
+	// защищает все поля ниже
+	mu sync.Mutex
+	// nil, если процесс не запущен
+	stdin   io.WriteCloser
+	nextID  int64
+	pending map[int64]*pluginCall
+	// методы, которые поддерживает плагин, nil, если плагин не сообщил их в initialize
+	methods map[string]void
+}
+
+// путь к папке с плагинами по-умолчанию
+func defaultPluginsPath() string {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(configDir, "lapki-flasher", "plugins")
+}
+
+/*
+Чтение описаний плагинов из папки dir и регистрация их типов устройств.
+
+Ошибка в описании одного плагина не мешает загрузке остальных.
+*/
+func loadPlugins(dir string) {
+	if dir == "" {
+		return
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			printLog("Can't read plugins directory:", err.Error())
+		}
+		return
+	}
+	var files []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.EqualFold(filepath.Ext(entry.Name()), ".json") {
+			files = append(files, entry.Name())
+		}
+	}
+	sort.Strings(files)
+	templateID := pluginTemplateIDBase
+	for _, file := range files {
+		plugin, err := readPlugin(filepath.Join(dir, file), templateID)
+		if err != nil {
+			printLog("Error, wrong plugin", file, err.Error())
+			continue
+		}
+		registerBoardType(plugin.boardType())
+		printLog("Plugin", plugin.config.Type, "loaded from", file)
+		templateID--
+	}
+}
+
+func readPlugin(path string, templateID int) (*Plugin, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config PluginConfig
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return nil, err
+	}
+	if config.Type == "" {
+		return nil, errors.New("не указан тип устройств (type)")
+	}
+	if len(config.Command) == 0 {
+		return nil, errors.New("не указана программа плагина (command)")
+	}
+	if _, exists := findBoardType(config.Type); exists {
+		return nil, fmt.Errorf("тип устройств %s уже зарегистрирован", config.Type)
+	}
+	name := config.Name
+	if name == "" {
+		name = config.Type
+	}
+	return &Plugin{
+		config: config,
+		dir:    filepath.Dir(path),
+		template: BoardTemplate{
+			ID:                 templateID,
+			Name:               name,
+			PidVid:             []PidVidType{},
+			Type:               config.Type,
+			FlashFileExtension: config.FlashFileExtension,
+			Timeouts:           config.Timeouts,
+		},
+		pending: make(map[int64]*pluginCall),
+	}, nil
+}
+
+func (plugin *Plugin) boardType() *BoardType {
+	return &BoardType{
+		Name:      plugin.config.Type,
+		Detection: CustomDetection,
+		Detect:    plugin.detect,
+		Refresh: func(old *Device, found *Device) bool {
+			oldDevice := &old.Board.(*PluginBoard).device
+			newDevice := found.Board.(*PluginBoard).device
+			portChanged := oldDevice.PortName != newDevice.PortName
+			*oldDevice = newDevice
+			return portChanged
+		},
+		ProgressMsg:          FlashBacktrackMsg,
+		FlashesThroughSerial: plugin.config.FlashesThroughSerial,
+		Timeouts:             plugin.config.Timeouts,
+	}
+}
+
+// путь к программе плагина, относительный путь (кроме названия программы из PATH) отсчитывается от папки плагина
+func (plugin *Plugin) executable() string {
+	name := plugin.config.Command[0]
+	if !filepath.IsAbs(name) && strings.ContainsAny(name, `/\`) {
+		return filepath.Join(plugin.dir, name)
+	}
+	return name
+}
+
+// запуск процесса плагина, если он ещё не запущен (или завершился)
+func (plugin *Plugin) ensureStarted() error {
+	plugin.startMu.Lock()
+	defer plugin.startMu.Unlock()
+	plugin.mu.Lock()
+	running := plugin.stdin != nil
+	plugin.mu.Unlock()
+	if running {
+		return nil
+	}
+	cmd := exec.Command(plugin.executable(), plugin.config.Command[1:]...)
+	cmd.Dir = plugin.dir
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	printLog("Plugin", plugin.config.Type, "started, pid", cmd.Process.Pid)
+	plugin.mu.Lock()
+	plugin.stdin = stdin
+	plugin.methods = nil
+	plugin.mu.Unlock()
+	go plugin.readStderr(stderr)
+	go plugin.readLoop(stdout, stdin, cmd)
+
+	ctx, cancel := context.WithTimeout(context.Background(), pluginStartTimeout)
+	defer cancel()
+	err = plugin.initialize(ctx)
+	if err != nil {
+		cmd.Process.Kill()
+		return fmt.Errorf("не удалось запустить плагин %s: %w", plugin.config.Type, err)
+	}
+	return nil
+}
+
+type pluginInitializeResult struct {
+	Methods []string `json:"methods"`
+}
+
+// обмен версией протокола и получение списка поддерживаемых методов, плагин может не реализовывать initialize
+func (plugin *Plugin) initialize(ctx context.Context) error {
+	result, err := plugin.send(ctx, "initialize", map[string]int{"protocolVersion": pluginProtocolVersion}, nil)
+	var rpcErr *rpcError
+	if errors.As(err, &rpcErr) && rpcErr.Code == rpcMethodNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var initResult pluginInitializeResult
+	if err := json.Unmarshal(result, &initResult); err != nil {
+		return err
+	}
+	if initResult.Methods == nil {
+		return nil
+	}
+	methods := make(map[string]void)
+	for _, method := range initResult.Methods {
+		methods[method] = void{}
+	}
+	plugin.mu.Lock()
+	plugin.methods = methods
+	plugin.mu.Unlock()
+	return nil
+}
+
+// true, если плагин поддерживает метод method (или не сообщил список методов)
+func (plugin *Plugin) supports(method string) bool {
+	plugin.mu.Lock()
+	defer plugin.mu.Unlock()
+	if plugin.methods == nil {
+		return true
+	}
+	_, exists := plugin.methods[method]
+	return exists
+}
+
+// вывод плагина в stderr печатается в консоль
+func (plugin *Plugin) readStderr(stderr io.Reader) {
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		printLog("plugin", plugin.config.Type+":", scanner.Text())
+	}
+}
+
+// чтение сообщений от плагина до завершения его процесса, после чего все ожидающие запросы завершаются с ошибкой
+func (plugin *Plugin) readLoop(stdout io.Reader, stdin io.WriteCloser, cmd *exec.Cmd) {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), pluginMaxMessageSize)
+	for scanner.Scan() {
+		plugin.handleMessage(scanner.Bytes())
+	}
+	if err := scanner.Err(); err != nil {
+		printLog("plugin", plugin.config.Type+": can't read message:", err.Error())
+		cmd.Process.Kill()
+	}
+	err := cmd.Wait()
+	if err != nil {
+		printLog("Plugin", plugin.config.Type, "stopped:", err.Error())
+	} else {
+		printLog("Plugin", plugin.config.Type, "stopped")
+	}
+	plugin.mu.Lock()
+	if plugin.stdin == stdin {
+		plugin.stdin = nil
+	}
+	pending := plugin.pending
+	plugin.pending = make(map[int64]*pluginCall)
+	plugin.mu.Unlock()
+	for _, call := range pending {
+		call.response <- rpcMessage{Error: &rpcError{Message: errPluginStopped.Error()}}
+	}
+}
+
+func (plugin *Plugin) handleMessage(data []byte) {
+	var msg rpcMessage
+	err := json.Unmarshal(data, &msg)
+	if err != nil {
+		printLog("plugin", plugin.config.Type+": wrong message:", err.Error())
+		return
+	}
+	if msg.Method != "" {
+		plugin.handleNotification(msg)
+		return
+	}
+	if msg.ID == nil {
+		printLog("plugin", plugin.config.Type+": message without id and method")
+		return
+	}
+	plugin.mu.Lock()
+	call, exists := plugin.pending[*msg.ID]
+	delete(plugin.pending, *msg.ID)
+	plugin.mu.Unlock()
+	if !exists {
+		printLog("plugin", plugin.config.Type+": response to unknown request", *msg.ID)
+		return
+	}
+	call.response <- msg
+}
+
+func (plugin *Plugin) handleNotification(msg rpcMessage) {
+	switch msg.Method {
+	case "progress":
+		var progress pluginProgress
+		err := json.Unmarshal(msg.Params, &progress)
+		if err != nil {
+			printLog("plugin", plugin.config.Type+": wrong progress:", err.Error())
+			return
+		}
+		plugin.mu.Lock()
+		call, exists := plugin.pending[progress.Request]
+		plugin.mu.Unlock()
+		if !exists {
+			return
+		}
+		// прогресс не должен задерживать чтение ответов, поэтому при переполнении буфера сообщение отбрасывается
+		select {
+		case call.progress <- progress:
+		default:
+		}
+	default:
+		printLog("plugin", plugin.config.Type+": unknown notification", msg.Method)
+	}
+}
+
+func (plugin *Plugin) write(request rpcRequest) error {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	plugin.mu.Lock()
+	defer plugin.mu.Unlock()
+	if plugin.stdin == nil {
+		return errPluginStopped
+	}
+	_, err = plugin.stdin.Write(append(data, '\n'))
+	return err
+}
+
+/*
+Вызов метода плагина, плагин запускается, если он ещё не запущен.
+
+Прогресс операции отправляется в logger (если он не nil), при отмене контекста ctx плагину отправляется уведомление cancel.
+*/
+func (plugin *Plugin) call(ctx context.Context, method string, params any, logger chan any) (json.RawMessage, error) {
+	err := plugin.ensureStarted()
+	if err != nil {
+		return nil, err
+	}
+	return plugin.send(ctx, method, params, logger)
+}
+
+func (plugin *Plugin) send(ctx context.Context, method string, params any, logger chan any) (json.RawMessage, error) {
+	call := &pluginCall{
+		response: make(chan rpcMessage, 1),
+		progress: make(chan pluginProgress, pluginProgressBuffer),
+	}
+	plugin.mu.Lock()
+	plugin.nextID++
+	id := plugin.nextID
+	plugin.pending[id] = call
+	plugin.mu.Unlock()
+
+	err := plugin.write(rpcRequest{JSONRPC: "2.0", ID: &id, Method: method, Params: params})
+	if err != nil {
+		plugin.forget(id)
+		return nil, err
+	}
+	var reporter *progressReporter
+	report := func(progress pluginProgress) {
+		if logger == nil {
+			return
+		}
+		stage := progress.Stage
+		if stage == "" {
+			stage = WRITING_STAGE
+		}
+		if reporter == nil || reporter.stage != stage {
+			reporter = newProgressReporter(logger, stage)
+		}
+		reporter.report(min(max(progress.Percent, 0), 100), 100)
+	}
+	for {
+		select {
+		case progress := <-call.progress:
+			report(progress)
+		case msg := <-call.response:
+			// прогресс, пришедший до ответа, может ещё находиться в буфере
+			for len(call.progress) > 0 {
+				report(<-call.progress)
+			}
+			if msg.Error != nil {
+				return nil, msg.Error
+			}
+			return msg.Result, nil
+		case <-ctx.Done():
+			plugin.forget(id)
+			err := plugin.write(rpcRequest{JSONRPC: "2.0", Method: "cancel", Params: map[string]int64{"request": id}})
+			if err != nil {
+				printLog("plugin", plugin.config.Type+": can't cancel request:", err.Error())
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// true, если процесс плагина запущен
+func (plugin *Plugin) running() bool {
+	plugin.mu.Lock()
+	defer plugin.mu.Unlock()
+	return plugin.stdin != nil
+}
+
+// true, если плагин выполняет запросы
+func (plugin *Plugin) busy() bool {
+	plugin.mu.Lock()
+	defer plugin.mu.Unlock()
+	return plugin.stdin != nil && len(plugin.pending) > 0
+}
+
+func (plugin *Plugin) forget(id int64) {
+	plugin.mu.Lock()
+	delete(plugin.pending, id)
+	plugin.mu.Unlock()
+}
+
+// устройство, найденное плагином
+type pluginDevice struct {
+	// ID устройства, уникальный в пределах плагина
+	ID       string `json:"id"`
+	Name     string `json:"name,omitempty"`
+	PortName string `json:"portName,omitempty"`
+	SerialID string `json:"serialID,omitempty"`
+}
+
+/*
+Поиск устройств плагином, к ID устройств добавляется тип плагина, чтобы они не совпадали с ID устройств других типов;
+шаблоны из списка устройств не используются, у устройств плагина собственный шаблон.
+
+Пока плагин выполняет другой запрос (например, прошивку), поиск не запрашивается, а если плагин не ответил
+или ответил неправильно, то возвращаются устройства из последнего успешного поиска,
+чтобы они не удалялись из списка посреди прошивки. Если процесс плагина завершился, то устройства удаляются.
+*/
+func (plugin *Plugin) detect(_ []BoardTemplate) map[string]*Device {
+	if plugin.busy() {
+		return plugin.devices(plugin.lastFound)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pluginDetectTimeout)
+	defer cancel()
+	result, err := plugin.call(ctx, "detect", nil, nil)
+	if err != nil {
+		if !plugin.running() {
+			printLog("plugin", plugin.config.Type+": detection failed:", err.Error())
+			plugin.lastFound = nil
+			return nil
+		}
+		printLog("plugin", plugin.config.Type+": detection failed, previous devices are kept:", err.Error())
+		return plugin.devices(plugin.lastFound)
+	}
+	var found []pluginDevice
+	err = json.Unmarshal(result, &found)
+	if err != nil {
+		printLog("plugin", plugin.config.Type+": wrong detection result, previous devices are kept:", err.Error())
+		return plugin.devices(plugin.lastFound)
+	}
+	plugin.lastFound = found
+	return plugin.devices(found)
+}
+
+// устройства плагина, найденные поиском
+func (plugin *Plugin) devices(found []pluginDevice) map[string]*Device {
+	devs := make(map[string]*Device)
+	for _, device := range found {
+		if device.ID == "" {
+			printLog("plugin", plugin.config.Type+": device without id")
+			continue
+		}
+		devs[plugin.config.Type+":"+device.ID] = newDevice(plugin.template, &PluginBoard{
+			plugin: plugin,
+			device: device,
+		})
+	}
+	return devs
+}
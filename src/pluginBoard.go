@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// устройство, работа с которым выполняется внешним плагином (см. plugin.go)
+type PluginBoard struct {
+	plugin *Plugin
+	device pluginDevice
+}
+
+// параметры всех методов плагина, относящихся к устройству
+type pluginDeviceParams struct {
+	DeviceID string `json:"deviceID"`
+	// путь к файлу прошивки, только для flash
+	File string `json:"file,omitempty"`
+}
+
+type pluginFlashResult struct {
+	Message string `json:"message"`
+}
+
+type pluginFirmwareResult struct {
+	// прошивка в base64
+	Data []byte `json:"data"`
+}
+
+// методы плагина, соответствующие операциям с устройством
+var pluginMethods = map[DeviceOperation]string{
+	FlashOperation:   "flash",
+	PingOperation:    "ping",
+	ResetOperation:   "reset",
+	MetaOperation:    "metadata",
+	ExtractOperation: "readFirmware",
+}
+
+func (board *PluginBoard) params() pluginDeviceParams {
+	return pluginDeviceParams{DeviceID: board.device.ID}
+}
+
+// устройство считается подключённым, пока плагин находит его при поиске
+func (board *PluginBoard) IsConnected() bool {
+	return true
+}
+
+func (board *PluginBoard) GetSerialPort() string {
+	return board.device.PortName
+}
+
+// прогресс прошивки отправляется в logger, после завершения прошивки logger закрывается
+func (board *PluginBoard) Flash(ctx context.Context, filePath string, logger chan any) (string, error) {
+	if logger != nil {
+		defer close(logger)
+	}
+	params := board.params()
+	params.File = getAbolutePath(filePath)
+	result, err := board.plugin.call(ctx, pluginMethods[FlashOperation], params, logger)
+	if err != nil {
+		return err.Error(), err
+	}
+	var flashResult pluginFlashResult
+	if len(result) > 0 {
+		err = json.Unmarshal(result, &flashResult)
+		if err != nil {
+			return "", fmt.Errorf("некорректный ответ плагина: %w", err)
+		}
+	}
+	return flashResult.Message, nil
+}
+
+func (board *PluginBoard) FlashPlan(filePath string) []string {
+	command := board.plugin.config.Command
+	return []string{
+		fmt.Sprintf("прошивка плагином %s: %s", board.plugin.config.Type, formatCommand(board.plugin.executable(), command[1:])),
+	}
+}
+
+// данные устройства обновляются при каждом поиске (см. Refresh в plugin.go)
+func (board *PluginBoard) Update() bool {
+	return false
+}
+
+func (board *PluginBoard) GetWebMessageType() string {
+	return DeviceMsg
+}
+
+func (board *PluginBoard) GetWebMessage(name string, deviceID string) any {
+	if board.device.Name != "" {
+		name = board.device.Name
+	}
+	return DeviceMessage{
+		ID:           deviceID,
+		Name:         name,
+		SerialID:     board.device.SerialID,
+		PortName:     board.device.PortName,
+		LastFirmware: deviceHistory.Last(deviceID),
+	}
+}
+
+func (board *PluginBoard) Ping(ctx context.Context) error {
+	_, err := board.plugin.call(ctx, pluginMethods[PingOperation], board.params(), nil)
+	return err
+}
+
+func (board *PluginBoard) Reset(ctx context.Context) error {
+	_, err := board.plugin.call(ctx, pluginMethods[ResetOperation], board.params(), nil)
+	return err
+}
+
+// метаданные передаются клиенту в том виде, в котором их вернул плагин
+func (board *PluginBoard) GetMetaData(ctx context.Context) (any, error) {
+	result, err := board.plugin.call(ctx, pluginMethods[MetaOperation], board.params(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// операция доступна, если плагин сообщил о поддержке соответствующего метода в initialize
+func (board *PluginBoard) Supports(op DeviceOperation) bool {
+	method, exists := pluginMethods[op]
+	if !exists {
+		return true
+	}
+	return board.plugin.supports(method)
+}
+
+func (board *PluginBoard) Extract(ctx context.Context) ([]byte, error) {
+	result, err := board.plugin.call(ctx, pluginMethods[ExtractOperation], board.params(), nil)
+	if err != nil {
+		return nil, err
+	}
+	var firmware pluginFirmwareResult
+	err = json.Unmarshal(result, &firmware)
+	if err != nil {
+		return nil, fmt.Errorf("некорректный ответ плагина: %w", err)
+	}
+	if len(firmware.Data) == 0 {
+		return nil, errors.New("плагин вернул пустую прошивку")
+	}
+	return firmware.Data, nil
+}
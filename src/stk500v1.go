@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/albenik/go-serial/v2"
+)
+
+// команды и ответы протокола STK500 версии 1 (загрузчики Optiboot и ATmegaBOOT)
+const (
+	STK_OK             = 0x10
+	STK_FAILED         = 0x11
+	STK_INSYNC         = 0x14
+	STK_NOSYNC         = 0x15
+	CRC_EOP            = 0x20
+	STK_GET_SYNC       = 0x30
+	STK_ENTER_PROGMODE = 0x50
+	STK_LEAVE_PROGMODE = 0x51
+	STK_LOAD_ADDRESS   = 0x55
+	STK_PROG_PAGE      = 0x64
+	STK_READ_PAGE      = 0x74
+	STK_READ_SIGN      = 0x75
+)
+
+// скорость по-умолчанию для Optiboot (Arduino Uno)
+const stk500v1DefaultBaud = 115200
+
+// количество попыток синхронизации с загрузчиком после перезагрузки
+const stk500v1SyncAttempts = 10
+
+// максимальное время ожидания ответа на одну команду
+const stk500v1Timeout = 1 * time.Second
+
+// STK500v1 адресует flash-память словами по 16-битному адресу
+const stk500v1MaxAddress = 0x20000
+
+var errSTK500v1NoSync = errors.New("загрузчик не отвечает (нет синхронизации)")
+
+// соединение с загрузчиком по протоколу STK500v1
+type stk500v1 struct {
+	port avrPort
+}
+
+/*
+Открытие порта, перезагрузка устройства через DTR/RTS (как это делает avrdude для программатора arduino),
+синхронизация с загрузчиком и вход в режим программирования.
+*/
+func openSTK500v1(ctx context.Context, portName string, baud int) (*stk500v1, error) {
+	if baud <= 0 {
+		baud = stk500v1DefaultBaud
+	}
+	port, err := serial.Open(
+		portName,
+		serial.WithBaudrate(baud),
+		serial.WithReadTimeout(50),
+		serial.WithWriteTimeout(int(stk500v1Timeout.Milliseconds())),
+	)
+	if err != nil {
+		return nil, err
+	}
+	resetToBootloader(port)
+	return startSTK500v1(ctx, port)
+}
+
+// синхронизация с загрузчиком, который уже запущен на порту port, и вход в режим программирования, при ошибке порт закрывается
+func startSTK500v1(ctx context.Context, port avrPort) (*stk500v1, error) {
+	programmer := &stk500v1{port: port}
+	err := programmer.sync(ctx)
+	if err != nil {
+		port.Close()
+		return nil, err
+	}
+	_, err = programmer.command([]byte{STK_ENTER_PROGMODE}, 0)
+	if err != nil {
+		port.Close()
+		return nil, fmt.Errorf("не удалось войти в режим программирования: %w", err)
+	}
+	return programmer, nil
+}
+
+/*
+Перезагрузка устройства в загрузчик через DTR/RTS (Arduino Uno, Mega).
+
+Ошибки игнорируются, так как не все порты поддерживают управление линиями.
+*/
+func resetToBootloader(port *serial.Port) {
+	if err := port.SetDTR(false); err != nil {
+		printLog("reset: can't set DTR:", err.Error())
+	}
+	port.SetRTS(false)
+	time.Sleep(250 * time.Millisecond)
+	port.SetDTR(true)
+	port.SetRTS(true)
+	time.Sleep(50 * time.Millisecond)
+	port.ResetInputBuffer()
+}
+
+func (programmer *stk500v1) sync(ctx context.Context) error {
+	for i := 0; i < stk500v1SyncAttempts; i++ {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		_, err := programmer.command([]byte{STK_GET_SYNC}, 0)
+		if err == nil {
+			return nil
+		}
+		printLog("stk500v1: sync attempt", i+1, err.Error())
+		programmer.port.ResetInputBuffer()
+	}
+	return errSTK500v1NoSync
+}
+
+/*
+Отправка команды (CRC_EOP добавляется автоматически) и чтение ответа.
+
+Ответ загрузчика имеет вид STK_INSYNC, responseSize байт данных, STK_OK, возвращаются только данные.
+*/
+func (programmer *stk500v1) command(cmd []byte, responseSize int) ([]byte, error) {
+	_, err := programmer.port.Write(append(cmd, CRC_EOP))
+	if err != nil {
+		return nil, err
+	}
+	response, err := readExactly(programmer.port, responseSize+2, stk500v1Timeout)
+	if err != nil {
+		return nil, err
+	}
+	if response[0] != STK_INSYNC {
+		return nil, errSTK500v1NoSync
+	}
+	switch response[len(response)-1] {
+	case STK_OK:
+		return response[1 : len(response)-1], nil
+	case STK_FAILED:
+		return nil, errors.New("загрузчик не смог выполнить команду")
+	}
+	return nil, fmt.Errorf("неожиданный ответ загрузчика: 0x%02x", response[len(response)-1])
+}
+
+func (programmer *stk500v1) readSignature() ([3]byte, error) {
+	var signature [3]byte
+	response, err := programmer.command([]byte{STK_READ_SIGN}, 3)
+	if err != nil {
+		return signature, err
+	}
+	copy(signature[:], response)
+	return signature, nil
+}
+
+func (programmer *stk500v1) loadAddress(address int) error {
+	if address >= stk500v1MaxAddress {
+		return fmt.Errorf("адрес 0x%x недоступен в протоколе STK500v1", address)
+	}
+	word := address / 2
+	_, err := programmer.command([]byte{STK_LOAD_ADDRESS, byte(word), byte(word >> 8)}, 0)
+	return err
+}
+
+func (programmer *stk500v1) writePage(address int, data []byte) error {
+	err := programmer.loadAddress(address)
+	if err != nil {
+		return err
+	}
+	cmd := append([]byte{STK_PROG_PAGE, byte(len(data) >> 8), byte(len(data)), 'F'}, data...)
+	_, err = programmer.command(cmd, 0)
+	return err
+}
+
+func (programmer *stk500v1) readPage(address int, size int) ([]byte, error) {
+	err := programmer.loadAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	return programmer.command([]byte{STK_READ_PAGE, byte(size >> 8), byte(size), 'F'}, size)
+}
+
+// выход из режима программирования, после чего Optiboot запускает записанную программу
+func (programmer *stk500v1) close() error {
+	_, err := programmer.command([]byte{STK_LEAVE_PROGMODE}, 0)
+	if err != nil {
+		printLog("stk500v1: can't leave programming mode:", err.Error())
+	}
+	return programmer.port.Close()
+}
+
+/*
+Чтение ровно size байт из порта, ошибка, если данные не пришли за timeout.
+
+Порт должен возвращать управление из Read, даже если данных нет (таймаут чтения последовательного порта).
+*/
+func readExactly(port io.Reader, size int, timeout time.Duration) ([]byte, error) {
+	buffer := make([]byte, size)
+	read := 0
+	deadline := time.Now().Add(timeout)
+	for read < size {
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("превышено время ожидания ответа (получено %d байт из %d)", read, size)
+		}
+		n, err := port.Read(buffer[read:])
+		if err != nil {
+			return nil, err
+		}
+		read += n
+	}
+	return buffer, nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+/*
+Порт с эмулятором загрузчика вместо устройства: данные, записанные в порт, разбираются функцией handle,
+а её ответы возвращаются из Read. Если ответа нет, то Read возвращает 0 байт, как последовательный порт по таймауту.
+*/
+type emulatedPort struct {
+	// разбор команды в начале input, возвращает ответ и количество байтов команды (0, если команда получена не полностью)
+	handle func(input []byte) (answer []byte, used int)
+	input  []byte
+	output []byte
+	closed bool
+}
+
+func (port *emulatedPort) Write(data []byte) (int, error) {
+	if port.closed {
+		return 0, errors.New("порт закрыт")
+	}
+	port.input = append(port.input, data...)
+	for len(port.input) > 0 {
+		answer, used := port.handle(port.input)
+		if used == 0 {
+			break
+		}
+		port.output = append(port.output, answer...)
+		port.input = port.input[used:]
+	}
+	return len(data), nil
+}
+
+func (port *emulatedPort) Read(buffer []byte) (int, error) {
+	if port.closed {
+		return 0, errors.New("порт закрыт")
+	}
+	n := copy(buffer, port.output)
+	port.output = port.output[n:]
+	return n, nil
+}
+
+func (port *emulatedPort) ResetInputBuffer() error {
+	port.output = nil
+	return nil
+}
+
+func (port *emulatedPort) Close() error {
+	port.closed = true
+	return nil
+}
+
+// flash-память эмулируемого контроллера, заполненная значением стёртой памяти
+func erasedFlash(part avrPart) []byte {
+	return bytes.Repeat([]byte{0xFF}, part.flashSize)
+}
+
+// прошивка из двух участков, второй начинается не с начала страницы
+func testAVRImage() *FirmwareImage {
+	code := make([]byte, 300)
+	for i := range code {
+		code[i] = byte(i * 7)
+	}
+	return &FirmwareImage{Segments: []MemorySegment{
+		{Address: 0, Data: code},
+		{Address: 0x1010, Data: []byte{0xDE, 0xAD, 0xBE, 0xEF}},
+	}}
+}
+
+// проверка того, что flash-память эмулятора содержит образ, а остальные байты не изменились
+func checkAVRFlash(t *testing.T, flash []byte, image *FirmwareImage) {
+	t.Helper()
+	for address, got := range flash {
+		want, inImage := image.byteAt(uint32(address))
+		if !inImage {
+			want = 0xFF
+		}
+		if got != want {
+			t.Fatalf("байт по адресу 0x%04x равен 0x%02x, ожидалось 0x%02x", address, got, want)
+		}
+	}
+}
+
+// Optiboot: отвечает STK_INSYNC, данные и STK_OK на каждую команду, завершённую CRC_EOP
+type stk500v1Emulator struct {
+	emulatedPort
+	signature [3]byte
+	flash     []byte
+	address   int
+	progMode  bool
+	// ответ STK_NOSYNC вместо STK_INSYNC на все команды
+	noSync bool
+	// ответ STK_FAILED на запись страницы
+	failWrite bool
+}
+
+func newSTK500v1Emulator(part avrPart) *stk500v1Emulator {
+	emulator := &stk500v1Emulator{signature: part.signature, flash: erasedFlash(part)}
+	emulator.handle = emulator.command
+	return emulator
+}
+
+func (emulator *stk500v1Emulator) command(input []byte) ([]byte, int) {
+	size := 2
+	switch input[0] {
+	case STK_LOAD_ADDRESS:
+		size += 2
+	case STK_READ_PAGE:
+		size += 3
+	case STK_PROG_PAGE:
+		if len(input) < 3 {
+			return nil, 0
+		}
+		size += 3 + (int(input[1])<<8 | int(input[2]))
+	}
+	if len(input) < size {
+		return nil, 0
+	}
+	args := input[1 : size-1]
+	var data []byte
+	status := byte(STK_OK)
+	switch input[0] {
+	case STK_GET_SYNC:
+	case STK_ENTER_PROGMODE:
+		emulator.progMode = true
+	case STK_LEAVE_PROGMODE:
+		emulator.progMode = false
+	case STK_READ_SIGN:
+		data = emulator.signature[:]
+	case STK_LOAD_ADDRESS:
+		emulator.address = 2 * (int(args[0]) | int(args[1])<<8)
+	case STK_PROG_PAGE:
+		if emulator.failWrite {
+			status = STK_FAILED
+			break
+		}
+		copy(emulator.flash[emulator.address:], args[3:])
+	case STK_READ_PAGE:
+		data = emulator.flash[emulator.address : emulator.address+(int(args[0])<<8|int(args[1]))]
+	default:
+		status = STK_FAILED
+	}
+	sync := byte(STK_INSYNC)
+	if input[size-1] != CRC_EOP || emulator.noSync {
+		sync = STK_NOSYNC
+	}
+	answer := append([]byte{sync}, data...)
+	return append(answer, status), size
+}
+
+func TestSTK500v1Flash(t *testing.T) {
+	emulator := newSTK500v1Emulator(atmega328p)
+	programmer, err := startSTK500v1(context.Background(), emulator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !emulator.progMode {
+		t.Fatal("загрузчик не переведён в режим программирования")
+	}
+	image := testAVRImage()
+	msg, err := programFlash(context.Background(), programmer, atmega328p, image, nil)
+	if err != nil {
+		t.Fatal(msg)
+	}
+	checkAVRFlash(t, emulator.flash, image)
+	flash, err := readFlash(context.Background(), programmer, atmega328p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(flash, emulator.flash) {
+		t.Fatal("прочитанная flash-память не совпадает с памятью загрузчика")
+	}
+	if err := programmer.close(); err != nil {
+		t.Fatal(err)
+	}
+	if emulator.progMode || !emulator.closed {
+		t.Fatal("загрузчик не выведен из режима программирования или порт не закрыт")
+	}
+}
+
+func TestSTK500v1Errors(t *testing.T) {
+	t.Run("нет синхронизации", func(t *testing.T) {
+		emulator := newSTK500v1Emulator(atmega328p)
+		emulator.noSync = true
+		_, err := startSTK500v1(context.Background(), emulator)
+		if !errors.Is(err, errSTK500v1NoSync) {
+			t.Fatalf("ошибка %v, ожидалось %v", err, errSTK500v1NoSync)
+		}
+		if !emulator.closed {
+			t.Fatal("порт не закрыт после ошибки")
+		}
+	})
+	t.Run("ошибка записи страницы", func(t *testing.T) {
+		emulator := newSTK500v1Emulator(atmega328p)
+		emulator.failWrite = true
+		programmer := &stk500v1{port: emulator}
+		msg, err := programFlash(context.Background(), programmer, atmega328p, testAVRImage(), nil)
+		if err == nil || !strings.Contains(msg, "ошибка записи страницы 0x0000") {
+			t.Fatalf("сообщение %q, ошибка %v", msg, err)
+		}
+	})
+	t.Run("другой контроллер", func(t *testing.T) {
+		programmer := &stk500v1{port: newSTK500v1Emulator(atmega168)}
+		msg, err := programFlash(context.Background(), programmer, atmega328p, testAVRImage(), nil)
+		if err == nil || !strings.Contains(msg, "сигнатура контроллера") {
+			t.Fatalf("сообщение %q, ошибка %v", msg, err)
+		}
+	})
+	t.Run("адрес вне 16-битного адреса слова", func(t *testing.T) {
+		programmer := &stk500v1{port: newSTK500v1Emulator(atmega2560)}
+		if err := programmer.writePage(stk500v1MaxAddress, make([]byte, 256)); err == nil {
+			t.Fatal("ожидалась ошибка")
+		}
+	})
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/albenik/go-serial/v2"
+)
+
+// команды и ответы протокола STK500 версии 2 (загрузчик wiring, Arduino Mega)
+const (
+	STK2_MESSAGE_START = 0x1B
+	STK2_TOKEN         = 0x0E
+
+	STK2_CMD_SIGN_ON            = 0x01
+	STK2_CMD_LOAD_ADDRESS       = 0x06
+	STK2_CMD_ENTER_PROGMODE_ISP = 0x10
+	STK2_CMD_LEAVE_PROGMODE_ISP = 0x11
+	STK2_CMD_PROGRAM_FLASH_ISP  = 0x13
+	STK2_CMD_READ_FLASH_ISP     = 0x14
+	STK2_CMD_READ_SIGNATURE_ISP = 0x1B
+
+	STK2_STATUS_CMD_OK = 0x00
+)
+
+// скорость по-умолчанию для загрузчика Arduino Mega
+const stk500v2DefaultBaud = 115200
+
+// количество попыток подключения к загрузчику после перезагрузки
+const stk500v2SignOnAttempts = 10
+
+// максимальное время ожидания ответа на одну команду
+const stk500v2Timeout = 1 * time.Second
+
+// адрес, начиная с которого для загрузки адреса нужен расширенный байт (адрес слова больше 16 бит)
+const stk500v2ExtendedAddress = 0x20000
+
+// флаг расширенного адреса в CMD_LOAD_ADDRESS
+const stk500v2ExtendedAddressFlag = 0x80000000
+
+var errSTK500v2NoSync = errors.New("загрузчик не отвечает на CMD_SIGN_ON")
+
+/*
+Параметры входа в режим программирования (CMD_ENTER_PROGMODE_ISP) из описания atmega2560 в avrdude.conf:
+timeout, stabDelay, cmdexeDelay, synchLoops, byteDelay, pollValue, pollIndex и SPI-команда Programming Enable.
+
+Загрузчик игнорирует эти параметры, но ожидает команду полной длины.
+*/
+var stk500v2EnterProgmode = []byte{STK2_CMD_ENTER_PROGMODE_ISP, 200, 100, 25, 32, 0, 0x53, 3, 0xAC, 0x53, 0x00, 0x00}
+
+// соединение с загрузчиком по протоколу STK500v2
+type stk500v2 struct {
+	port avrPort
+	// номер последнего отправленного сообщения, ответ должен иметь тот же номер
+	sequence byte
+	// true, если уже использовался расширенный адрес, после этого он указывается во всех командах
+	extended bool
+}
+
+/*
+Открытие порта, перезагрузка устройства через DTR/RTS, подключение к загрузчику и вход в режим программирования.
+*/
+func openSTK500v2(ctx context.Context, portName string, baud int) (*stk500v2, error) {
+	if baud <= 0 {
+		baud = stk500v2DefaultBaud
+	}
+	port, err := serial.Open(
+		portName,
+		serial.WithBaudrate(baud),
+		serial.WithReadTimeout(50),
+		serial.WithWriteTimeout(int(stk500v2Timeout.Milliseconds())),
+	)
+	if err != nil {
+		return nil, err
+	}
+	resetToBootloader(port)
+	return startSTK500v2(ctx, port)
+}
+
+// подключение к загрузчику, который уже запущен на порту port, и вход в режим программирования, при ошибке порт закрывается
+func startSTK500v2(ctx context.Context, port avrPort) (*stk500v2, error) {
+	programmer := &stk500v2{port: port}
+	err := programmer.signOn(ctx)
+	if err != nil {
+		port.Close()
+		return nil, err
+	}
+	_, err = programmer.command(stk500v2EnterProgmode)
+	if err != nil {
+		port.Close()
+		return nil, fmt.Errorf("не удалось войти в режим программирования: %w", err)
+	}
+	return programmer, nil
+}
+
+func (programmer *stk500v2) signOn(ctx context.Context) error {
+	for i := 0; i < stk500v2SignOnAttempts; i++ {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		answer, err := programmer.command([]byte{STK2_CMD_SIGN_ON})
+		if err == nil {
+			// после статуса идёт длина и название программатора
+			if len(answer) > 1 {
+				printLog("stk500v2: bootloader", string(answer[1:]))
+			}
+			return nil
+		}
+		printLog("stk500v2: sign on attempt", i+1, err.Error())
+		programmer.port.ResetInputBuffer()
+	}
+	return errSTK500v2NoSync
+}
+
+/*
+Отправка команды и чтение ответа.
+
+Сообщение имеет вид MESSAGE_START, номер сообщения, размер тела (2 байта), TOKEN, тело, контрольная сумма (XOR всех байтов).
+Возвращает тело ответа без кода команды и статуса.
+*/
+func (programmer *stk500v2) command(body []byte) ([]byte, error) {
+	programmer.sequence++
+	message := []byte{STK2_MESSAGE_START, programmer.sequence, byte(len(body) >> 8), byte(len(body)), STK2_TOKEN}
+	message = append(message, body...)
+	message = append(message, stk500v2Checksum(message))
+	_, err := programmer.port.Write(message)
+	if err != nil {
+		return nil, err
+	}
+	answer, err := programmer.readAnswer()
+	if err != nil {
+		return nil, err
+	}
+	if len(answer) < 2 || answer[0] != body[0] {
+		return nil, fmt.Errorf("неожиданный ответ загрузчика на команду 0x%02x", body[0])
+	}
+	if answer[1] != STK2_STATUS_CMD_OK {
+		return nil, fmt.Errorf("загрузчик не смог выполнить команду 0x%02x (статус 0x%02x)", body[0], answer[1])
+	}
+	return answer[2:], nil
+}
+
+// чтение ответного сообщения, проверка номера и контрольной суммы
+func (programmer *stk500v2) readAnswer() ([]byte, error) {
+	header, err := readExactly(programmer.port, 5, stk500v2Timeout)
+	if err != nil {
+		return nil, err
+	}
+	if header[0] != STK2_MESSAGE_START || header[4] != STK2_TOKEN {
+		return nil, fmt.Errorf("некорректный заголовок ответа: 0x%X", header)
+	}
+	if header[1] != programmer.sequence {
+		return nil, fmt.Errorf("номер ответа %d не совпадает с номером команды %d", header[1], programmer.sequence)
+	}
+	size := int(header[2])<<8 | int(header[3])
+	rest, err := readExactly(programmer.port, size+1, stk500v2Timeout)
+	if err != nil {
+		return nil, err
+	}
+	body := rest[:size]
+	if stk500v2Checksum(append(header, body...)) != rest[size] {
+		return nil, errors.New("неверная контрольная сумма ответа")
+	}
+	return body, nil
+}
+
+func stk500v2Checksum(data []byte) byte {
+	var checksum byte
+	for _, b := range data {
+		checksum ^= b
+	}
+	return checksum
+}
+
+// сигнатура читается по одному байту SPI-командой Read Signature Byte
+func (programmer *stk500v2) readSignature() ([3]byte, error) {
+	var signature [3]byte
+	for i := range signature {
+		answer, err := programmer.command([]byte{STK2_CMD_READ_SIGNATURE_ISP, 4, 0x30, 0x00, byte(i), 0x00})
+		if err != nil {
+			return signature, err
+		}
+		if len(answer) < 1 {
+			return signature, errors.New("пустой ответ на чтение сигнатуры")
+		}
+		signature[i] = answer[0]
+	}
+	return signature, nil
+}
+
+// адрес flash-памяти передаётся в словах
+func (programmer *stk500v2) loadAddress(address int) error {
+	word := uint32(address / 2)
+	if address >= stk500v2ExtendedAddress {
+		programmer.extended = true
+	}
+	if programmer.extended {
+		word |= stk500v2ExtendedAddressFlag
+	}
+	_, err := programmer.command([]byte{STK2_CMD_LOAD_ADDRESS, byte(word >> 24), byte(word >> 16), byte(word >> 8), byte(word)})
+	return err
+}
+
+/*
+Запись страницы в страничном режиме (mode 0xC1: запись страницы после загрузки данных).
+
+Остальные параметры - задержка и SPI-команды Load Program Memory Page, Write Program Memory Page, Read Program Memory,
+загрузчик их игнорирует.
+*/
+func (programmer *stk500v2) writePage(address int, data []byte) error {
+	err := programmer.loadAddress(address)
+	if err != nil {
+		return err
+	}
+	cmd := []byte{STK2_CMD_PROGRAM_FLASH_ISP, byte(len(data) >> 8), byte(len(data)), 0xC1, 10, 0x40, 0x4C, 0x20, 0x00, 0x00}
+	_, err = programmer.command(append(cmd, data...))
+	return err
+}
+
+func (programmer *stk500v2) readPage(address int, size int) ([]byte, error) {
+	err := programmer.loadAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	answer, err := programmer.command([]byte{STK2_CMD_READ_FLASH_ISP, byte(size >> 8), byte(size), 0x20})
+	if err != nil {
+		return nil, err
+	}
+	// после данных идёт ещё один статус
+	if len(answer) != size+1 {
+		return nil, fmt.Errorf("загрузчик вернул %d байт вместо %d", len(answer)-1, size)
+	}
+	return answer[:size], nil
+}
+
+// выход из режима программирования, после чего загрузчик запускает записанную программу
+func (programmer *stk500v2) close() error {
+	_, err := programmer.command([]byte{STK2_CMD_LEAVE_PROGMODE_ISP, 1, 1})
+	if err != nil {
+		printLog("stk500v2: can't leave programming mode:", err.Error())
+	}
+	return programmer.port.Close()
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// ответ загрузчика на сообщение с неверной контрольной суммой
+const (
+	STK2_ANSWER_CKSUM_ERROR = 0xB0
+	STK2_STATUS_CKSUM_ERROR = 0xC1
+	STK2_STATUS_CMD_FAILED  = 0xC0
+)
+
+/*
+Загрузчик Arduino Mega (wiring): проверяет контрольную сумму каждого сообщения и отвечает сообщением с тем же номером.
+*/
+type stk500v2Emulator struct {
+	emulatedPort
+	signature [3]byte
+	flash     []byte
+	address   int
+	progMode  bool
+	// значения CMD_LOAD_ADDRESS в порядке получения
+	loadedAddresses []uint32
+	// статус STK2_STATUS_CMD_FAILED на запись страницы
+	failWrite bool
+	// ответы с испорченной контрольной суммой
+	corruptAnswers bool
+	// все сообщения считаются полученными с неверной контрольной суммой (помехи на линии)
+	rejectMessages bool
+	// ответы с номером, который не совпадает с номером сообщения
+	wrongSequence bool
+}
+
+func newSTK500v2Emulator(part avrPart) *stk500v2Emulator {
+	emulator := &stk500v2Emulator{signature: part.signature, flash: erasedFlash(part)}
+	emulator.handle = emulator.message
+	return emulator
+}
+
+func (emulator *stk500v2Emulator) message(input []byte) ([]byte, int) {
+	if input[0] != STK2_MESSAGE_START {
+		// байты вне сообщения пропускаются
+		return nil, 1
+	}
+	if len(input) < 5 {
+		return nil, 0
+	}
+	size := 5 + (int(input[2])<<8 | int(input[3])) + 1
+	if len(input) < size {
+		return nil, 0
+	}
+	sequence := input[1]
+	if emulator.wrongSequence {
+		sequence++
+	}
+	var answer []byte
+	if input[4] != STK2_TOKEN || stk500v2Checksum(input[:size-1]) != input[size-1] || emulator.rejectMessages {
+		answer = []byte{STK2_ANSWER_CKSUM_ERROR, STK2_STATUS_CKSUM_ERROR}
+	} else {
+		answer = emulator.command(input[5 : size-1])
+	}
+	frame := []byte{STK2_MESSAGE_START, sequence, byte(len(answer) >> 8), byte(len(answer)), STK2_TOKEN}
+	frame = append(frame, answer...)
+	checksum := stk500v2Checksum(frame)
+	if emulator.corruptAnswers {
+		checksum ^= 0xFF
+	}
+	return append(frame, checksum), size
+}
+
+// выполнение команды, возвращает тело ответа
+func (emulator *stk500v2Emulator) command(body []byte) []byte {
+	ok := []byte{body[0], STK2_STATUS_CMD_OK}
+	switch body[0] {
+	case STK2_CMD_SIGN_ON:
+		return append(ok, append([]byte{8}, "AVRISP_2"...)...)
+	case STK2_CMD_ENTER_PROGMODE_ISP:
+		emulator.progMode = true
+	case STK2_CMD_LEAVE_PROGMODE_ISP:
+		emulator.progMode = false
+	case STK2_CMD_READ_SIGNATURE_ISP:
+		return append(ok, emulator.signature[body[4]], STK2_STATUS_CMD_OK)
+	case STK2_CMD_LOAD_ADDRESS:
+		word := uint32(body[1])<<24 | uint32(body[2])<<16 | uint32(body[3])<<8 | uint32(body[4])
+		emulator.loadedAddresses = append(emulator.loadedAddresses, word)
+		emulator.address = int(word&^stk500v2ExtendedAddressFlag) * 2
+	case STK2_CMD_PROGRAM_FLASH_ISP:
+		if emulator.failWrite {
+			return []byte{body[0], STK2_STATUS_CMD_FAILED}
+		}
+		data := body[10:]
+		copy(emulator.flash[emulator.address:], data)
+		emulator.address += len(data)
+	case STK2_CMD_READ_FLASH_ISP:
+		length := int(body[1])<<8 | int(body[2])
+		ok = append(ok, emulator.flash[emulator.address:emulator.address+length]...)
+		emulator.address += length
+		return append(ok, STK2_STATUS_CMD_OK)
+	default:
+		return []byte{body[0], STK2_STATUS_CMD_FAILED}
+	}
+	return ok
+}
+
+func TestSTK500v2Flash(t *testing.T) {
+	emulator := newSTK500v2Emulator(atmega2560)
+	programmer, err := startSTK500v2(context.Background(), emulator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !emulator.progMode {
+		t.Fatal("загрузчик не переведён в режим программирования")
+	}
+	image := testAVRImage()
+	// участок выше 128 КБ записывается с расширенным адресом
+	image.Segments = append(image.Segments, MemorySegment{Address: 0x20100, Data: []byte{1, 2, 3}})
+	msg, err := programFlash(context.Background(), programmer, atmega2560, image, nil)
+	if err != nil {
+		t.Fatal(msg)
+	}
+	checkAVRFlash(t, emulator.flash, image)
+	extended := slices.IndexFunc(emulator.loadedAddresses, func(word uint32) bool { return word&stk500v2ExtendedAddressFlag != 0 })
+	if extended < 0 || emulator.loadedAddresses[extended] != stk500v2ExtendedAddressFlag|0x20100/2 {
+		t.Fatalf("расширенный адрес не загружен: %x", emulator.loadedAddresses)
+	}
+	page, err := programmer.readPage(0x1000, atmega2560.pageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(page, emulator.flash[0x1000:0x1000+atmega2560.pageSize]) {
+		t.Fatal("прочитанная страница не совпадает с памятью загрузчика")
+	}
+	if err := programmer.close(); err != nil {
+		t.Fatal(err)
+	}
+	if emulator.progMode || !emulator.closed {
+		t.Fatal("загрузчик не выведен из режима программирования или порт не закрыт")
+	}
+}
+
+func TestSTK500v2Errors(t *testing.T) {
+	t.Run("неверная контрольная сумма ответа", func(t *testing.T) {
+		emulator := newSTK500v2Emulator(atmega2560)
+		emulator.corruptAnswers = true
+		_, err := startSTK500v2(context.Background(), emulator)
+		if err != errSTK500v2NoSync || !emulator.closed {
+			t.Fatalf("ошибка %v, порт закрыт: %v", err, emulator.closed)
+		}
+		programmer := &stk500v2{port: newSTK500v2Emulator(atmega2560)}
+		programmer.port.(*stk500v2Emulator).corruptAnswers = true
+		if _, err := programmer.command([]byte{STK2_CMD_SIGN_ON}); err == nil || !strings.Contains(err.Error(), "контрольная сумма") {
+			t.Fatalf("ошибка %v", err)
+		}
+	})
+	t.Run("загрузчик не принял контрольную сумму", func(t *testing.T) {
+		emulator := newSTK500v2Emulator(atmega2560)
+		emulator.rejectMessages = true
+		programmer := &stk500v2{port: emulator}
+		if _, err := programmer.command([]byte{STK2_CMD_SIGN_ON}); err == nil || !strings.Contains(err.Error(), "неожиданный ответ") {
+			t.Fatalf("ошибка %v", err)
+		}
+	})
+	t.Run("ошибка записи страницы", func(t *testing.T) {
+		emulator := newSTK500v2Emulator(atmega2560)
+		emulator.failWrite = true
+		programmer := &stk500v2{port: emulator}
+		msg, err := programFlash(context.Background(), programmer, atmega2560, testAVRImage(), nil)
+		if err == nil || !strings.Contains(msg, "статус 0xc0") {
+			t.Fatalf("сообщение %q, ошибка %v", msg, err)
+		}
+	})
+	t.Run("ответ на другое сообщение", func(t *testing.T) {
+		emulator := newSTK500v2Emulator(atmega2560)
+		emulator.wrongSequence = true
+		programmer := &stk500v2{port: emulator}
+		if _, err := programmer.command([]byte{STK2_CMD_SIGN_ON}); err == nil || !strings.Contains(err.Error(), "номер ответа") {
+			t.Fatalf("ошибка %v", err)
+		}
+	})
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/albenik/go-serial/v2"
+)
+
+// адрес начала flash-памяти STM32, если в шаблоне не указан flashBase
+const stm32DefaultFlashBase = 0x08000000
+
+/*
+Устройство на STM32, которое прошивается через системный загрузчик по USART (см. stm32Bootloader.go).
+
+Порт и серийный номер устройства (USB-UART адаптера) определяются так же, как у Arduino.
+*/
+type STM32 struct {
+	payload   STM32Payload
+	flashBase uint32
+	// размер flash-памяти из шаблона, 0, если он определяется по микроконтроллеру
+	flashSize int
+	// используется только для поиска и отслеживания порта устройства
+	port *Arduino
+}
+
+// метаданные устройства STM32
+type STM32MetaData struct {
+	Device            string `json:"device"`
+	PID               string `json:"pid"`
+	BootloaderVersion string `json:"bootloaderVersion"`
+	FlashSize         int    `json:"flashSize,omitempty"`
+}
+
+func init() {
+	registerBoardType(&BoardType{
+		Name:      "stm32",
+		Detection: SerialDetection,
+		New: func(temp BoardTemplate, found FoundDevice) Board {
+			return NewSTM32(temp, found.Ports[0], found.ArduinoOS, found.SerialID)
+		},
+		Refresh: func(old *Device, found *Device) bool {
+			oldPort := old.Board.(*STM32).port
+			newPort := found.Board.(*STM32).port
+			if oldPort.portName == newPort.portName {
+				return false
+			}
+			oldPort.portName = newPort.portName
+			return true
+		},
+		ProgressMsg:          FlashBacktrackMsg,
+		FlashesThroughSerial: true,
+		Timeouts: map[DeviceOperation]int{
+			FlashOperation:   180,
+			PingOperation:    15,
+			ResetOperation:   15,
+			MetaOperation:    15,
+			ExtractOperation: 180,
+		},
+	})
+}
+
+func NewSTM32(temp BoardTemplate, portName string, ardOS ArduinoOS, serialID string) *STM32 {
+	board := STM32{
+		flashBase: uint32(temp.FlashBase),
+		flashSize: temp.FlashSize,
+		port: &Arduino{
+			bootloaderID: -1,
+			serialID:     serialID,
+			portName:     portName,
+			ardOS:        ardOS,
+		},
+	}
+	if board.flashBase == 0 {
+		board.flashBase = stm32DefaultFlashBase
+	}
+	if len(temp.TypePayload) > 0 {
+		err := json.Unmarshal(temp.TypePayload, &board.payload)
+		if err != nil {
+			printLog("Error, wrong stm32 payload!", temp.Name, err.Error())
+		}
+	}
+	return &board
+}
+
+func (board *STM32) open(ctx context.Context) (*stm32Bootloader, error) {
+	return openSTM32Bootloader(ctx, board.port.portName, board.payload)
+}
+
+func (board *STM32) IsConnected() bool {
+	return board.port.IsConnected()
+}
+
+func (board *STM32) GetSerialPort() string {
+	return board.port.portName
+}
+
+/*
+Прошивка файлом в формате BIN (записывается с адреса flashBase), HEX или ELF (записываются по своим адресам).
+
+Flash-память полностью стирается, после записи прошивка сверяется с памятью устройства.
+Прогресс записи и проверки отправляется в logger, после завершения прошивки logger закрывается.
+*/
+func (board *STM32) Flash(ctx context.Context, filePath string, logger chan any) (string, error) {
+	if logger != nil {
+		defer close(logger)
+	}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return err.Error(), err
+	}
+	image, err := loadFirmwareImage(data, detectFirmwareFormat(data), board.flashBase)
+	if err != nil {
+		return err.Error(), err
+	}
+	if len(image.Segments) == 0 {
+		err = errors.New("файл прошивки не содержит данных")
+		return err.Error(), err
+	}
+	loader, err := board.open(ctx)
+	if err != nil {
+		return err.Error(), err
+	}
+	defer loader.close(board.flashBase)
+	err = loader.massErase()
+	if err != nil {
+		err = fmt.Errorf("не удалось стереть flash-память: %w", err)
+		return err.Error(), err
+	}
+	blocks := stm32Blocks(image)
+	reporter := newProgressReporter(logger, WRITING_STAGE)
+	for i, block := range blocks {
+		if ctx.Err() != nil {
+			return ctx.Err().Error(), ctx.Err()
+		}
+		err = loader.writeMemory(block.Address, block.Data)
+		if err != nil {
+			err = fmt.Errorf("не удалось записать блок по адресу 0x%08x: %w", block.Address, err)
+			return err.Error(), err
+		}
+		reporter.report(i+1, len(blocks))
+	}
+	reporter = newProgressReporter(logger, VERIFYING_STAGE)
+	for i, block := range blocks {
+		if ctx.Err() != nil {
+			return ctx.Err().Error(), ctx.Err()
+		}
+		read, err := loader.readMemory(block.Address, len(block.Data))
+		if err != nil {
+			err = fmt.Errorf("не удалось прочитать блок по адресу 0x%08x: %w", block.Address, err)
+			return err.Error(), err
+		}
+		if !bytes.Equal(read, block.Data) {
+			err = fmt.Errorf("прошивка не совпадает с памятью устройства в блоке по адресу 0x%08x", block.Address)
+			return err.Error(), err
+		}
+		reporter.report(i+1, len(blocks))
+	}
+	return fmt.Sprintf("%s: записано и проверено %d байт", loader.deviceName(), image.Size()), nil
+}
+
+// разбиение прошивки на блоки для WRITE_MEMORY и READ_MEMORY
+func stm32Blocks(image *FirmwareImage) []MemorySegment {
+	var blocks []MemorySegment
+	for _, segment := range image.Segments {
+		for offset := 0; offset < len(segment.Data); offset += stm32BlockSize {
+			end := min(offset+stm32BlockSize, len(segment.Data))
+			blocks = append(blocks, MemorySegment{
+				Address: segment.Address + uint32(offset),
+				Data:    segment.Data[offset:end],
+			})
+		}
+	}
+	return blocks
+}
+
+func (board *STM32) FlashPlan(filePath string) []string {
+	plan := []string{"перезагрузка в системный загрузчик (BOOT0 и NRST через линии порта)", "полное стирание flash-памяти"}
+	if data, err := os.ReadFile(filePath); err == nil {
+		if image, err := loadFirmwareImage(data, detectFirmwareFormat(data), board.flashBase); err == nil {
+			for _, segment := range image.Segments {
+				plan = append(plan, fmt.Sprintf("запись %d байт по адресу 0x%08x", len(segment.Data), segment.Address))
+			}
+		}
+	}
+	return append(plan, "проверка записанной прошивки", "запуск программы")
+}
+
+func (board *STM32) Update() bool {
+	return board.port.Update()
+}
+
+func (board *STM32) GetWebMessageType() string {
+	return DeviceMsg
+}
+
+func (board *STM32) GetWebMessage(name string, deviceID string) any {
+	return DeviceMessage{
+		ID:           deviceID,
+		Name:         name,
+		SerialID:     board.port.serialID,
+		PortName:     board.port.portName,
+		LastFirmware: deviceHistory.Last(deviceID),
+	}
+}
+
+// проверка связи с загрузчиком, после неё запускается программа устройства
+func (board *STM32) Ping(ctx context.Context) error {
+	loader, err := board.open(ctx)
+	if err != nil {
+		return err
+	}
+	return loader.close(board.flashBase)
+}
+
+// перезагрузка с низким уровнем на BOOT0, требует линии NRST
+func (board *STM32) Reset(ctx context.Context) error {
+	port, err := serial.Open(board.port.portName, serial.WithBaudrate(stm32DefaultBaud), serial.WithParity(serial.EvenParity))
+	if err != nil {
+		return err
+	}
+	defer port.Close()
+	loader := stm32Bootloader{port: port, payload: board.payload}
+	if loader.resetLine() == STM32_LINE_NONE {
+		return errors.New("линия порта для NRST не задана в описании устройства")
+	}
+	loader.setLine(loader.boot0Line(), false)
+	loader.pulseReset()
+	return nil
+}
+
+func (board *STM32) GetMetaData(ctx context.Context) (any, error) {
+	loader, err := board.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer loader.close(board.flashBase)
+	return STM32MetaData{
+		Device:            loader.deviceName(),
+		PID:               fmt.Sprintf("0x%03x", loader.pid),
+		BootloaderVersion: fmt.Sprintf("%d.%d", loader.version>>4, loader.version&0x0F),
+		FlashSize:         loader.flashSize(),
+	}, nil
+}
+
+// выгрузка всей flash-памяти, размер берётся из шаблона или из регистра микроконтроллера
+func (board *STM32) Extract(ctx context.Context) ([]byte, error) {
+	loader, err := board.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer loader.close(board.flashBase)
+	size := board.flashSize
+	if size <= 0 {
+		size = loader.flashSize()
+	}
+	if size <= 0 {
+		return nil, fmt.Errorf("размер flash-памяти %s неизвестен, укажите flashSize в описании устройства", loader.deviceName())
+	}
+	firmware := make([]byte, 0, size)
+	for offset := 0; offset < size; offset += stm32BlockSize {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		block, err := loader.readMemory(board.flashBase+uint32(offset), min(stm32BlockSize, size-offset))
+		if err != nil {
+			return nil, fmt.Errorf("не удалось прочитать память по адресу 0x%08x: %w", board.flashBase+uint32(offset), err)
+		}
+		firmware = append(firmware, block...)
+	}
+	return firmware, nil
+}
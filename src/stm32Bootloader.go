@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/albenik/go-serial/v2"
+)
+
+// команды и ответы системного загрузчика STM32 (AN3155, USART)
+const (
+	STM32_INIT           = 0x7F
+	STM32_ACK            = 0x79
+	STM32_NACK           = 0x1F
+	STM32_GET            = 0x00
+	STM32_GET_ID         = 0x02
+	STM32_READ_MEMORY    = 0x11
+	STM32_GO             = 0x21
+	STM32_WRITE_MEMORY   = 0x31
+	STM32_ERASE          = 0x43
+	STM32_EXTENDED_ERASE = 0x44
+)
+
+// линии порта для управления BOOT0 и NRST (поля boot0 и reset в typePayload)
+const (
+	STM32_LINE_RTS  = "rts"
+	STM32_LINE_DTR  = "dtr"
+	STM32_LINE_NONE = "none"
+)
+
+// максимальная скорость, которую загрузчик определяет автоматически
+const stm32DefaultBaud = 115200
+
+// максимальный размер данных в одной команде чтения или записи
+const stm32BlockSize = 256
+
+// время ожидания ответа на обычную команду
+const stm32Timeout = 1 * time.Second
+
+// время ожидания полного стирания flash-памяти
+const stm32EraseTimeout = 30 * time.Second
+
+// количество попыток синхронизации с загрузчиком
+const stm32InitAttempts = 5
+
+var errSTM32NACK = errors.New("загрузчик STM32 отклонил команду (NACK)")
+var errSTM32NoSync = errors.New("загрузчик STM32 не отвечает, проверьте, что при перезагрузке на BOOT0 подаётся высокий уровень")
+
+// микроконтроллер STM32, определяемый по PID из GET_ID
+type stm32Device struct {
+	name string
+	// адрес регистра с размером flash-памяти в килобайтах
+	flashSizeReg uint32
+}
+
+var stm32Devices = map[uint16]stm32Device{
+	0x412: {name: "STM32F10x (low-density)", flashSizeReg: 0x1FFFF7E0},
+	0x410: {name: "STM32F10x (medium-density)", flashSizeReg: 0x1FFFF7E0},
+	0x414: {name: "STM32F10x (high-density)", flashSizeReg: 0x1FFFF7E0},
+	0x444: {name: "STM32F03x", flashSizeReg: 0x1FFFF7CC},
+	0x440: {name: "STM32F05x/F030x8", flashSizeReg: 0x1FFFF7CC},
+	0x413: {name: "STM32F40x/F41x", flashSizeReg: 0x1FFF7A22},
+	0x431: {name: "STM32F411", flashSizeReg: 0x1FFF7A22},
+	0x466: {name: "STM32G03x/G04x", flashSizeReg: 0x1FFF75E0},
+	0x460: {name: "STM32G07x/G08x", flashSizeReg: 0x1FFF75E0},
+}
+
+// соединение с системным загрузчиком STM32
+type stm32Bootloader struct {
+	port    *serial.Port
+	payload STM32Payload
+	// версия загрузчика (старшие и младшие 4 бита - номер версии)
+	version byte
+	// true, если загрузчик поддерживает EXTENDED_ERASE вместо ERASE
+	extendedErase bool
+	pid           uint16
+}
+
+/*
+Открытие порта (8 бит, проверка на чётность), перезагрузка в системный загрузчик через линии BOOT0 и NRST,
+синхронизация и получение списка команд и PID.
+*/
+func openSTM32Bootloader(ctx context.Context, portName string, payload STM32Payload) (*stm32Bootloader, error) {
+	baud := payload.Baud
+	if baud <= 0 {
+		baud = stm32DefaultBaud
+	}
+	port, err := serial.Open(
+		portName,
+		serial.WithBaudrate(baud),
+		serial.WithParity(serial.EvenParity),
+		serial.WithReadTimeout(50),
+		serial.WithWriteTimeout(int(stm32Timeout.Milliseconds())),
+	)
+	if err != nil {
+		return nil, err
+	}
+	loader := &stm32Bootloader{port: port, payload: payload}
+	loader.resetToBootloader()
+	err = loader.init(ctx)
+	if err == nil {
+		err = loader.get()
+	}
+	if err == nil {
+		err = loader.getID()
+	}
+	if err != nil {
+		port.Close()
+		return nil, err
+	}
+	printLog(fmt.Sprintf("stm32: bootloader %d.%d, pid 0x%03x", loader.version>>4, loader.version&0x0F, loader.pid))
+	return loader, nil
+}
+
+/*
+Установка линии, управляющей BOOT0 или NRST.
+
+active - активное состояние сигнала (высокий уровень на BOOT0, низкий на NRST), по-умолчанию ему соответствует установленная линия.
+Ошибки игнорируются, так как не все порты поддерживают управление линиями.
+*/
+func (loader *stm32Bootloader) setLine(line string, active bool) {
+	level := active != loader.payload.InvertLines
+	switch line {
+	case STM32_LINE_RTS:
+		loader.port.SetRTS(level)
+	case STM32_LINE_DTR:
+		loader.port.SetDTR(level)
+	}
+}
+
+func (loader *stm32Bootloader) boot0Line() string {
+	if loader.payload.Boot0 == "" {
+		return STM32_LINE_RTS
+	}
+	return loader.payload.Boot0
+}
+
+func (loader *stm32Bootloader) resetLine() string {
+	if loader.payload.Reset == "" {
+		return STM32_LINE_DTR
+	}
+	return loader.payload.Reset
+}
+
+// перезагрузка с высоким уровнем на BOOT0, после которой запускается системный загрузчик
+func (loader *stm32Bootloader) resetToBootloader() {
+	loader.setLine(loader.boot0Line(), true)
+	loader.pulseReset()
+	loader.port.ResetInputBuffer()
+}
+
+func (loader *stm32Bootloader) pulseReset() {
+	loader.setLine(loader.resetLine(), true)
+	time.Sleep(50 * time.Millisecond)
+	loader.setLine(loader.resetLine(), false)
+	time.Sleep(100 * time.Millisecond)
+}
+
+/*
+Синхронизация: загрузчик определяет скорость по байту STM32_INIT.
+
+Если загрузчик уже синхронизирован (например, после предыдущей операции без перезагрузки), то он отвечает NACK.
+*/
+func (loader *stm32Bootloader) init(ctx context.Context) error {
+	for i := 0; i < stm32InitAttempts; i++ {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		_, err := loader.port.Write([]byte{STM32_INIT})
+		if err != nil {
+			return err
+		}
+		err = loader.readAck(stm32Timeout)
+		if err == nil || errors.Is(err, errSTM32NACK) {
+			return nil
+		}
+		printLog("stm32: init attempt", i+1, err.Error())
+		loader.port.ResetInputBuffer()
+	}
+	return errSTM32NoSync
+}
+
+func (loader *stm32Bootloader) readAck(timeout time.Duration) error {
+	response, err := readExactly(loader.port, 1, timeout)
+	if err != nil {
+		return err
+	}
+	switch response[0] {
+	case STM32_ACK:
+		return nil
+	case STM32_NACK:
+		return errSTM32NACK
+	}
+	return fmt.Errorf("неожиданный ответ загрузчика: 0x%02x", response[0])
+}
+
+// код команды передаётся вместе с его дополнением
+func (loader *stm32Bootloader) command(cmd byte) error {
+	_, err := loader.port.Write([]byte{cmd, ^cmd})
+	if err != nil {
+		return err
+	}
+	err = loader.readAck(stm32Timeout)
+	if err != nil {
+		return fmt.Errorf("команда 0x%02x: %w", cmd, err)
+	}
+	return nil
+}
+
+// отправка данных с контрольной суммой (XOR всех байтов)
+func (loader *stm32Bootloader) sendChecked(data []byte, timeout time.Duration) error {
+	var checksum byte
+	for _, b := range data {
+		checksum ^= b
+	}
+	_, err := loader.port.Write(append(data, checksum))
+	if err != nil {
+		return err
+	}
+	return loader.readAck(timeout)
+}
+
+func (loader *stm32Bootloader) sendAddress(address uint32) error {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, address)
+	err := loader.sendChecked(data, stm32Timeout)
+	if err != nil {
+		return fmt.Errorf("адрес 0x%08x: %w", address, err)
+	}
+	return nil
+}
+
+// версия загрузчика и список поддерживаемых команд
+func (loader *stm32Bootloader) get() error {
+	err := loader.command(STM32_GET)
+	if err != nil {
+		return err
+	}
+	size, err := readExactly(loader.port, 1, stm32Timeout)
+	if err != nil {
+		return err
+	}
+	data, err := readExactly(loader.port, int(size[0])+1, stm32Timeout)
+	if err != nil {
+		return err
+	}
+	loader.version = data[0]
+	for _, cmd := range data[1:] {
+		if cmd == STM32_EXTENDED_ERASE {
+			loader.extendedErase = true
+		}
+	}
+	return loader.readAck(stm32Timeout)
+}
+
+func (loader *stm32Bootloader) getID() error {
+	err := loader.command(STM32_GET_ID)
+	if err != nil {
+		return err
+	}
+	size, err := readExactly(loader.port, 1, stm32Timeout)
+	if err != nil {
+		return err
+	}
+	data, err := readExactly(loader.port, int(size[0])+1, stm32Timeout)
+	if err != nil {
+		return err
+	}
+	if len(data) < 2 {
+		return errors.New("некорректный ответ на GET_ID")
+	}
+	loader.pid = binary.BigEndian.Uint16(data[len(data)-2:])
+	return loader.readAck(stm32Timeout)
+}
+
+// название микроконтроллера по PID
+func (loader *stm32Bootloader) deviceName() string {
+	if device, exists := stm32Devices[loader.pid]; exists {
+		return device.name
+	}
+	return fmt.Sprintf("STM32 (PID 0x%03x)", loader.pid)
+}
+
+// размер flash-памяти из регистра микроконтроллера, 0, если микроконтроллер неизвестен
+func (loader *stm32Bootloader) flashSize() int {
+	device, exists := stm32Devices[loader.pid]
+	if !exists {
+		return 0
+	}
+	data, err := loader.readMemory(device.flashSizeReg, 2)
+	if err != nil {
+		printLog("stm32: can't read flash size:", err.Error())
+		return 0
+	}
+	return int(binary.LittleEndian.Uint16(data)) * 1024
+}
+
+func (loader *stm32Bootloader) readMemory(address uint32, size int) ([]byte, error) {
+	err := loader.command(STM32_READ_MEMORY)
+	if err != nil {
+		return nil, err
+	}
+	err = loader.sendAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	count := byte(size - 1)
+	_, err = loader.port.Write([]byte{count, ^count})
+	if err != nil {
+		return nil, err
+	}
+	err = loader.readAck(stm32Timeout)
+	if err != nil {
+		return nil, err
+	}
+	return readExactly(loader.port, size, stm32Timeout)
+}
+
+// запись блока (не больше stm32BlockSize байт), размер дополняется до кратного 4 значением стёртой памяти
+func (loader *stm32Bootloader) writeMemory(address uint32, data []byte) error {
+	data = append([]byte(nil), data...)
+	for len(data)%4 != 0 {
+		data = append(data, 0xFF)
+	}
+	err := loader.command(STM32_WRITE_MEMORY)
+	if err != nil {
+		return err
+	}
+	err = loader.sendAddress(address)
+	if err != nil {
+		return err
+	}
+	return loader.sendChecked(append([]byte{byte(len(data) - 1)}, data...), stm32Timeout)
+}
+
+// полное стирание flash-памяти
+func (loader *stm32Bootloader) massErase() error {
+	if loader.extendedErase {
+		err := loader.command(STM32_EXTENDED_ERASE)
+		if err != nil {
+			return err
+		}
+		// 0xFFFF - полное стирание, 0x00 - контрольная сумма
+		_, err = loader.port.Write([]byte{0xFF, 0xFF, 0x00})
+		if err != nil {
+			return err
+		}
+		return loader.readAck(stm32EraseTimeout)
+	}
+	err := loader.command(STM32_ERASE)
+	if err != nil {
+		return err
+	}
+	_, err = loader.port.Write([]byte{0xFF, 0x00})
+	if err != nil {
+		return err
+	}
+	return loader.readAck(stm32EraseTimeout)
+}
+
+func (loader *stm32Bootloader) jump(address uint32) error {
+	err := loader.command(STM32_GO)
+	if err != nil {
+		return err
+	}
+	return loader.sendAddress(address)
+}
+
+/*
+Запуск записанной программы и закрытие порта.
+
+Если задана линия NRST, то устройство перезагружается с низким уровнем на BOOT0, иначе выполняется команда GO по адресу flashBase.
+*/
+func (loader *stm32Bootloader) close(flashBase uint32) error {
+	if loader.resetLine() != STM32_LINE_NONE {
+		loader.setLine(loader.boot0Line(), false)
+		loader.pulseReset()
+	} else if err := loader.jump(flashBase); err != nil {
+		printLog("stm32: can't start program:", err.Error())
+	}
+	return loader.port.Close()
+}
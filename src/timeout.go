@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// операция с устройством, для которой задаётся максимальное время выполнения
+type DeviceOperation string
+
+const (
+	// прошивка устройства
+	FlashOperation DeviceOperation = "flash"
+	// пинг устройства
+	PingOperation DeviceOperation = "ping"
+	// перезагрузка устройства
+	ResetOperation DeviceOperation = "reset"
+	// получение метаданных (и адреса для МС-ТЮК)
+	MetaOperation DeviceOperation = "meta"
+	// выгрузка прошивки из устройства
+	ExtractOperation DeviceOperation = "extract"
+	// сравнение прошивки устройства с файлом
+	VerifyOperation DeviceOperation = "verify"
+	// чтение и запись fuse-битов
+	FuseOperation DeviceOperation = "fuses"
+)
+
+// время ожидания (в секундах), используемое, если для типа устройства не задано своё значение
+var fallbackTimeouts = map[DeviceOperation]int{
+	FlashOperation:   120,
+	PingOperation:    15,
+	ResetOperation:   15,
+	MetaOperation:    15,
+	ExtractOperation: 120,
+	VerifyOperation:  120,
+	FuseOperation:    30,
+}
+
+/*
+Максимальное время выполнения операции op для устройств этого шаблона.
+
+Сначала используется значение из поля timeouts шаблона, затем значение по-умолчанию для типа устройства,
+затем общее значение по-умолчанию.
+*/
+func (temp *BoardTemplate) Timeout(op DeviceOperation) time.Duration {
+	if seconds, ok := temp.Timeouts[op]; ok && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultTimeout(temp.Type, op)
+}
+
+// время ожидания операции op для устройств типа typeName без учёта настроек шаблона (см. BoardType.Timeouts)
+func defaultTimeout(typeName string, op DeviceOperation) time.Duration {
+	if boardType, exists := findBoardType(typeName); exists {
+		if seconds, ok := boardType.Timeouts[op]; ok {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return time.Duration(fallbackTimeouts[op]) * time.Second
+}
+
+// контекст для выполнения операции op над устройством, завершается по истечению времени ожидания или при отмене parent
+func (dev *Device) operationContext(parent context.Context, op DeviceOperation) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, dev.TypeDesc.Timeout(op))
+}
+
+// true, если операция была прервана из-за превышения времени ожидания
+func isTimeout(ctx context.Context) bool {
+	return errors.Is(ctx.Err(), context.DeadlineExceeded)
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// константы формата UF2 (https://github.com/microsoft/uf2)
+const (
+	UF2_MAGIC_START0 = 0x0A324655
+	UF2_MAGIC_START1 = 0x9E5D5157
+	UF2_MAGIC_END    = 0x0AB16F30
+	// флаг: вместо размера файла в блоке указан идентификатор семейства
+	UF2_FLAG_FAMILY_ID = 0x00002000
+)
+
+// размер UF2-блока и количество байт прошивки в нём
+const uf2BlockSize = 512
+const uf2PayloadSize = 256
+
+// файл, по которому накопитель определяется как UF2-загрузчик
+const uf2InfoFile = "INFO_UF2.TXT"
+
+// имя файла, в который копируется прошивка
+const uf2FirmwareFile = "FIRMWARE.UF2"
+
+// максимальное время ожидания отключения накопителя после копирования прошивки
+const uf2EjectTimeout = 30 * time.Second
+
+// промежуток между проверками отключения накопителя
+const uf2PollInterval = 200 * time.Millisecond
+
+// количество UF2-блоков, записываемых за один раз (между отправками прогресса)
+const uf2WriteChunk = 16
+
+/*
+Устройство, которое прошивается копированием UF2-файла на накопитель загрузчика (RP2040 и другие).
+
+Накопители ищутся в папках uf2MountRoots по файлу INFO_UF2.TXT и сопоставляются с шаблонами по полю Board-ID.
+*/
+type UF2 struct {
+	payload UF2Payload
+	// 0, если семейство не указано
+	familyID  uint32
+	flashBase uint32
+	// папка, в которую смонтирован накопитель
+	drive string
+	// поля INFO_UF2.TXT
+	info map[string]string
+}
+
+func init() {
+	registerBoardType(&BoardType{
+		Name:      "uf2",
+		Detection: CustomDetection,
+		Detect:    detectUF2,
+		Refresh: func(old *Device, found *Device) bool {
+			old.Board.(*UF2).info = found.Board.(*UF2).info
+			return false
+		},
+		ProgressMsg: FlashBacktrackMsg,
+		Timeouts: map[DeviceOperation]int{
+			FlashOperation: 120,
+			PingOperation:  5,
+			MetaOperation:  5,
+		},
+	})
+}
+
+// папки, в которые ОС монтирует накопители по-умолчанию
+func defaultUF2MountRoots() string {
+	var roots []string
+	switch runtime.GOOS {
+	case "windows":
+		for letter := 'C'; letter <= 'Z'; letter++ {
+			roots = append(roots, string(letter)+`:\`)
+		}
+	case "darwin":
+		roots = []string{"/Volumes"}
+	default:
+		roots = []string{"/media", "/run/media", "/mnt"}
+		if user := os.Getenv("USER"); user != "" {
+			roots = append(roots, filepath.Join("/media", user), filepath.Join("/run/media", user))
+		}
+	}
+	return strings.Join(roots, string(os.PathListSeparator))
+}
+
+/*
+Накопители UF2-загрузчиков: сами папки из roots и их подпапки, в которых есть INFO_UF2.TXT.
+
+Корень диска Windows (например, E:\) проверяется только сам: накопитель на Windows всегда монтируется в корень диска,
+а обход папок на системном, сетевом или пустом съёмном диске при каждом обновлении списка устройств может занимать много времени.
+*/
+func findUF2Drives(roots string) []string {
+	var drives []string
+	for _, root := range filepath.SplitList(roots) {
+		if root == "" {
+			continue
+		}
+		if isUF2Drive(root) {
+			drives = append(drives, filepath.Clean(root))
+			continue
+		}
+		if isDriveRoot(root) {
+			continue
+		}
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			drive := filepath.Join(root, entry.Name())
+			if entry.IsDir() && isUF2Drive(drive) {
+				drives = append(drives, drive)
+			}
+		}
+	}
+	return drives
+}
+
+// true, если path - корень диска Windows (C:\, E:\ и т.д.), на других ОС всегда false
+func isDriveRoot(path string) bool {
+	volume := filepath.VolumeName(path)
+	return volume != "" && filepath.Clean(path) == volume+string(filepath.Separator)
+}
+
+func isUF2Drive(dir string) bool {
+	info, err := os.Stat(filepath.Join(dir, uf2InfoFile))
+	return err == nil && !info.IsDir()
+}
+
+/*
+Чтение INFO_UF2.TXT: строки вида "Ключ: значение", первая строка (версия загрузчика) сохраняется с ключом Bootloader.
+*/
+func readUF2Info(drive string) (map[string]string, error) {
+	data, err := os.ReadFile(filepath.Join(drive, uf2InfoFile))
+	if err != nil {
+		return nil, err
+	}
+	info := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			if _, exists := info["Bootloader"]; !exists {
+				info["Bootloader"] = line
+			}
+			continue
+		}
+		info[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return info, nil
+}
+
+// поиск накопителей UF2-загрузчиков и подходящих им шаблонов, ID устройства - папка накопителя
+func detectUF2(templates []BoardTemplate) map[string]*Device {
+	devs := make(map[string]*Device)
+	for _, drive := range findUF2Drives(uf2MountRoots) {
+		info, err := readUF2Info(drive)
+		if err != nil {
+			printLog("uf2: can't read info:", err.Error())
+			continue
+		}
+		temp := findUF2Template(templates, info["Board-ID"])
+		if temp == nil {
+			printLog("uf2: no template for drive", drive, "board id", info["Board-ID"])
+			continue
+		}
+		devs["uf2:"+drive] = newDevice(*temp, NewUF2(*temp, drive, info))
+	}
+	return devs
+}
+
+// первый шаблон типа uf2, boardID которого является началом Board-ID накопителя
+func findUF2Template(templates []BoardTemplate, boardID string) *BoardTemplate {
+	for i := range templates {
+		if templates[i].Type != "uf2" {
+			continue
+		}
+		var payload UF2Payload
+		if len(templates[i].TypePayload) > 0 {
+			if err := json.Unmarshal(templates[i].TypePayload, &payload); err != nil {
+				continue
+			}
+		}
+		if strings.HasPrefix(boardID, payload.BoardID) {
+			return &templates[i]
+		}
+	}
+	return nil
+}
+
+func NewUF2(temp BoardTemplate, drive string, info map[string]string) *UF2 {
+	board := UF2{
+		flashBase: uint32(temp.FlashBase),
+		drive:     drive,
+		info:      info,
+	}
+	if len(temp.TypePayload) > 0 {
+		err := json.Unmarshal(temp.TypePayload, &board.payload)
+		if err != nil {
+			printLog("Error, wrong uf2 payload!", temp.Name, err.Error())
+		}
+	}
+	if board.payload.FamilyID != "" {
+		familyID, err := strconv.ParseUint(board.payload.FamilyID, 0, 32)
+		if err != nil {
+			printLog("Error, wrong uf2 familyID!", temp.Name, err.Error())
+		}
+		board.familyID = uint32(familyID)
+	}
+	return &board
+}
+
+// true, если данные уже в формате UF2
+func isUF2(data []byte) bool {
+	return len(data) >= uf2BlockSize && len(data)%uf2BlockSize == 0 &&
+		binary.LittleEndian.Uint32(data[0:]) == UF2_MAGIC_START0 &&
+		binary.LittleEndian.Uint32(data[4:]) == UF2_MAGIC_START1
+}
+
+/*
+Преобразование образа прошивки в UF2: данные разбиваются на страницы по 256 байт, выровненные по их размеру,
+незаполненные байты страниц заполняются binPadding.
+*/
+func buildUF2(image *FirmwareImage, familyID uint32) []byte {
+	pages := make(map[uint32][]byte)
+	for _, segment := range image.Segments {
+		for i, b := range segment.Data {
+			address := segment.Address + uint32(i)
+			pageAddress := address &^ (uf2PayloadSize - 1)
+			page, exists := pages[pageAddress]
+			if !exists {
+				page = bytes.Repeat([]byte{binPadding}, uf2PayloadSize)
+				pages[pageAddress] = page
+			}
+			page[address-pageAddress] = b
+		}
+	}
+	addresses := make([]uint32, 0, len(pages))
+	for address := range pages {
+		addresses = append(addresses, address)
+	}
+	sort.Slice(addresses, func(i, j int) bool { return addresses[i] < addresses[j] })
+	var flags uint32
+	if familyID != 0 {
+		flags = UF2_FLAG_FAMILY_ID
+	}
+	uf2 := make([]byte, 0, len(addresses)*uf2BlockSize)
+	for blockNo, address := range addresses {
+		block := make([]byte, uf2BlockSize)
+		header := []uint32{UF2_MAGIC_START0, UF2_MAGIC_START1, flags, address, uf2PayloadSize, uint32(blockNo), uint32(len(addresses)), familyID}
+		for i, value := range header {
+			binary.LittleEndian.PutUint32(block[4*i:], value)
+		}
+		copy(block[32:], pages[address])
+		binary.LittleEndian.PutUint32(block[uf2BlockSize-4:], UF2_MAGIC_END)
+		uf2 = append(uf2, block...)
+	}
+	return uf2
+}
+
+// содержимое UF2-файла для прошивки файлом filePath (UF2, BIN, HEX или ELF)
+func (board *UF2) firmware(filePath string) ([]byte, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if isUF2(data) {
+		return data, nil
+	}
+	image, err := loadFirmwareImage(data, detectFirmwareFormat(data), board.flashBase)
+	if err != nil {
+		return nil, err
+	}
+	if len(image.Segments) == 0 {
+		return nil, errors.New("файл прошивки не содержит данных")
+	}
+	return buildUF2(image, board.familyID), nil
+}
+
+func (board *UF2) IsConnected() bool {
+	return isUF2Drive(board.drive)
+}
+
+// у накопителя нет serial-порта
+func (board *UF2) GetSerialPort() string {
+	return ""
+}
+
+/*
+Копирование прошивки на накопитель и ожидание его отключения (загрузчик перезагружает устройство после получения всех блоков).
+
+Прогресс копирования отправляется в logger, после завершения прошивки logger закрывается.
+*/
+func (board *UF2) Flash(ctx context.Context, filePath string, logger chan any) (string, error) {
+	if logger != nil {
+		defer close(logger)
+	}
+	uf2, err := board.firmware(filePath)
+	if err != nil {
+		return err.Error(), err
+	}
+	err = board.copyFirmware(ctx, uf2, newProgressReporter(logger, WRITING_STAGE))
+	// устройство может перезагрузиться раньше, чем ОС завершит запись, поэтому ошибка игнорируется, если накопитель отключился
+	if err != nil && (ctx.Err() != nil || board.IsConnected()) {
+		return err.Error(), err
+	}
+	err = board.waitEject(ctx)
+	if err != nil {
+		return err.Error(), err
+	}
+	return fmt.Sprintf("скопировано %d UF2-блоков на %s, устройство перезагрузилось", len(uf2)/uf2BlockSize, board.drive), nil
+}
+
+func (board *UF2) copyFirmware(ctx context.Context, uf2 []byte, reporter *progressReporter) error {
+	file, err := os.Create(filepath.Join(board.drive, uf2FirmwareFile))
+	if err != nil {
+		return err
+	}
+	chunkSize := uf2WriteChunk * uf2BlockSize
+	for offset := 0; offset < len(uf2); offset += chunkSize {
+		if ctx.Err() != nil {
+			file.Close()
+			return ctx.Err()
+		}
+		end := min(offset+chunkSize, len(uf2))
+		_, err = file.Write(uf2[offset:end])
+		if err != nil {
+			file.Close()
+			return err
+		}
+		reporter.report(end, len(uf2))
+	}
+	err = file.Sync()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (board *UF2) waitEject(ctx context.Context) error {
+	deadline := time.Now().Add(uf2EjectTimeout)
+	for board.IsConnected() {
+		if time.Now().After(deadline) {
+			return errors.New("накопитель не отключился после копирования прошивки, возможно, загрузчик не принял файл")
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(uf2PollInterval):
+		}
+	}
+	return nil
+}
+
+func (board *UF2) FlashPlan(filePath string) []string {
+	conversion := "преобразование прошивки в UF2"
+	if board.familyID != 0 {
+		conversion += fmt.Sprintf(" (семейство 0x%08x)", board.familyID)
+	}
+	if data, err := os.ReadFile(filePath); err == nil && isUF2(data) {
+		conversion = "файл уже в формате UF2, преобразование не требуется"
+	}
+	return []string{
+		conversion,
+		"копирование в " + filepath.Join(board.drive, uf2FirmwareFile),
+		"ожидание отключения накопителя",
+	}
+}
+
+// данные обновляются при каждом поиске (см. Refresh)
+func (board *UF2) Update() bool {
+	return false
+}
+
+func (board *UF2) GetWebMessageType() string {
+	return DeviceMsg
+}
+
+// сообщение о UF2-устройстве, поля DeviceMessage дополняются папкой накопителя
+type UF2DeviceMessage struct {
+	DeviceMessage
+	// папка, в которую смонтирован накопитель
+	Drive string `json:"drive"`
+}
+
+func (board *UF2) GetWebMessage(name string, deviceID string) any {
+	return UF2DeviceMessage{
+		DeviceMessage: DeviceMessage{
+			ID:           deviceID,
+			Name:         name,
+			LastFirmware: deviceHistory.Last(deviceID),
+		},
+		Drive: board.drive,
+	}
+}
+
+func (board *UF2) Ping(ctx context.Context) error {
+	if !board.IsConnected() {
+		return errors.New("накопитель не найден")
+	}
+	return nil
+}
+
+func (board *UF2) Reset(ctx context.Context) error {
+	return errors.New("устройство в режиме UF2-загрузчика не поддерживает перезагрузку")
+}
+
+// поля INFO_UF2.TXT
+func (board *UF2) GetMetaData(ctx context.Context) (any, error) {
+	return board.info, nil
+}
+
+func (board *UF2) Supports(op DeviceOperation) bool {
+	return op != ResetOperation
+}
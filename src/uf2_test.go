@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// поле заголовка UF2-блока с номером index (каждое поле - 4 байта)
+func uf2Header(block []byte, index int) uint32 {
+	return binary.LittleEndian.Uint32(block[4*index:])
+}
+
+func TestBuildUF2(t *testing.T) {
+	tests := []struct {
+		name     string
+		segments []MemorySegment
+		familyID uint32
+		// адреса страниц в порядке блоков
+		pages []uint32
+	}{
+		{
+			name:     "одна выровненная страница",
+			segments: []MemorySegment{{Address: 0x10000000, Data: bytes.Repeat([]byte{0xAA}, 256)}},
+			familyID: 0xe48bff56,
+			pages:    []uint32{0x10000000},
+		},
+		{
+			name:     "участок пересекает границу страницы",
+			segments: []MemorySegment{{Address: 0x100000F0, Data: bytes.Repeat([]byte{0x11}, 32)}},
+			familyID: 0xe48bff56,
+			pages:    []uint32{0x10000000, 0x10000100},
+		},
+		{
+			name: "несколько участков на одной странице и промежуток",
+			segments: []MemorySegment{
+				{Address: 0x10, Data: []byte{1, 2}},
+				{Address: 0x20, Data: []byte{3}},
+				{Address: 0x1000, Data: []byte{4}},
+			},
+			pages: []uint32{0x0, 0x1000},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			image := &FirmwareImage{Segments: test.segments}
+			uf2 := buildUF2(image, test.familyID)
+			if !isUF2(uf2) {
+				t.Fatal("результат не распознаётся как UF2")
+			}
+			if len(uf2) != len(test.pages)*uf2BlockSize {
+				t.Fatalf("размер %d, ожидалось %d блоков", len(uf2), len(test.pages))
+			}
+			wantFlags := uint32(0)
+			if test.familyID != 0 {
+				wantFlags = UF2_FLAG_FAMILY_ID
+			}
+			for blockNo, pageAddress := range test.pages {
+				block := uf2[blockNo*uf2BlockSize : (blockNo+1)*uf2BlockSize]
+				if flags := uf2Header(block, 2); flags != wantFlags {
+					t.Errorf("блок %d: флаги 0x%x, ожидалось 0x%x", blockNo, flags, wantFlags)
+				}
+				if address := uf2Header(block, 3); address != pageAddress {
+					t.Errorf("блок %d: адрес 0x%x, ожидалось 0x%x", blockNo, address, pageAddress)
+				}
+				if size := uf2Header(block, 4); size != uf2PayloadSize {
+					t.Errorf("блок %d: размер данных %d", blockNo, size)
+				}
+				if no, total := uf2Header(block, 5), uf2Header(block, 6); no != uint32(blockNo) || total != uint32(len(test.pages)) {
+					t.Errorf("блок %d: номер %d из %d", blockNo, no, total)
+				}
+				if familyID := uf2Header(block, 7); familyID != test.familyID {
+					t.Errorf("блок %d: семейство 0x%x", blockNo, familyID)
+				}
+				if end := binary.LittleEndian.Uint32(block[uf2BlockSize-4:]); end != UF2_MAGIC_END {
+					t.Errorf("блок %d: неправильный конец блока 0x%x", blockNo, end)
+				}
+				payload := block[32 : 32+uf2PayloadSize]
+				for i, b := range payload {
+					address := pageAddress + uint32(i)
+					want, inImage := image.byteAt(address)
+					if !inImage {
+						want = binPadding
+					}
+					if b != want {
+						t.Fatalf("блок %d: байт по адресу 0x%x равен 0x%02x, ожидалось 0x%02x", blockNo, address, b, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+// создание папки накопителя с INFO_UF2.TXT (если info не пустая)
+func makeUF2Drive(t *testing.T, dir string, info string) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if info == "" {
+		return
+	}
+	if err := os.WriteFile(filepath.Join(dir, uf2InfoFile), []byte(info), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDetectUF2(t *testing.T) {
+	payload, _ := json.Marshal(UF2Payload{BoardID: "RPI-RP2", FamilyID: "0xe48bff56"})
+	templates := []BoardTemplate{
+		{ID: 0, Name: "Arduino Uno", Type: "arduino"},
+		{ID: 1, Name: "Raspberry Pi Pico", Type: "uf2", TypePayload: payload, FlashBase: 0x10000000},
+	}
+	root := t.TempDir()
+	picoDrive := filepath.Join(root, "RPI-RP2")
+	makeUF2Drive(t, picoDrive, "UF2 Bootloader v3.0\nModel: Raspberry Pi RP2\nBoard-ID: RPI-RP2\n")
+	makeUF2Drive(t, filepath.Join(root, "OTHER"), "UF2 Bootloader v1.0\nBoard-ID: SAMD21-Other\n")
+	makeUF2Drive(t, filepath.Join(root, "USB"), "")
+	// папка, которая сама является накопителем, указывается в списке папок напрямую
+	directDrive := t.TempDir()
+	makeUF2Drive(t, directDrive, "UF2 Bootloader v3.0\nBoard-ID: RPI-RP2-B1\n")
+
+	oldRoots := uf2MountRoots
+	defer func() { uf2MountRoots = oldRoots }()
+	uf2MountRoots = root + string(os.PathListSeparator) + directDrive + string(os.PathListSeparator) + filepath.Join(root, "missing")
+
+	devs := detectUF2(templates)
+	tests := []struct {
+		drive    string
+		bootInfo string
+		boardID  string
+	}{
+		{drive: picoDrive, bootInfo: "UF2 Bootloader v3.0", boardID: "RPI-RP2"},
+		{drive: directDrive, bootInfo: "UF2 Bootloader v3.0", boardID: "RPI-RP2-B1"},
+	}
+	if len(devs) != len(tests) {
+		t.Fatalf("найдено %d устройств, ожидалось %d: %v", len(devs), len(tests), devs)
+	}
+	for _, test := range tests {
+		dev, exists := devs["uf2:"+test.drive]
+		if !exists {
+			t.Errorf("накопитель %s не найден", test.drive)
+			continue
+		}
+		if dev.TypeDesc.ID != 1 {
+			t.Errorf("%s: шаблон %d", test.drive, dev.TypeDesc.ID)
+		}
+		board := dev.Board.(*UF2)
+		if board.drive != test.drive || board.familyID != 0xe48bff56 || board.flashBase != 0x10000000 {
+			t.Errorf("%s: неправильное устройство %+v", test.drive, board)
+		}
+		if board.info["Bootloader"] != test.bootInfo || board.info["Board-ID"] != test.boardID {
+			t.Errorf("%s: неправильно прочитан INFO_UF2.TXT: %v", test.drive, board.info)
+		}
+		if !board.IsConnected() {
+			t.Errorf("%s: накопитель не считается подключённым", test.drive)
+		}
+	}
+
+	if err := os.Remove(filepath.Join(picoDrive, uf2InfoFile)); err != nil {
+		t.Fatal(err)
+	}
+	if devs["uf2:"+picoDrive].Board.IsConnected() {
+		t.Error("накопитель без INFO_UF2.TXT считается подключённым")
+	}
+	if _, exists := detectUF2(templates)["uf2:"+picoDrive]; exists {
+		t.Error("накопитель без INFO_UF2.TXT найден повторно")
+	}
+}
+
+func TestIsDriveRoot(t *testing.T) {
+	tests := []struct {
+		path string
+		// результат на Windows, на других ОС корней дисков нет
+		windows bool
+	}{
+		{path: `E:\`, windows: true},
+		{path: `E:`, windows: false},
+		{path: `E:\RPI-RP2`, windows: false},
+		{path: "/media", windows: false},
+		{path: "/", windows: false},
+	}
+	for _, test := range tests {
+		want := test.windows && runtime.GOOS == "windows"
+		if got := isDriveRoot(test.path); got != want {
+			t.Errorf("isDriveRoot(%q) = %v, ожидалось %v", test.path, got, want)
+		}
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 // exists returns whether the given file or directory exists
@@ -26,3 +28,15 @@ func getAbolutePath(path string) string {
 	}
 	return abspath
 }
+
+// команда в виде строки для вывода клиенту, аргументы с пробелами и кавычками заключаются в кавычки
+func formatCommand(name string, args []string) string {
+	quoted := make([]string, 0, len(args)+1)
+	for _, arg := range append([]string{name}, args...) {
+		if arg == "" || strings.ContainsAny(arg, " \t\"'") {
+			arg = strconv.Quote(arg)
+		}
+		quoted = append(quoted, arg)
+	}
+	return strings.Join(quoted, " ")
+}
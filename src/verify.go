@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"os"
+)
+
+// результат сравнения прошивки устройства с файлом
+type VerifyResult struct {
+	// true, если прошивка устройства совпадает с файлом
+	Match bool
+	// адрес первого несовпадающего байта, -1, если прошивки совпадают
+	Address int
+	// сообщение от прошивающей программы
+	Message string
+}
+
+/*
+Устройство, прошивку которого можно сравнить с файлом без перезаписи.
+
+Проверка прерывается при отмене контекста ctx.
+Если logger не nil, то после завершения проверки он закрывается.
+*/
+type Verifier interface {
+	Verify(ctx context.Context, filePath string, logger chan any) (VerifyResult, error)
+}
+
+// побайтовое сравнение ожидаемой прошивки с выгруженной из устройства, адрес отсчитывается от начала файла
+func compareFirmware(expected []byte, actual []byte) VerifyResult {
+	for i := range expected {
+		if i >= len(actual) || expected[i] != actual[i] {
+			return VerifyResult{Match: false, Address: i}
+		}
+	}
+	return VerifyResult{Match: true, Address: -1}
+}
+
+// сравнение файла filePath с прошивкой, полученной через extract
+func verifyExtracted(filePath string, extract func() ([]byte, error)) (VerifyResult, error) {
+	expected, err := os.ReadFile(filePath)
+	if err != nil {
+		return VerifyResult{Address: -1, Message: err.Error()}, err
+	}
+	actual, err := extract()
+	if err != nil {
+		return VerifyResult{Address: -1, Message: err.Error()}, err
+	}
+	return compareFirmware(expected, actual), nil
+}
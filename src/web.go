@@ -49,7 +49,11 @@ func (m *WebSocketManager) setupEventHandlers() {
 	m.handlers[GetListMsg] = GetList
 	m.handlers[FlashStartMsg] = FlashStart
 	m.handlers[MSBinStartMsg] = FlashStart
+	m.handlers[VerifyStartMsg] = FlashStart
+	m.handlers[EEPROMWriteMsg] = FlashStart
+	m.handlers[EEPROMReadMsg] = EEPROMReadStart
 	m.handlers[FlashBinaryBlockMsg] = FlashBinaryBlock
+	m.handlers[FlashCancelMsg] = FlashCancel
 	m.handlers[GetMaxFileSizeMsg] = GetMaxFileSize
 	m.handlers[SerialConnectMsg] = SerialConnect
 	m.handlers[SerialDisconnectMsg] = SerialDisconnect
@@ -68,6 +72,12 @@ func (m *WebSocketManager) setupEventHandlers() {
 	m.handlers[pingMsg] = Ping
 	m.handlers[resetMsg] = Reset
 	m.handlers[GetMetaDataMsg] = GetMetaData
+	m.handlers[readFusesMsg] = ReadFuses
+	m.handlers[writeFusesMsg] = WriteFuses
+	m.handlers[inspectFirmwareMsg] = InspectFirmware
+	m.handlers[getDeviceHistoryMsg] = GetDeviceHistory
+	m.handlers[getBackupsMsg] = GetBackups
+	m.handlers[restoreBackupMsg] = RestoreBackup
 }
 
 // обработка нового соединения